@@ -0,0 +1,11 @@
+//go:build !windows
+// +build !windows
+
+package httpu
+
+import "golang.org/x/sys/unix"
+
+// dirWritable reports the error if the process can not create files in dir.
+func dirWritable(dir string) error {
+	return unix.Access(dir, unix.W_OK)
+}
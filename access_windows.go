@@ -0,0 +1,21 @@
+package httpu
+
+import (
+	"errors"
+	"os"
+)
+
+// dirWritable reports the error if the process can not create files in dir.
+func dirWritable(dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return errors.New("not a directory")
+	}
+	if info.Mode().Perm()&0200 == 0 {
+		return os.ErrPermission
+	}
+	return nil
+}
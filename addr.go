@@ -1,12 +1,15 @@
 package httpu
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net"
 	"os"
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 )
 
 type Addr string
@@ -19,35 +22,192 @@ func (a Addr) UnixPath() string {
 }
 
 func (a Addr) Network() (net string, addr string) {
-	parts := strings.SplitN(string(a), ":", 2)
-	switch parts[0] {
-	case "tcp", "tcp4", "tcp6", "unix":
-		return parts[0], parts[1]
-	default:
-		return "tcp", string(a)
+	if net, addr, ok := strings.Cut(string(a), ":"); ok {
+		switch net {
+		case "tcp", "tcp4", "tcp6", "unix":
+			return net, addr
+		}
 	}
+	return "tcp", string(a)
 }
 
-func (a Addr) CreateListener() (net.Listener, error) {
+// Parse parses the address. The address format is `[NETWORK:]HOST:PORT`,
+// where NETWORK is one of "tcp" (default), "tcp4" or "tcp6", HOST is
+// a hostname, IPv4, or IPv6 in brackets with optional zone (like
+// `[fe80::1%eth0]`) and PORT is a number or a service name (like "http"), or
+// `unix:PATH` for unix sockets.
+func (a Addr) Parse() (p *ParsedAddr, err error) {
+	if a == "" {
+		return nil, errors.New("empty address")
+	}
+	if !strings.Contains(string(a), ":") {
+		return nil, fmt.Errorf("invalid addr %q: missing port or unix socket path", a)
+	}
 	network, addr := a.Network()
+	p = &ParsedAddr{Network: network}
 	if network == "unix" {
-		if _, err := os.Stat(addr); err != nil {
-			if !os.IsNotExist(err) {
-				return nil, err
-			}
-		} else if err = syscall.Unlink(addr); err != nil {
-			return nil, err
+		if addr == "" {
+			return nil, fmt.Errorf("invalid addr %q: empty unix socket path", a)
 		}
+		p.UnixPath = addr
+		return
 	}
-	return net.Listen(network, strings.TrimPrefix(string(a), network+":"))
+
+	var port string
+	if p.Host, port, err = net.SplitHostPort(addr); err != nil {
+		return nil, fmt.Errorf("invalid addr %q: %v", a, err)
+	}
+	if i := strings.LastIndexByte(p.Host, '%'); i >= 0 {
+		p.Host, p.Zone = p.Host[:i], p.Host[i+1:]
+		if p.Zone == "" {
+			return nil, fmt.Errorf("invalid addr %q: empty IPv6 zone", a)
+		}
+	}
+	if ip := net.ParseIP(p.Host); ip != nil {
+		if is4 := ip.To4() != nil; is4 && network == "tcp6" || !is4 && network == "tcp4" {
+			return nil, fmt.Errorf("invalid addr %q: IP %s does not match network %s", a, p.Host, network)
+		}
+		if p.Zone != "" && ip.To4() != nil {
+			return nil, fmt.Errorf("invalid addr %q: zone on IPv4 address", a)
+		}
+	} else if p.Zone != "" {
+		return nil, fmt.Errorf("invalid addr %q: zone on non IPv6 address", a)
+	}
+
+	if port == "" {
+		return
+	}
+	if p.Port, err = strconv.Atoi(port); err != nil {
+		if p.Port, err = net.LookupPort(network, port); err != nil {
+			return nil, fmt.Errorf("invalid addr %q: %v", a, err)
+		}
+		p.Service = port
+	} else if p.Port < 0 || p.Port > 65535 {
+		return nil, fmt.Errorf("invalid addr %q: port %d out of range", a, p.Port)
+	}
+	return
+}
+
+func (a Addr) CreateListener() (net.Listener, error) {
+	p, err := a.Parse()
+	if err != nil {
+		return nil, err
+	}
+	return p.Listen()
 }
 
+// Port returns the port number, or zero if the address is invalid or a unix
+// socket. Use Parse to get the parse error.
 func (a Addr) Port() int {
-	_, addr := a.Network()
-	parts := strings.Split(addr, ":")
-	if port, err := strconv.Atoi(parts[1]); err != nil {
-		panic(fmt.Errorf("Invalid addr %q: %v", addr, err))
-	} else {
-		return port
+	if p, err := a.Parse(); err == nil {
+		return p.Port
+	}
+	return 0
+}
+
+// ParsedAddr is the parsed Addr.
+type ParsedAddr struct {
+	// Network is "tcp", "tcp4", "tcp6" or "unix".
+	Network string
+	// Host is the hostname or IP, without brackets and zone.
+	Host string
+	// Zone is the IPv6 zone.
+	Zone string
+	// Port is the port number. If Service is set, it is the resolved service
+	// port.
+	Port int
+	// Service is the named port, like "http".
+	Service string
+	// UnixPath is the unix socket path.
+	UnixPath string
+}
+
+func (p *ParsedAddr) IsUnix() bool {
+	return p.Network == "unix"
+}
+
+// IsAbstract reports if is a Linux abstract unix socket, like `unix:@name`.
+func (p *ParsedAddr) IsAbstract() bool {
+	return p.IsUnix() && strings.HasPrefix(p.UnixPath, "@")
+}
+
+// Address returns the address for net.Listen.
+func (p *ParsedAddr) Address() string {
+	if p.IsUnix() {
+		return p.UnixPath
+	}
+	host := p.Host
+	if p.Zone != "" {
+		host += "%" + p.Zone
+	}
+	return net.JoinHostPort(host, strconv.Itoa(p.Port))
+}
+
+func (p *ParsedAddr) String() string {
+	if p.Network == "tcp" {
+		return p.Address()
+	}
+	return p.Network + ":" + p.Address()
+}
+
+// Resolve returns the parsed address of each IP of hostname. If the host is
+// empty or an IP, returns a slice with p only.
+func (p *ParsedAddr) Resolve(ctx context.Context) (addrs []*ParsedAddr, err error) {
+	if p.IsUnix() || p.Host == "" || net.ParseIP(p.Host) != nil {
+		return []*ParsedAddr{p}, nil
+	}
+	var ips []net.IPAddr
+	if ips, err = net.DefaultResolver.LookupIPAddr(ctx, p.Host); err != nil {
+		return
+	}
+	for _, ip := range ips {
+		is4 := ip.IP.To4() != nil
+		if is4 && p.Network == "tcp6" || !is4 && p.Network == "tcp4" {
+			continue
+		}
+		addr := *p
+		addr.Host, addr.Zone = ip.IP.String(), ip.Zone
+		addrs = append(addrs, &addr)
+	}
+	if len(addrs) == 0 {
+		err = fmt.Errorf("no %s addresses found for host %q", p.Network, p.Host)
+	}
+	return
+}
+
+// Listen creates the network listener. If the unix socket file exists, it is
+// removed only if no other process is serving on it. The unix socket file is
+// removed when the listener is closed.
+func (p *ParsedAddr) Listen() (net.Listener, error) {
+	return p.ListenConfig(&net.ListenConfig{})
+}
+
+// ListenConfig creates the network listener using lc. See Listen.
+func (p *ParsedAddr) ListenConfig(lc *net.ListenConfig) (net.Listener, error) {
+	if !p.IsUnix() {
+		return lc.Listen(context.Background(), p.Network, p.Address())
+	}
+	if !p.IsAbstract() {
+		if _, err := os.Stat(p.UnixPath); err != nil {
+			if !os.IsNotExist(err) {
+				return nil, err
+			}
+		} else {
+			if con, err := net.DialTimeout("unix", p.UnixPath, time.Second); err == nil {
+				con.Close()
+				return nil, fmt.Errorf("unix socket %q is in use by another process", p.UnixPath)
+			}
+			if err = syscall.Unlink(p.UnixPath); err != nil {
+				return nil, err
+			}
+		}
+	}
+	l, err := lc.Listen(context.Background(), "unix", p.UnixPath)
+	if err != nil {
+		return nil, err
+	}
+	if ul, ok := l.(*net.UnixListener); ok {
+		ul.SetUnlinkOnClose(!p.IsAbstract())
 	}
+	return l, nil
 }
@@ -0,0 +1,60 @@
+package httpu
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAddrParse(t *testing.T) {
+	for _, tt := range []struct {
+		addr Addr
+		want *ParsedAddr
+	}{
+		{":8080", &ParsedAddr{Network: "tcp", Port: 8080}},
+		{"localhost:80", &ParsedAddr{Network: "tcp", Host: "localhost", Port: 80}},
+		{"tcp4:127.0.0.1:80", &ParsedAddr{Network: "tcp4", Host: "127.0.0.1", Port: 80}},
+		{"tcp6:[fe80::1%eth0]:80", &ParsedAddr{Network: "tcp6", Host: "fe80::1", Zone: "eth0", Port: 80}},
+		{":http", &ParsedAddr{Network: "tcp", Port: 80, Service: "http"}},
+		{"unix:/tmp/x.sock", &ParsedAddr{Network: "unix", UnixPath: "/tmp/x.sock"}},
+		{"unix:@name", &ParsedAddr{Network: "unix", UnixPath: "@name"}},
+		{"", nil},
+		{"tcp", nil},
+		{"tcp6", nil},
+		{"unix", nil},
+		{"localhost", nil},
+		{"unix:", nil},
+		{"tcp4:[::1]:80", nil},
+		{"tcp6:127.0.0.1:80", nil},
+		{"127.0.0.1%eth0:80", nil},
+		{"[fe80::1%]:80", nil},
+		{":70000", nil},
+		{":no-such-service", nil},
+	} {
+		got, err := tt.addr.Parse()
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("%q: expected error, got %+v", tt.addr, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.addr, err)
+		} else if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: got %+v, want %+v", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestAddrNetwork(t *testing.T) {
+	for addr, want := range map[Addr][2]string{
+		"tcp":           {"tcp", "tcp"},
+		"unix":          {"tcp", "unix"},
+		"unix:/x.sock":  {"unix", "/x.sock"},
+		"tcp6:[::1]:80": {"tcp6", "[::1]:80"},
+		"localhost:80":  {"tcp", "localhost:80"},
+	} {
+		if net, a := addr.Network(); net != want[0] || a != want[1] {
+			t.Errorf("%q: got %s, %s", addr, net, a)
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package httpu
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+const CtxAssets ContextKey = 3
+
+// AssetFingerprintSize is the number of hex digits of asset fingerprints.
+const AssetFingerprintSize = 12
+
+// Asset is a file of AssetBundle.
+type Asset struct {
+	// Name is the file path in bundle, like "js/app.js".
+	Name string
+	// Path is the fingerprinted file path, like "js/app.3f2a9c1b5e7d.js".
+	Path        string
+	ContentType string
+	// ETag is the strong content hash etag.
+	ETag    string
+	ModTime time.Time
+	Data    []byte
+	// Encoded are the precompressed data by content coding.
+	Encoded map[string][]byte
+}
+
+// AssetBundleOptions specifies the AssetBundle.
+type AssetBundleOptions struct {
+	// Prefix is the path where the bundle is served, relative to the context
+	// prefix, like "static/".
+	Prefix string
+	// Precompress compresses the assets in memory at startup.
+	Precompress bool
+	// Compress is the encodings, min size and content types of
+	// precompression. If nil, DefaultCompressConfig is used.
+	Compress *CompressConfig
+	// ModTime is the assets modification time if the file system has none,
+	// like embed.FS.
+	ModTime time.Time
+}
+
+// AssetBundle serves the files of a fs.FS, like embed.FS, by fingerprinted
+// paths with immutable caching, and by plain paths without caching.
+type AssetBundle struct {
+	prefix string
+	assets map[string]*Asset
+	paths  map[string]*Asset
+}
+
+// NewAssetBundle indexes the files of fsys, except the hidden ones. If opts
+// is nil, no prefix and precompression are used.
+func NewAssetBundle(fsys fs.FS, opts *AssetBundleOptions) (b *AssetBundle, err error) {
+	if opts == nil {
+		opts = &AssetBundleOptions{}
+	}
+	cfg := opts.Compress
+	if cfg == nil {
+		cfg = DefaultCompressConfig
+	}
+	b = &AssetBundle{
+		prefix: strings.Trim(opts.Prefix, "/"),
+		assets: map[string]*Asset{},
+		paths:  map[string]*Asset{},
+	}
+	if b.prefix != "" {
+		b.prefix += "/"
+	}
+	err = fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if name != "." && strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+		var asset *Asset
+		if asset, err = newAsset(fsys, name, opts.ModTime); err != nil {
+			return err
+		}
+		if opts.Precompress && len(asset.Data) >= cfg.minSize() && cfg.Compressible(asset.ContentType) {
+			if err = asset.precompress(cfg.encodings()); err != nil {
+				return err
+			}
+		}
+		b.assets[asset.Name] = asset
+		b.paths[asset.Path] = asset
+		return nil
+	})
+	return
+}
+
+func newAsset(fsys fs.FS, name string, modTime time.Time) (asset *Asset, err error) {
+	var info fs.FileInfo
+	if info, err = fs.Stat(fsys, name); err != nil {
+		return
+	}
+	asset = &Asset{Name: name, ModTime: info.ModTime()}
+	if asset.ModTime.IsZero() {
+		asset.ModTime = modTime
+	}
+	if asset.Data, err = fs.ReadFile(fsys, name); err != nil {
+		return
+	}
+	sum := sha256.Sum256(asset.Data)
+	asset.ETag = hashETag(sum[:])
+	asset.Path = fingerprintPath(name, hex.EncodeToString(sum[:])[:AssetFingerprintSize])
+	if asset.ContentType = mime.TypeByExtension(path.Ext(name)); asset.ContentType == "" {
+		asset.ContentType = http.DetectContentType(asset.Data)
+	}
+	return
+}
+
+func (a *Asset) precompress(encodings []string) (err error) {
+	for _, name := range encodings {
+		e := GetEncoding(name)
+		if e == nil {
+			continue
+		}
+		var encoded []byte
+		if encoded, err = e.Encode(a.Data); err != nil {
+			return
+		}
+		if len(encoded) < len(a.Data) {
+			if a.Encoded == nil {
+				a.Encoded = map[string][]byte{}
+			}
+			a.Encoded[name] = encoded
+		}
+	}
+	return
+}
+
+// fingerprintPath returns name with fingerprint before extension, like
+// "app.3f2a9c1b5e7d.js" of "app.js".
+func fingerprintPath(name, fingerprint string) string {
+	dir, base := path.Split(name)
+	ext := path.Ext(base)
+	if ext == base {
+		ext = ""
+	}
+	return dir + strings.TrimSuffix(base, ext) + "." + fingerprint + ext
+}
+
+// Lookup returns the asset of name or nil.
+func (b *AssetBundle) Lookup(name string) *Asset {
+	return b.assets[strings.TrimPrefix(name, "/")]
+}
+
+// Path returns the fingerprinted path of name, relative to the context
+// prefix, like "static/app.3f2a9c1b5e7d.js". If name is not an asset, returns
+// the plain path.
+func (b *AssetBundle) Path(name string) string {
+	name = strings.TrimPrefix(name, "/")
+	if asset := b.assets[name]; asset != nil {
+		return b.prefix + asset.Path
+	}
+	return b.prefix + name
+}
+
+// Middleware returns a handler that adds the bundle and the current prefix to
+// the request context, used by AssetURL.
+func (b *AssetBundle) Middleware(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.ServeHTTP(w, SetAssetsR(r, b))
+	})
+}
+
+func (b *AssetBundle) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		RenderError(w, r, NewHttpError(http.StatusMethodNotAllowed, ""))
+		return
+	}
+	name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+	h := w.Header()
+	asset := b.paths[name]
+	if asset != nil {
+		h.Set("Cache-Control", "public, max-age=31536000, immutable")
+	} else if asset = b.assets[name]; asset != nil {
+		h.Set("Cache-Control", "no-cache")
+	} else {
+		NotFound(w, r)
+		return
+	}
+	asset.serve(w, r)
+}
+
+func (a *Asset) serve(w http.ResponseWriter, r *http.Request) {
+	h := w.Header()
+	h.Set("Content-Type", a.ContentType)
+	h.Set("Etag", a.ETag)
+
+	data := a.Data
+	if len(a.Encoded) > 0 {
+		AddVary(w, "Accept-Encoding")
+		offers := make([]string, 0, len(a.Encoded)+1)
+		for _, p := range DefaultPrecompressed {
+			if _, ok := a.Encoded[p.Encoding]; ok {
+				offers = append(offers, p.Encoding)
+			}
+		}
+		for name := range a.Encoded {
+			if !containsString(offers, name) {
+				offers = append(offers, name)
+			}
+		}
+		if encoding := NegotiateEncoding(nil, r, append(offers, "identity")...); encoding != "" && encoding != "identity" {
+			data = a.Encoded[encoding]
+			h.Set("Content-Encoding", encoding)
+			h.Set("Etag", VariantETag(a.ETag, encoding))
+		}
+	}
+
+	ServeContent(w, r, a.Name, a.ModTime, bytes.NewReader(data), func() (int64, error) {
+		return int64(len(data)), nil
+	})
+}
+
+type assetsContext struct {
+	bundle *AssetBundle
+	prefix string
+}
+
+// SetAssets returns a copy of ctx with the bundle, served under the prefix
+// of ctx.
+func SetAssets(ctx context.Context, b *AssetBundle) context.Context {
+	return context.WithValue(ctx, CtxAssets, &assetsContext{b, Prefix(ctx)})
+}
+
+func SetAssetsR(r *http.Request, b *AssetBundle) *http.Request {
+	return r.WithContext(SetAssets(r.Context(), b))
+}
+
+// AssetsOf returns the AssetBundle of context or nil.
+func AssetsOf(ctx context.Context) *AssetBundle {
+	if ac, ok := ctx.Value(CtxAssets).(*assetsContext); ok {
+		return ac.bundle
+	}
+	return nil
+}
+
+// AssetURL returns the URL path of the asset name, fingerprinted by the
+// request AssetBundle, like "/app/static/app.3f2a9c1b5e7d.js". Without
+// bundle, returns name under the request prefix.
+func AssetURL(r *http.Request, name string) string {
+	if ac, ok := r.Context().Value(CtxAssets).(*assetsContext); ok {
+		return ac.prefix + ac.bundle.Path(name)
+	}
+	return PrefixR(r) + strings.TrimPrefix(name, "/")
+}
@@ -0,0 +1,104 @@
+package httpu
+
+import (
+	"context"
+	"mime"
+	"net/http"
+	"strings"
+
+	post_limit "github.com/moisespsena-go/http-post-limit"
+)
+
+// BodyLimitConfig is the request body size limit of the paths starting with
+// Prefix and of ContentType.
+type BodyLimitConfig struct {
+	// Prefix is the request path prefix, like "/api/". If empty, matches all
+	// paths. The server limits are matched against the path without the
+	// Config.Prefix and the request prefix header, so Prefix does not
+	// include them.
+	Prefix string `mapstructure:"prefix" yaml:"prefix"`
+	// ContentType is the media range, like "application/json" or
+	// "multipart/*". If empty, matches all content types.
+	ContentType string `mapstructure:"content_type" yaml:"content_type"`
+	// MaxSize is the max body bytes. If zero, post_limit.DefaultMaxPostSize
+	// is used.
+	MaxSize int64 `mapstructure:"max_size" yaml:"max_size"`
+	// Unlimited disables the limit.
+	Unlimited bool `mapstructure:"unlimited" yaml:"unlimited"`
+}
+
+func (l *BodyLimitConfig) maxSize() int64 {
+	if l.MaxSize == 0 {
+		return post_limit.DefaultMaxPostSize
+	}
+	return l.MaxSize
+}
+
+// BodyLimits are the request body size limits by path prefix and content
+// type.
+type BodyLimits []BodyLimitConfig
+
+// Get returns the limit of the longest prefix matching path and, between
+// the same prefixes, of the most specific content type, or nil if none
+// matches.
+func (limits BodyLimits) Get(path, contentType string) (limit *BodyLimitConfig) {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	var prefixLen, quality int
+	for i := range limits {
+		l := &limits[i]
+		if !strings.HasPrefix(path, l.Prefix) {
+			continue
+		}
+		q := 0
+		if l.ContentType != "" {
+			// matchMediaType is 0 for "*/*", so the empty content type
+			// is the least specific
+			if q = matchMediaType(strings.ToLower(l.ContentType), mediaType) + 1; q == 0 {
+				continue
+			}
+		}
+		if limit == nil || len(l.Prefix) > prefixLen || len(l.Prefix) == prefixLen && q > quality {
+			limit, prefixLen, quality = l, len(l.Prefix), q
+		}
+	}
+	return
+}
+
+// BodyLimitHandler limits the request bodies size by the Limits, or the
+// Default limit. The requests with bigger Content-Length are replied with
+// 413 Request Entity Too Large, and the reads past the limit fail with
+// http.MaxBytesError, rendered by RenderError with the same response.
+//
+// The limit is also set as the request post size, returned by
+// post_limit.MaxPostSizeOf.
+type BodyLimitHandler struct {
+	Handler http.Handler
+	Default BodyLimitConfig
+	Limits  BodyLimits
+}
+
+// NewBodyLimitHandler creates the BodyLimitHandler.
+func NewBodyLimitHandler(handler http.Handler, defaultLimit BodyLimitConfig, limits ...BodyLimitConfig) *BodyLimitHandler {
+	return &BodyLimitHandler{Handler: handler, Default: defaultLimit, Limits: limits}
+}
+
+func (h *BodyLimitHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	limit := h.Limits.Get(r.URL.Path, r.Header.Get("Content-Type"))
+	if limit == nil {
+		limit = &h.Default
+	}
+	if limit.Unlimited {
+		h.Handler.ServeHTTP(w, r)
+		return
+	}
+	maxSize := limit.maxSize()
+	if r.ContentLength > maxSize {
+		RenderError(w, r, NewBodyTooLargeError(maxSize))
+		return
+	}
+	r = r.WithContext(context.WithValue(r.Context(), post_limit.PostSizeKey, maxSize))
+	if r.Body != nil && r.Body != http.NoBody {
+		r.Body = http.MaxBytesReader(w, r.Body, maxSize)
+	}
+	h.Handler.ServeHTTP(w, r)
+}
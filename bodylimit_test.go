@@ -0,0 +1,43 @@
+package httpu
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestServerBodyLimitPrefix(t *testing.T) {
+	cfg := &Config{
+		Prefix:      "/app/",
+		MaxPostSize: 10,
+		BodyLimits:  BodyLimits{{Prefix: "/upload/", MaxSize: 100}},
+	}
+	prepareConfig(cfg)
+	s := NewServer(cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := io.ReadAll(r.Body); err != nil {
+			RenderError(w, r, err)
+			return
+		}
+		io.WriteString(w, "ok")
+	}))
+	handler := s.buildHandler(cfg)
+
+	for _, tt := range []struct {
+		path string
+		size int
+		code int
+	}{
+		{"/app/upload/file", 50, http.StatusOK},
+		{"/app/upload/file", 150, http.StatusRequestEntityTooLarge},
+		{"/app/other", 50, http.StatusRequestEntityTooLarge},
+		{"/app/other", 5, http.StatusOK},
+	} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("POST", tt.path, strings.NewReader(strings.Repeat("x", tt.size))))
+		if w.Code != tt.code {
+			t.Errorf("POST %s of %d bytes: code = %d, want %d", tt.path, tt.size, w.Code, tt.code)
+		}
+	}
+}
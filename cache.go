@@ -0,0 +1,667 @@
+package httpu
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultCacheMaxBodySize is the max body size of cached responses if
+// CacheConfig.MaxBodySize is zero.
+const DefaultCacheMaxBodySize = 1 << 20
+
+// CacheStatusHeader is the RFC 9211 response header with the cache handling
+// of request.
+const CacheStatusHeader = "Cache-Status"
+
+// maxHeuristicFreshness is the max freshness lifetime of responses without
+// explicit expiration, computed from Last-Modified.
+const maxHeuristicFreshness = 24 * time.Hour
+
+// maxCacheVariants is the max number of stored variants of an URL.
+const maxCacheVariants = 64
+
+// CacheConfig specifies the response cache.
+type CacheConfig struct {
+	// Enabled enables the response cache of server handler.
+	Enabled bool `mapstructure:"enabled" yaml:"enabled"`
+	// MaxSize is the max bytes of storage. If zero, DefaultCacheMemorySize
+	// is used for memory and DefaultCacheDiskSize for disk.
+	MaxSize int64 `mapstructure:"max_size" yaml:"max_size"`
+	// Dir is the directory of disk storage. If empty, the responses are
+	// stored in memory.
+	Dir string `mapstructure:"dir" yaml:"dir"`
+	// MaxAge is the max duration of unused disk storage entries. If zero,
+	// DefaultCacheDiskMaxAge is used.
+	MaxAge time.Duration `mapstructure:"max_age" yaml:"max_age"`
+	// MaxBodySize is the max body bytes of cached responses. If zero,
+	// DefaultCacheMaxBodySize is used.
+	MaxBodySize int64 `mapstructure:"max_body_size" yaml:"max_body_size"`
+}
+
+// CreateStorage creates the disk storage if Dir is set, otherwise the memory
+// storage.
+func (cfg *CacheConfig) CreateStorage() (CacheStorage, error) {
+	if cfg.Dir != "" {
+		s, err := NewDiskCacheStorage(cfg.Dir)
+		if err != nil {
+			return nil, err
+		}
+		s.MaxSize, s.MaxAge = cfg.MaxSize, cfg.MaxAge
+		return s, nil
+	}
+	return NewMemoryCacheStorage(cfg.MaxSize), nil
+}
+
+// storageConfig returns the config of options used by CreateStorage.
+func (cfg *CacheConfig) storageConfig() CacheConfig {
+	return CacheConfig{MaxSize: cfg.MaxSize, Dir: cfg.Dir, MaxAge: cfg.MaxAge}
+}
+
+// cacheableStatuses are the statuses cacheable by default, as of RFC 9110
+// section 15.1.
+var cacheableStatuses = map[int]bool{
+	200: true, 203: true, 204: true, 300: true, 301: true, 308: true,
+	404: true, 405: true, 410: true, 414: true, 501: true,
+}
+
+// hopHeaders are the connection headers not stored.
+var hopHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Connection", "Te", "Trailer",
+	"Transfer-Encoding", "Upgrade", CacheStatusHeader,
+}
+
+// CacheHandler is a RFC 9111 shared cache of the GET and HEAD responses of
+// Handler. The stale responses are revalidated by conditional requests to
+// Handler, and served while revalidated in background within the
+// stale-while-revalidate window. The successful unsafe requests, like POST,
+// invalidate the cached responses of the request URL and of its Location and
+// Content-Location targets.
+type CacheHandler struct {
+	Handler http.Handler
+	Storage CacheStorage
+	// MaxBodySize is the max body bytes of cached responses. If zero,
+	// DefaultCacheMaxBodySize is used.
+	MaxBodySize  int64
+	revalidating sync.Map
+}
+
+// NewCacheHandler creates the CacheHandler. If cfg is nil, the default
+// options are used.
+func NewCacheHandler(handler http.Handler, storage CacheStorage, cfg *CacheConfig) *CacheHandler {
+	h := &CacheHandler{Handler: handler, Storage: storage}
+	if cfg != nil {
+		h.MaxBodySize = cfg.MaxBodySize
+	}
+	return h
+}
+
+func (h *CacheHandler) maxBodySize() int64 {
+	if h.MaxBodySize <= 0 {
+		return DefaultCacheMaxBodySize
+	}
+	return h.MaxBodySize
+}
+
+// cacheKey returns the storage key of request URL.
+func cacheKey(r *http.Request) string {
+	return r.Host + " " + PrefixR(r) + " " + r.URL.RequestURI()
+}
+
+// variantKey returns the storage key of the request variant of key by the
+// vary headers.
+func variantKey(key string, r *http.Request, vary []string) string {
+	var b strings.Builder
+	b.WriteString(key)
+	for _, name := range vary {
+		b.WriteString("\x00" + name + "=" + strings.Join(r.Header.Values(name), ","))
+	}
+	return b.String()
+}
+
+func (h *CacheHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		h.serveUnsafe(w, r)
+		return
+	}
+
+	reqCC := parseCacheControl(r.Header.Get("Cache-Control"))
+	if len(reqCC) == 0 && r.Header.Get("Pragma") == "no-cache" {
+		reqCC["no-cache"] = ""
+	}
+	if _, ok := reqCC["no-store"]; ok {
+		h.Handler.ServeHTTP(w, r)
+		return
+	}
+
+	key := cacheKey(r)
+	res := h.lookup(r, key)
+	_, onlyIfCached := reqCC["only-if-cached"]
+	if res == nil {
+		if onlyIfCached {
+			RenderError(w, r, NewHttpError(http.StatusGatewayTimeout, "not cached"))
+			return
+		}
+		w.Header().Set(CacheStatusHeader, "httpu; fwd=miss")
+		h.fetch(w, r, key, nil)
+		return
+	}
+
+	var (
+		now            = time.Now()
+		age            = res.age(now)
+		lifetime       = res.freshness()
+		resCC          = parseCacheControl(res.Header.Get("Cache-Control"))
+		_, resNoCache  = resCC["no-cache"]
+		_, reqNoCache  = reqCC["no-cache"]
+		_, mustReval   = resCC["must-revalidate"]
+		_, proxyReval  = resCC["proxy-revalidate"]
+		fresh          = age < lifetime
+		validate       = resNoCache || reqNoCache
+		staleForbidden = mustReval || proxyReval || validate
+	)
+	if maxAge, ok := ccSeconds(reqCC, "max-age"); ok && age > maxAge {
+		validate = true
+	}
+	if minFresh, ok := ccSeconds(reqCC, "min-fresh"); ok && age+minFresh > lifetime {
+		fresh = false
+	}
+
+	switch {
+	case fresh && !validate:
+		h.serve(w, r, res, age, "httpu; hit")
+		return
+	case !staleForbidden:
+		if swr, ok := ccSeconds(resCC, "stale-while-revalidate"); ok && age < lifetime+swr {
+			h.serve(w, r, res, age, "httpu; hit; detail=stale-while-revalidate")
+			h.revalidate(r, key, res)
+			return
+		}
+		if maxStale, ok := reqCC["max-stale"]; ok {
+			if d, err := strconv.Atoi(maxStale); maxStale == "" || err == nil && age < lifetime+time.Duration(d)*time.Second {
+				h.serve(w, r, res, age, "httpu; hit; detail=stale")
+				return
+			}
+		}
+	}
+	if onlyIfCached {
+		RenderError(w, r, NewHttpError(http.StatusGatewayTimeout, "not fresh"))
+		return
+	}
+	w.Header().Set(CacheStatusHeader, "httpu; fwd=stale")
+	h.fetch(w, r, key, res)
+}
+
+// serveUnsafe serves the unsafe method request, invalidating the cached
+// responses of URL and of the Location and Content-Location targets, as of
+// RFC 9111 section 4.4, if succeeded. The response writer forwards
+// http.Flusher and http.Hijacker.
+func (h *CacheHandler) serveUnsafe(w http.ResponseWriter, r *http.Request) {
+	wtd := ResponseWriterOf(w)
+	h.Handler.ServeHTTP(wtd, r)
+	if status := wtd.Status(); status >= 400 {
+		return
+	}
+	for _, key := range append([]string{cacheKey(r)}, targetKeys(r, wtd.Header())...) {
+		if err := h.invalidate(key); err != nil {
+			log.Errorf("cache: invalidate %q failed: %v", key, err)
+		}
+	}
+}
+
+// targetKeys returns the storage keys of the same origin Location and
+// Content-Location targets of the response.
+func targetKeys(r *http.Request, header http.Header) (keys []string) {
+	prefix := PrefixR(r)
+	base := &url.URL{Path: prefix + strings.TrimPrefix(r.URL.Path, "/"), RawQuery: r.URL.RawQuery}
+	for _, name := range []string{"Location", "Content-Location"} {
+		value := header.Get(name)
+		if value == "" {
+			continue
+		}
+		u, err := base.Parse(value)
+		if err != nil || u.Host != "" && u.Host != r.Host || !strings.HasPrefix(u.Path, prefix) {
+			continue
+		}
+		target := &url.URL{Path: "/" + strings.TrimPrefix(u.Path, prefix), RawQuery: u.RawQuery}
+		if key := r.Host + " " + prefix + " " + target.RequestURI(); !containsString(keys, key) {
+			keys = append(keys, key)
+		}
+	}
+	return
+}
+
+// invalidate deletes the stored response of key, with its variants if it is
+// a variants index.
+func (h *CacheHandler) invalidate(key string) (err error) {
+	var res *CachedResponse
+	if res, err = h.Storage.Get(key); err != nil {
+		return
+	}
+	if res != nil && res.Status == 0 {
+		for _, vkey := range res.Variants {
+			if err = h.Storage.Delete(vkey); err != nil {
+				return
+			}
+		}
+	}
+	return h.Storage.Delete(key)
+}
+
+// lookup returns the stored response of request or nil.
+func (h *CacheHandler) lookup(r *http.Request, key string) *CachedResponse {
+	res, err := h.Storage.Get(key)
+	if err == nil && res != nil && res.Status == 0 {
+		res, err = h.Storage.Get(variantKey(key, r, res.Vary))
+	}
+	if err != nil {
+		log.Errorf("cache: get %q failed: %v", r.URL.RequestURI(), err)
+		return nil
+	}
+	if res == nil || res.Status == 0 {
+		return nil
+	}
+	return res
+}
+
+// store stores the response of request, with the variants index if the
+// response varies. The index keeps up to maxCacheVariants variants, the older
+// ones are deleted.
+func (h *CacheHandler) store(r *http.Request, key string, res *CachedResponse) {
+	var variants []string
+	if old, err := h.Storage.Get(key); err == nil && old != nil && old.Status == 0 {
+		variants = old.Variants
+	}
+
+	var err error
+	if vary := varyNames(res.Header); len(vary) > 0 {
+		vkey := variantKey(key, r, vary)
+		index := &CachedResponse{Vary: vary, Variants: []string{vkey}}
+		for _, k := range variants {
+			if k == vkey {
+				continue
+			}
+			if len(index.Variants) < maxCacheVariants {
+				index.Variants = append(index.Variants, k)
+			} else if err = h.Storage.Delete(k); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			if err = h.Storage.Set(key, index); err == nil {
+				err = h.Storage.Set(vkey, res)
+			}
+		}
+	} else {
+		// the variants of replaced index are unreachable
+		for _, k := range variants {
+			if err = h.Storage.Delete(k); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			err = h.Storage.Set(key, res)
+		}
+	}
+	if err != nil {
+		log.Errorf("cache: set %q failed: %v", r.URL.RequestURI(), err)
+	}
+}
+
+// fetch serves the request by Handler, storing the response if cacheable. If
+// stored is not nil, the request is conditional to its validators, and it is
+// served updated if Handler replies 304 Not Modified.
+func (h *CacheHandler) fetch(w http.ResponseWriter, r *http.Request, key string, stored *CachedResponse) {
+	req := r
+	if stored != nil {
+		etag, lastModified := stored.Header.Get("Etag"), stored.Header.Get("Last-Modified")
+		if etag == "" && lastModified == "" {
+			stored = nil
+		} else {
+			req = r.Clone(r.Context())
+			req.Header.Del("If-None-Match")
+			req.Header.Del("If-Modified-Since")
+			if etag != "" {
+				req.Header.Set("If-None-Match", etag)
+			}
+			if lastModified != "" {
+				req.Header.Set("If-Modified-Since", lastModified)
+			}
+		}
+	}
+
+	cw := &cacheWriter{w: w, header: http.Header{}, hold304: stored != nil, max: h.maxBodySize()}
+	requestTime := time.Now()
+	h.Handler.ServeHTTP(cw, req)
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	responseTime := time.Now()
+
+	if cw.held {
+		// RFC 9111 section 4.3.4: updates the stored headers by the 304
+		// response headers
+		updated := *stored
+		updated.Header = stored.Header.Clone()
+		for name, values := range cw.sent {
+			if name != "Content-Length" {
+				updated.Header[name] = values
+			}
+		}
+		updated.RequestTime, updated.ResponseTime = requestTime, responseTime
+		updated.Header.Set("Date", responseTime.UTC().Format(http.TimeFormat))
+		h.store(r, key, &updated)
+		h.serve(w, r, &updated, 0, "httpu; fwd=stale; fwd-status=304")
+		return
+	}
+
+	if r.Method != http.MethodGet || !cw.storable(r) {
+		return
+	}
+	res := &CachedResponse{
+		Status:       cw.status,
+		Header:       cw.sent,
+		Body:         cw.body.Bytes(),
+		RequestTime:  requestTime,
+		ResponseTime: responseTime,
+	}
+	for _, name := range hopHeaders {
+		res.Header.Del(name)
+	}
+	if res.Header.Get("Date") == "" {
+		res.Header.Set("Date", responseTime.UTC().Format(http.TimeFormat))
+	}
+	res.Header.Set("Content-Length", strconv.Itoa(len(res.Body)))
+	if res.freshness() <= 0 && res.Header.Get("Etag") == "" && res.Header.Get("Last-Modified") == "" {
+		// expired and can not be revalidated
+		return
+	}
+	h.store(r, key, res)
+}
+
+// revalidate revalidates the stored response in background.
+func (h *CacheHandler) revalidate(r *http.Request, key string, stored *CachedResponse) {
+	if _, loaded := h.revalidating.LoadOrStore(key, true); loaded {
+		return
+	}
+	req := r.Clone(context.WithoutCancel(r.Context()))
+	go func() {
+		defer h.revalidating.Delete(key)
+		defer func() {
+			if err := recover(); err != nil && err != http.ErrAbortHandler {
+				log.Errorf("cache: revalidate %q failed: %v", req.URL.RequestURI(), err)
+			}
+		}()
+		h.fetch(&discardWriter{header: http.Header{}}, req, key, stored)
+	}()
+}
+
+// serve writes the stored response, or 304 Not Modified if the request
+// preconditions match it.
+func (h *CacheHandler) serve(w http.ResponseWriter, r *http.Request, res *CachedResponse, age time.Duration, status string) {
+	header := w.Header()
+	for name, values := range res.Header {
+		if name == "Vary" {
+			AddVary(w, values...)
+		} else {
+			header[name] = append([]string(nil), values...)
+		}
+	}
+	header.Set("Age", strconv.FormatInt(int64(age/time.Second), 10))
+	header.Set(CacheStatusHeader, status)
+
+	lastModified, _ := http.ParseTime(res.Header.Get("Last-Modified"))
+	if hasPreconditions(r) && writePrecondition(w, r, evalPreconditions(r, res.Header.Get("Etag"), lastModified, true)) {
+		return
+	}
+	w.WriteHeader(res.Status)
+	if r.Method != http.MethodHead {
+		w.Write(res.Body)
+	}
+}
+
+// date returns the Date header time or the response time.
+func (res *CachedResponse) date() time.Time {
+	if t, err := http.ParseTime(res.Header.Get("Date")); err == nil {
+		return t
+	}
+	return res.ResponseTime
+}
+
+// age returns the current age of response, as of RFC 9111 section 4.2.3.
+func (res *CachedResponse) age(now time.Time) time.Duration {
+	apparentAge := res.ResponseTime.Sub(res.date())
+	if apparentAge < 0 {
+		apparentAge = 0
+	}
+	ageValue, _ := strconv.ParseInt(res.Header.Get("Age"), 10, 64)
+	correctedAgeValue := time.Duration(ageValue)*time.Second + res.ResponseTime.Sub(res.RequestTime)
+	initialAge := apparentAge
+	if correctedAgeValue > initialAge {
+		initialAge = correctedAgeValue
+	}
+	return initialAge + now.Sub(res.ResponseTime)
+}
+
+// freshness returns the freshness lifetime of response, as of RFC 9111
+// section 4.2.1.
+func (res *CachedResponse) freshness() time.Duration {
+	cc := parseCacheControl(res.Header.Get("Cache-Control"))
+	if d, ok := ccSeconds(cc, "s-maxage"); ok {
+		return d
+	}
+	if d, ok := ccSeconds(cc, "max-age"); ok {
+		return d
+	}
+	if expires := res.Header.Get("Expires"); expires != "" {
+		t, err := http.ParseTime(expires)
+		if err != nil {
+			return 0
+		}
+		return t.Sub(res.date())
+	}
+	if lastModified, err := http.ParseTime(res.Header.Get("Last-Modified")); err == nil && cacheableStatuses[res.Status] {
+		d := res.date().Sub(lastModified) / 10
+		if d > maxHeuristicFreshness {
+			d = maxHeuristicFreshness
+		}
+		return d
+	}
+	return 0
+}
+
+// parseCacheControl returns the Cache-Control directives by lower case name.
+func parseCacheControl(value string) map[string]string {
+	cc := map[string]string{}
+	for _, part := range strings.Split(value, ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		name, v, _ := strings.Cut(part, "=")
+		cc[strings.ToLower(strings.TrimSpace(name))] = strings.Trim(strings.TrimSpace(v), `"`)
+	}
+	return cc
+}
+
+// ccSeconds returns the delta seconds directive value.
+func ccSeconds(cc map[string]string, name string) (d time.Duration, ok bool) {
+	v, ok := cc[name]
+	if !ok {
+		return
+	}
+	secs, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || secs < 0 {
+		return 0, false
+	}
+	return time.Duration(secs) * time.Second, true
+}
+
+// varyNames returns the sorted canonical names of the Vary header.
+func varyNames(header http.Header) (names []string) {
+	for _, v := range header.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	sort.Strings(names)
+	return
+}
+
+// cacheWriter forwards the response of Handler, capturing its header and body
+// up to max bytes. The header is forwarded on WriteHeader, so the changes of
+// outer writers, like compression, are not captured.
+type cacheWriter struct {
+	w                  http.ResponseWriter
+	header, sent       http.Header
+	status             int
+	wroteHeader, wrote bool
+	// hold304 holds the 304 responses of revalidation requests.
+	hold304, held bool
+	body          bytes.Buffer
+	max           int64
+	overflow      bool
+	bytesWritten  int
+}
+
+func (cw *cacheWriter) Header() http.Header {
+	return cw.header
+}
+
+func (cw *cacheWriter) WriteHeader(status int) {
+	if cw.wroteHeader {
+		return
+	}
+	if status >= 100 && status < 200 {
+		cw.w.WriteHeader(status)
+		return
+	}
+	cw.wroteHeader = true
+	cw.status = status
+	cw.sent = cw.header.Clone()
+	if status == http.StatusNotModified && cw.hold304 {
+		cw.held = true
+		return
+	}
+	header := cw.w.Header()
+	for name, values := range cw.header {
+		if name == "Vary" {
+			AddVary(cw.w, values...)
+		} else {
+			header[name] = values
+		}
+	}
+	cw.w.WriteHeader(status)
+}
+
+func (cw *cacheWriter) Write(p []byte) (n int, err error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	cw.wrote = true
+	if cw.held {
+		return len(p), nil
+	}
+	if !cw.overflow {
+		if int64(cw.body.Len()+len(p)) > cw.max {
+			cw.overflow = true
+			cw.body = bytes.Buffer{}
+		} else {
+			cw.body.Write(p)
+		}
+	}
+	n, err = cw.w.Write(p)
+	cw.bytesWritten += n
+	return
+}
+
+func (cw *cacheWriter) Flush() {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if f, ok := cw.w.(http.Flusher); ok && !cw.held {
+		f.Flush()
+	}
+}
+
+func (cw *cacheWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	cw.overflow = true
+	if h, ok := cw.w.(http.Hijacker); ok {
+		return h.Hijack()
+	}
+	return nil, nil, fmt.Errorf("%T is not a http.Hijacker", cw.w)
+}
+
+func (cw *cacheWriter) WroteHeader() bool {
+	return cw.wroteHeader
+}
+
+func (cw *cacheWriter) Wrote() bool {
+	return cw.wrote
+}
+
+func (cw *cacheWriter) Status() int {
+	return cw.status
+}
+
+func (cw *cacheWriter) BytesWritten() int {
+	return cw.bytesWritten
+}
+
+func (cw *cacheWriter) Unwrap() http.ResponseWriter {
+	return cw.w
+}
+
+// storable reports if the response is storable by a shared cache, as of
+// RFC 9111 section 3.
+func (cw *cacheWriter) storable(r *http.Request) bool {
+	if cw.overflow || !cacheableStatuses[cw.status] || cw.sent.Get("Set-Cookie") != "" {
+		return false
+	}
+	cc := parseCacheControl(cw.sent.Get("Cache-Control"))
+	if _, ok := cc["no-store"]; ok {
+		return false
+	}
+	if _, ok := cc["private"]; ok {
+		return false
+	}
+	if r.Header.Get("Authorization") != "" {
+		_, public := cc["public"]
+		_, sMaxAge := cc["s-maxage"]
+		_, mustRevalidate := cc["must-revalidate"]
+		if !public && !sMaxAge && !mustRevalidate {
+			return false
+		}
+	}
+	for _, name := range varyNames(cw.sent) {
+		if name == "*" {
+			return false
+		}
+	}
+	return true
+}
+
+// discardWriter discards the response.
+type discardWriter struct {
+	header http.Header
+}
+
+func (w *discardWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *discardWriter) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (w *discardWriter) WriteHeader(int) {}
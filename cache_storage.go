@@ -0,0 +1,376 @@
+package httpu
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultCacheMemorySize is the max bytes of MemoryCacheStorage if its
+	// size is zero.
+	DefaultCacheMemorySize = 64 << 20
+	// DefaultCacheDiskSize is the max bytes of DiskCacheStorage if its
+	// MaxSize is zero.
+	DefaultCacheDiskSize = 1 << 30
+	// DefaultCacheDiskMaxAge is the max duration of unused DiskCacheStorage
+	// entries if its MaxAge is zero.
+	DefaultCacheDiskMaxAge = 7 * 24 * time.Hour
+	// DefaultCacheDiskSweepInterval is the min interval between the
+	// DiskCacheStorage sweeps started by Set.
+	DefaultCacheDiskSweepInterval = time.Hour
+)
+
+// CachedResponse is a response stored by the CacheHandler.
+type CachedResponse struct {
+	Status int
+	Header http.Header
+	Body   []byte
+	// Vary are the request headers names of response variants. The entries
+	// with Vary and without status are the variants index of an URL.
+	Vary []string
+	// Variants are the storage keys of the stored variants of the index,
+	// most recent first.
+	Variants []string
+	// RequestTime is the time the request of response was started.
+	RequestTime time.Time
+	// ResponseTime is the time the response was received.
+	ResponseTime time.Time
+}
+
+// size returns the approximated memory size of response.
+func (res *CachedResponse) size() (size int64) {
+	size = int64(len(res.Body))
+	for name, values := range res.Header {
+		size += int64(len(name))
+		for _, v := range values {
+			size += int64(len(v))
+		}
+	}
+	for _, name := range res.Vary {
+		size += int64(len(name))
+	}
+	for _, key := range res.Variants {
+		size += int64(len(key))
+	}
+	return size + 64
+}
+
+// CacheStorage stores the CacheHandler responses by key. The stored responses
+// must not be modified.
+type CacheStorage interface {
+	// Get returns the response of key or nil if not found.
+	Get(key string) (res *CachedResponse, err error)
+	// Set stores the response of key, replacing the current one.
+	Set(key string, res *CachedResponse) error
+	// Delete removes the response of key, if exists.
+	Delete(key string) error
+}
+
+type memoryCacheEntry struct {
+	key  string
+	res  *CachedResponse
+	size int64
+}
+
+// MemoryCacheStorage is a CacheStorage in memory, evicting the least recently
+// used responses when full.
+type MemoryCacheStorage struct {
+	maxSize int64
+	mu      sync.Mutex
+	size    int64
+	ll      *list.List
+	items   map[string]*list.Element
+}
+
+// NewMemoryCacheStorage creates the MemoryCacheStorage with max size bytes.
+// If size is zero, DefaultCacheMemorySize is used.
+func NewMemoryCacheStorage(size int64) *MemoryCacheStorage {
+	if size <= 0 {
+		size = DefaultCacheMemorySize
+	}
+	return &MemoryCacheStorage{maxSize: size, ll: list.New(), items: map[string]*list.Element{}}
+}
+
+// Size returns the used bytes.
+func (s *MemoryCacheStorage) Size() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size
+}
+
+func (s *MemoryCacheStorage) Get(key string) (*CachedResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if el, ok := s.items[key]; ok {
+		s.ll.MoveToFront(el)
+		return el.Value.(*memoryCacheEntry).res, nil
+	}
+	return nil, nil
+}
+
+func (s *MemoryCacheStorage) Set(key string, res *CachedResponse) error {
+	entry := &memoryCacheEntry{key, res, res.size() + int64(len(key))}
+	if entry.size > s.maxSize {
+		return s.Delete(key)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if el, ok := s.items[key]; ok {
+		s.remove(el)
+	}
+	s.items[key] = s.ll.PushFront(entry)
+	s.size += entry.size
+	for s.size > s.maxSize {
+		s.remove(s.ll.Back())
+	}
+	return nil
+}
+
+func (s *MemoryCacheStorage) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if el, ok := s.items[key]; ok {
+		s.remove(el)
+	}
+	return nil
+}
+
+func (s *MemoryCacheStorage) remove(el *list.Element) {
+	entry := el.Value.(*memoryCacheEntry)
+	s.ll.Remove(el)
+	delete(s.items, entry.key)
+	s.size -= entry.size
+}
+
+// DiskCacheStorage is a CacheStorage of gob encoded files in Dir, named by
+// the key hash. The entries not used for MaxAge are removed by RemoveExpired,
+// and the least recently used ones when the files exceed MaxSize. Set starts
+// RemoveExpired in background every DefaultCacheDiskSweepInterval, or when
+// MaxSize is exceeded.
+type DiskCacheStorage struct {
+	Dir string
+	// MaxSize is the max bytes of files. If zero, DefaultCacheDiskSize is
+	// used.
+	MaxSize int64
+	// MaxAge is the max duration of unused entries. If zero,
+	// DefaultCacheDiskMaxAge is used.
+	MaxAge time.Duration
+
+	mu        sync.Mutex
+	size      atomic.Int64
+	lastSweep atomic.Int64
+	sweeping  atomic.Bool
+}
+
+// NewDiskCacheStorage creates the DiskCacheStorage of dir, creating it if
+// does not exist.
+func NewDiskCacheStorage(dir string) (s *DiskCacheStorage, err error) {
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return
+	}
+	return &DiskCacheStorage{Dir: dir}, nil
+}
+
+func (s *DiskCacheStorage) maxSize() int64 {
+	if s.MaxSize <= 0 {
+		return DefaultCacheDiskSize
+	}
+	return s.MaxSize
+}
+
+func (s *DiskCacheStorage) maxAge() time.Duration {
+	if s.MaxAge <= 0 {
+		return DefaultCacheDiskMaxAge
+	}
+	return s.MaxAge
+}
+
+// Size returns the bytes of files, as of the last sweep and the changes
+// after it.
+func (s *DiskCacheStorage) Size() int64 {
+	return s.size.Load()
+}
+
+func (s *DiskCacheStorage) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	name := hex.EncodeToString(sum[:])
+	return filepath.Join(s.Dir, name[:2], name)
+}
+
+func (s *DiskCacheStorage) Get(key string) (res *CachedResponse, err error) {
+	pth := s.path(key)
+	f, err := os.Open(pth)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			err = nil
+		}
+		return
+	}
+	defer f.Close()
+	res = &CachedResponse{}
+	if err = gob.NewDecoder(f).Decode(res); err != nil {
+		return nil, err
+	}
+	// the modification time is the last use time of entry
+	if info, err := f.Stat(); err == nil {
+		if now := time.Now(); now.Sub(info.ModTime()) > time.Minute {
+			os.Chtimes(pth, now, now)
+		}
+	}
+	return
+}
+
+func (s *DiskCacheStorage) Set(key string, res *CachedResponse) (err error) {
+	pth := s.path(key)
+	if err = os.MkdirAll(filepath.Dir(pth), 0700); err != nil {
+		return
+	}
+	f, err := os.CreateTemp(filepath.Dir(pth), ".tmp-*")
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(f.Name())
+		}
+	}()
+	if err = gob.NewEncoder(f).Encode(res); err != nil {
+		f.Close()
+		return
+	}
+	var info os.FileInfo
+	if info, err = f.Stat(); err != nil {
+		f.Close()
+		return
+	}
+	if err = f.Close(); err != nil {
+		return
+	}
+	size := info.Size()
+	if old, err := os.Stat(pth); err == nil {
+		size -= old.Size()
+	}
+	// replaces atomically, so concurrent readers do not get partial files
+	if err = os.Rename(f.Name(), pth); err != nil {
+		return
+	}
+	if s.size.Add(size) > s.maxSize() || time.Since(time.Unix(0, s.lastSweep.Load())) > DefaultCacheDiskSweepInterval {
+		s.sweep()
+	}
+	return
+}
+
+func (s *DiskCacheStorage) Delete(key string) (err error) {
+	pth := s.path(key)
+	info, err := os.Stat(pth)
+	if err == nil {
+		err = os.Remove(pth)
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err == nil {
+		s.size.Add(-info.Size())
+	}
+	return
+}
+
+// sweep starts RemoveExpired in background, if not running.
+func (s *DiskCacheStorage) sweep() {
+	if !s.sweeping.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		defer s.sweeping.Store(false)
+		if _, err := s.RemoveExpired(time.Now()); err != nil {
+			log.Errorf("cache: sweep %q failed: %v", s.Dir, err)
+		}
+	}()
+}
+
+// RemoveExpired removes the entries not used for MaxAge at now, including the
+// orphaned temporary files, then the least recently used entries while the
+// files exceed MaxSize. Returns the number of removed files.
+func (s *DiskCacheStorage) RemoveExpired(now time.Time) (n int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	type entry struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+	var (
+		entries []entry
+		size    int64
+		expire  = now.Add(-s.maxAge())
+	)
+	err = filepath.WalkDir(s.Dir, func(pth string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		expired := info.ModTime().Before(expire)
+		if strings.HasPrefix(d.Name(), ".tmp-") {
+			// the temporary files of running Set calls are recent
+			expired = now.Sub(info.ModTime()) > DefaultCacheDiskSweepInterval
+		}
+		if expired {
+			if err = os.Remove(pth); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+			n++
+			return nil
+		}
+		entries = append(entries, entry{pth, info.Size(), info.ModTime()})
+		size += info.Size()
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	if maxSize := s.maxSize(); size > maxSize {
+		sort.Slice(entries, func(i, j int) bool {
+			return entries[i].modTime.Before(entries[j].modTime)
+		})
+		for _, e := range entries {
+			if size <= maxSize {
+				break
+			}
+			if err = os.Remove(e.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return
+			}
+			err = nil
+			size -= e.size
+			n++
+		}
+	}
+	s.size.Store(size)
+	s.lastSweep.Store(now.UnixNano())
+	return
+}
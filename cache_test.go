@@ -0,0 +1,171 @@
+package httpu
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func cacheTestRequest(method, target string, header ...string) *http.Request {
+	r := httptest.NewRequest(method, target, nil)
+	r = SetPrefixR(r, "/")
+	for i := 0; i < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	return r
+}
+
+func TestCacheHandlerInvalidate(t *testing.T) {
+	storage := NewMemoryCacheStorage(0)
+	h := NewCacheHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("Vary", "Accept-Language")
+			io.WriteString(w, r.URL.Path+" "+r.Header.Get("Accept-Language"))
+		case http.MethodPost:
+			w.Header().Set("Location", "/items/1")
+			w.Header().Set("Content-Location", "http://other.example/items/2")
+			w.WriteHeader(http.StatusCreated)
+		}
+	}), storage, nil)
+
+	for _, target := range []string{"/items", "/items/1", "/items/2"} {
+		for _, lang := range []string{"en", "pt", "es"} {
+			h.ServeHTTP(httptest.NewRecorder(), cacheTestRequest("GET", target, "Accept-Language", lang))
+		}
+	}
+	index, _ := storage.Get(cacheKey(cacheTestRequest("GET", "/items")))
+	if index == nil || len(index.Variants) != 3 {
+		t.Fatalf("index = %+v", index)
+	}
+
+	h.ServeHTTP(httptest.NewRecorder(), cacheTestRequest("POST", "/items"))
+
+	for _, target := range []string{"/items", "/items/1"} {
+		key := cacheKey(cacheTestRequest("GET", target))
+		if res, _ := storage.Get(key); res != nil {
+			t.Errorf("%s: index not invalidated", target)
+		}
+		for _, vkey := range index.Variants {
+			vkey = key + strings.TrimPrefix(vkey, cacheKey(cacheTestRequest("GET", "/items")))
+			if res, _ := storage.Get(vkey); res != nil {
+				t.Errorf("%s: variant %q not invalidated", target, vkey)
+			}
+		}
+	}
+	// the other origin target is kept
+	if res, _ := storage.Get(cacheKey(cacheTestRequest("GET", "/items/2"))); res == nil {
+		t.Error("/items/2 invalidated")
+	}
+}
+
+func TestCacheHandlerMaxVariants(t *testing.T) {
+	storage := NewMemoryCacheStorage(0)
+	h := NewCacheHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Vary", "X-Client")
+		io.WriteString(w, "ok")
+	}), storage, nil)
+
+	first := cacheTestRequest("GET", "/", "X-Client", "0")
+	h.ServeHTTP(httptest.NewRecorder(), first)
+	for i := 1; i <= maxCacheVariants; i++ {
+		h.ServeHTTP(httptest.NewRecorder(), cacheTestRequest("GET", "/", "X-Client", strings.Repeat("x", i)))
+	}
+	key := cacheKey(first)
+	index, _ := storage.Get(key)
+	if len(index.Variants) != maxCacheVariants {
+		t.Fatalf("variants = %d", len(index.Variants))
+	}
+	if res, _ := storage.Get(variantKey(key, first, []string{"X-Client"})); res != nil {
+		t.Error("the oldest variant is not deleted")
+	}
+}
+
+func TestDiskCacheStorageRemoveExpired(t *testing.T) {
+	s, err := NewDiskCacheStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.MaxAge = time.Hour
+	// no background sweep started by Set
+	s.lastSweep.Store(time.Now().UnixNano())
+	res := &CachedResponse{Status: 200, Header: http.Header{}, Body: make([]byte, 1000)}
+	for _, key := range []string{"old", "a", "b", "c"} {
+		if err = s.Set(key, res); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Now()
+	old := now.Add(-2 * time.Hour)
+	if err = os.Chtimes(s.path("old"), old, old); err != nil {
+		t.Fatal(err)
+	}
+	for i, key := range []string{"a", "b", "c"} {
+		mtime := now.Add(time.Duration(i-3) * time.Minute)
+		if err = os.Chtimes(s.path(key), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tmp := filepath.Join(s.Dir, ".tmp-orphan")
+	if err = os.WriteFile(tmp, []byte("x"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(tmp, old, old)
+
+	info, _ := os.Stat(s.path("a"))
+	s.MaxSize = 2 * info.Size()
+	n, err := s.RemoveExpired(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the expired, the orphaned temporary file and the least recently used
+	if n != 3 {
+		t.Errorf("removed = %d", n)
+	}
+	for key, exists := range map[string]bool{"old": false, "a": false, "b": true, "c": true} {
+		if res, _ := s.Get(key); (res != nil) != exists {
+			t.Errorf("%s exists = %v", key, !exists)
+		}
+	}
+	if _, err = os.Stat(tmp); !os.IsNotExist(err) {
+		t.Error("temporary file not removed")
+	}
+	if s.Size() != 2*info.Size() {
+		t.Errorf("size = %d", s.Size())
+	}
+}
+
+func TestServerCacheStorageReload(t *testing.T) {
+	cfg := &Config{Cache: CacheConfig{Enabled: true, MaxSize: 1 << 20}}
+	s := NewServer(cfg, http.NotFoundHandler())
+	s.buildHandler(cfg)
+	storage := s.cacheStorage
+
+	cfg2 := cfg.Clone()
+	cfg2.Cache.MaxBodySize = 100
+	s.buildHandler(cfg2)
+	if s.cacheStorage != storage {
+		t.Fatal("storage recreated on a handler option change")
+	}
+
+	cfg2.Cache.Dir = t.TempDir()
+	s.buildHandler(cfg2)
+	if ds, ok := s.cacheStorage.(*DiskCacheStorage); !ok || ds.MaxSize != 1<<20 {
+		t.Fatalf("storage = %#v", s.cacheStorage)
+	}
+
+	custom := NewMemoryCacheStorage(10)
+	s.SetCacheStorage(custom)
+	cfg2.Cache.MaxSize = 10
+	s.buildHandler(cfg2)
+	if s.cacheStorage != custom {
+		t.Fatal("the SetCacheStorage storage was replaced")
+	}
+}
@@ -0,0 +1,449 @@
+package httpu
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/flate"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+const DefaultCompressMinSize = 1024
+
+var (
+	// DefaultCompressEncodings are the content codings used if
+	// CompressConfig.Encodings is empty, in server preference order.
+	DefaultCompressEncodings = []string{"br", "zstd", "gzip", "deflate"}
+
+	// DefaultCompressContentTypes are the media types compressed if
+	// CompressConfig.ContentTypes is empty.
+	DefaultCompressContentTypes = []string{
+		"text/",
+		"application/json",
+		"application/javascript",
+		"application/x-javascript",
+		"application/xml",
+		"application/xhtml+xml",
+		"application/rss+xml",
+		"application/atom+xml",
+		"application/manifest+json",
+		"application/problem+json",
+		"application/wasm",
+		"image/svg+xml",
+		"image/x-icon",
+		"font/ttf",
+		"font/otf",
+		"application/vnd.ms-fontobject",
+	}
+
+	// DefaultCompressConfig is the config used by ServeContent.
+	DefaultCompressConfig = &CompressConfig{}
+)
+
+// encoder is the compressing writer of a content coding.
+type encoder interface {
+	io.WriteCloser
+	Reset(w io.Writer)
+	Flush() error
+}
+
+// Encoding is a content coding, like "gzip", with a pool of its writers.
+type Encoding struct {
+	Name string
+	new  func(w io.Writer) encoder
+	pool sync.Pool
+}
+
+// NewEncoding creates the content coding name. The newWriter function
+// creates the compressing writers, that must implement the Reset(io.Writer)
+// and Flush() error methods for reuse.
+func NewEncoding(name string, newWriter func(w io.Writer) io.WriteCloser) *Encoding {
+	return &Encoding{Name: name, new: func(w io.Writer) encoder {
+		return newWriter(w).(encoder)
+	}}
+}
+
+func (e *Encoding) get(w io.Writer) encoder {
+	if enc, ok := e.pool.Get().(encoder); ok {
+		enc.Reset(w)
+		return enc
+	}
+	return e.new(w)
+}
+
+func (e *Encoding) put(enc encoder) {
+	enc.Reset(nil)
+	e.pool.Put(enc)
+}
+
+// Encode returns the data compressed.
+func (e *Encoding) Encode(data []byte) (encoded []byte, err error) {
+	var buf bytes.Buffer
+	enc := e.get(&buf)
+	defer e.put(enc)
+	if _, err = enc.Write(data); err != nil {
+		return
+	}
+	if err = enc.Close(); err != nil {
+		return
+	}
+	return buf.Bytes(), nil
+}
+
+var (
+	encodingsMu sync.RWMutex
+	encodings   = map[string]*Encoding{}
+)
+
+// RegisterEncoding registers the content coding, replacing the registered
+// one with same name.
+func RegisterEncoding(e *Encoding) {
+	encodingsMu.Lock()
+	defer encodingsMu.Unlock()
+	encodings[e.Name] = e
+}
+
+// GetEncoding returns the registered content coding or nil.
+func GetEncoding(name string) *Encoding {
+	encodingsMu.RLock()
+	defer encodingsMu.RUnlock()
+	return encodings[name]
+}
+
+func init() {
+	RegisterEncoding(NewEncoding("gzip", func(w io.Writer) io.WriteCloser {
+		gw, _ := gzip.NewWriterLevel(w, gzip.DefaultCompression)
+		return gw
+	}))
+	RegisterEncoding(NewEncoding("deflate", func(w io.Writer) io.WriteCloser {
+		fw, _ := flate.NewWriter(w, flate.DefaultCompression)
+		return fw
+	}))
+	RegisterEncoding(NewEncoding("br", func(w io.Writer) io.WriteCloser {
+		return brotli.NewWriterLevel(w, 5)
+	}))
+	RegisterEncoding(NewEncoding("zstd", func(w io.Writer) io.WriteCloser {
+		zw, _ := zstd.NewWriter(w,
+			zstd.WithEncoderConcurrency(1),
+			// the max window size supported by browsers
+			zstd.WithWindowSize(8<<20))
+		return zw
+	}))
+}
+
+// CompressConfig specifies the response compression.
+type CompressConfig struct {
+	// Enabled enables the compression of server responses.
+	Enabled bool `mapstructure:"enabled" yaml:"enabled"`
+	// Encodings are the content codings, like "gzip", in server preference
+	// order, used on Accept-Encoding quality ties. If empty,
+	// DefaultCompressEncodings is used.
+	Encodings []string `mapstructure:"encodings" yaml:"encodings"`
+	// MinSize is the min body size compressed. If zero,
+	// DefaultCompressMinSize is used. If -1, all sizes are compressed.
+	MinSize int `mapstructure:"min_size" yaml:"min_size"`
+	// ContentTypes are the media types compressed. The values ending with "/"
+	// matches by prefix, like "text/". If empty, DefaultCompressContentTypes
+	// is used.
+	ContentTypes []string `mapstructure:"content_types" yaml:"content_types"`
+}
+
+func (cfg *CompressConfig) encodings() []string {
+	if len(cfg.Encodings) == 0 {
+		return DefaultCompressEncodings
+	}
+	return cfg.Encodings
+}
+
+func (cfg *CompressConfig) minSize() int {
+	switch cfg.MinSize {
+	case 0:
+		return DefaultCompressMinSize
+	case -1:
+		return 0
+	}
+	return cfg.MinSize
+}
+
+// Compressible reports if the content type is compressed.
+func (cfg *CompressConfig) Compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	types := cfg.ContentTypes
+	if len(types) == 0 {
+		types = DefaultCompressContentTypes
+	}
+	for _, t := range types {
+		if mediaType == t || strings.HasSuffix(t, "/") && strings.HasPrefix(mediaType, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// NegotiateEncoding returns the registered content coding chosen by the
+// request Accept-Encoding header or nil for identity.
+func (cfg *CompressConfig) NegotiateEncoding(r *http.Request) *Encoding {
+	if r.Header.Get("Accept-Encoding") == "" {
+		return nil
+	}
+	offers := append(append([]string(nil), cfg.encodings()...), "identity")
+	if name := NegotiateEncoding(nil, r, offers...); name != "" && name != "identity" {
+		return GetEncoding(name)
+	}
+	return nil
+}
+
+// CompressHandler compresses the responses of Handler using the content
+// coding negotiated by the request Accept-Encoding header. The responses
+// already encoded, partial, smaller than min size or with not compressible
+// content type are sent unchanged.
+type CompressHandler struct {
+	Handler http.Handler
+	Config  *CompressConfig
+}
+
+// NewCompressHandler creates the CompressHandler. If cfg is nil,
+// DefaultCompressConfig is used.
+func NewCompressHandler(handler http.Handler, cfg *CompressConfig) *CompressHandler {
+	if cfg == nil {
+		cfg = DefaultCompressConfig
+	}
+	return &CompressHandler{Handler: handler, Config: cfg}
+}
+
+func (h *CompressHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	AddVary(w, "Accept-Encoding")
+	if isCompressing(w) {
+		h.Handler.ServeHTTP(w, r)
+		return
+	}
+	enc := h.Config.NegotiateEncoding(r)
+	if enc == nil {
+		h.Handler.ServeHTTP(w, r)
+		return
+	}
+	cw := &compressWriter{w: w, r: r, cfg: h.Config, enc: enc}
+	defer func() {
+		if err := recover(); err != nil {
+			// the encoder is not closed, so the client does not take the
+			// aborted response as complete
+			cw.release()
+			panic(err)
+		}
+		cw.finish()
+	}()
+	h.Handler.ServeHTTP(cw, r)
+}
+
+// isCompressing reports if w, or the writer wrapped by it, is compressing.
+func isCompressing(w http.ResponseWriter) bool {
+	for {
+		switch t := w.(type) {
+		case *compressWriter:
+			return true
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = t.Unwrap()
+		default:
+			return false
+		}
+	}
+}
+
+// compressWriter buffers the body until min size to decide the compression.
+type compressWriter struct {
+	w           http.ResponseWriter
+	r           *http.Request
+	cfg         *CompressConfig
+	enc         *Encoding
+	encoder     encoder
+	status      int
+	wroteHeader bool
+	decided     bool
+	compress    bool
+	buf         []byte
+	wrote       bool
+	wire        int
+}
+
+func (cw *compressWriter) Header() http.Header {
+	return cw.w.Header()
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.wroteHeader {
+		return
+	}
+	if status >= 100 && status < 200 {
+		cw.w.WriteHeader(status)
+		return
+	}
+	cw.wroteHeader = true
+	cw.status = status
+
+	h := cw.w.Header()
+	switch {
+	case status == http.StatusNoContent, status == http.StatusNotModified,
+		status == http.StatusPartialContent, h.Get("Content-Range") != "",
+		h.Get("Content-Encoding") != "", strings.Contains(h.Get("Cache-Control"), "no-transform"):
+		cw.decide(false)
+	case h.Get("Content-Length") != "":
+		size, _ := strconv.Atoi(h.Get("Content-Length"))
+		cw.decide(size >= cw.cfg.minSize() && cw.compressible())
+	case cw.r.Method == http.MethodHead:
+		cw.decide(cw.compressible())
+	}
+}
+
+func (cw *compressWriter) compressible() bool {
+	ctype := cw.w.Header().Get("Content-Type")
+	if ctype == "" {
+		if len(cw.buf) == 0 {
+			return false
+		}
+		ctype = http.DetectContentType(cw.buf)
+		// sets the type of uncompressed content, before net/http sniffs
+		// the compressed one
+		cw.w.Header().Set("Content-Type", ctype)
+	}
+	return cw.cfg.Compressible(ctype)
+}
+
+// decide sends the header and buffered body, compressed if compress.
+func (cw *compressWriter) decide(compress bool) {
+	cw.decided = true
+	cw.compress = compress
+	if compress {
+		h := cw.w.Header()
+		h.Set("Content-Encoding", cw.enc.Name)
+		h.Del("Content-Length")
+		h.Del("Accept-Ranges")
+		// the compressed representation is not byte-for-byte equal
+		if etag := h.Get("Etag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			h.Set("Etag", "W/"+etag)
+		}
+		if cw.r.Method != http.MethodHead {
+			cw.encoder = cw.enc.get(wireWriter{cw})
+		}
+	}
+	cw.w.WriteHeader(cw.status)
+	if len(cw.buf) > 0 {
+		buf := cw.buf
+		cw.buf = nil
+		cw.write(buf)
+	}
+}
+
+func (cw *compressWriter) write(p []byte) (n int, err error) {
+	if cw.compress {
+		if cw.encoder == nil {
+			return len(p), nil
+		}
+		return cw.encoder.Write(p)
+	}
+	return wireWriter{cw}.Write(p)
+}
+
+func (cw *compressWriter) Write(p []byte) (n int, err error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	cw.wrote = true
+	if cw.decided {
+		return cw.write(p)
+	}
+	cw.buf = append(cw.buf, p...)
+	if len(cw.buf) >= cw.cfg.minSize() {
+		cw.decide(cw.compressible())
+	}
+	return len(p), nil
+}
+
+// finish sends the buffered body and closes the encoder.
+func (cw *compressWriter) finish() {
+	if !cw.wroteHeader {
+		return
+	}
+	if !cw.decided {
+		cw.decide(len(cw.buf) >= cw.cfg.minSize() && cw.compressible())
+	}
+	if cw.encoder != nil {
+		cw.encoder.Close()
+	}
+	cw.release()
+}
+
+// release puts the encoder back into the pool.
+func (cw *compressWriter) release() {
+	if cw.encoder != nil {
+		cw.enc.put(cw.encoder)
+		cw.encoder = nil
+	}
+}
+
+func (cw *compressWriter) Flush() {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if !cw.decided {
+		cw.decide(cw.compressible())
+	}
+	if cw.encoder != nil {
+		cw.encoder.Flush()
+	}
+	if f, ok := cw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (cw *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := cw.w.(http.Hijacker); ok {
+		return h.Hijack()
+	}
+	return nil, nil, fmt.Errorf("%T is not a http.Hijacker", cw.w)
+}
+
+func (cw *compressWriter) WroteHeader() bool {
+	return cw.wroteHeader
+}
+
+func (cw *compressWriter) Wrote() bool {
+	return cw.wrote
+}
+
+func (cw *compressWriter) Status() int {
+	return cw.status
+}
+
+// BytesWritten returns the number of bytes sent to the client, after
+// compression.
+func (cw *compressWriter) BytesWritten() int {
+	return cw.wire
+}
+
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.w
+}
+
+// wireWriter writes to the underlying writer counting the bytes.
+type wireWriter struct {
+	cw *compressWriter
+}
+
+func (w wireWriter) Write(p []byte) (n int, err error) {
+	n, err = w.cw.w.Write(p)
+	w.cw.wire += n
+	return
+}
@@ -1,8 +1,13 @@
 package httpu
 
 import (
+	"context"
 	"crypto/tls"
+	"fmt"
+	"net"
 	"net/http"
+	"os"
+	"os/user"
 	"strconv"
 	"time"
 
@@ -21,6 +26,13 @@ type TlsConfig struct {
 	CertFile    string         `mapstructure:"cert_file" yaml:"cert_file"`
 	KeyFile     string         `mapstructure:"key_file" yaml:"key_file"`
 	NPNDisabled bool
+	// HandshakeTimeout is the max duration of the TLS handshake. If zero,
+	// DefaultTlsHandshakeTimeout is used.
+	HandshakeTimeout time.Duration `mapstructure:"handshake_timeout" yaml:"handshake_timeout"`
+	// MaxHandshakes is the max number of concurrent TLS handshakes. The
+	// listener stops accepting while the limit is reached. If zero,
+	// DefaultTlsMaxHandshakes is used.
+	MaxHandshakes int `mapstructure:"max_handshakes" yaml:"max_handshakes"`
 }
 
 func (cfg *TlsConfig) Valid() bool {
@@ -50,11 +62,81 @@ func (ka KeepAliveConfig) Get() (dur time.Duration, err error) {
 	return
 }
 
+// UnixSocketConfig specifies the unix socket file permissions and ownership.
+type UnixSocketConfig struct {
+	// Mode is the socket file mode, like 0660. If zero, the process umask
+	// is used.
+	Mode os.FileMode `mapstructure:"mode" yaml:"mode"`
+	// Owner is the user name or uid of socket file owner.
+	Owner string `mapstructure:"owner" yaml:"owner"`
+	// Group is the group name or gid of socket file group.
+	Group string `mapstructure:"group" yaml:"group"`
+}
+
+// IsZero reports if no options are set.
+func (cfg UnixSocketConfig) IsZero() bool {
+	return cfg == UnixSocketConfig{}
+}
+
+// ids returns the uid and gid of Owner and Group, or -1 if not set.
+func (cfg UnixSocketConfig) ids() (uid, gid int, err error) {
+	uid, gid = -1, -1
+	if cfg.Owner != "" {
+		if uid, err = strconv.Atoi(cfg.Owner); err != nil {
+			var u *user.User
+			if u, err = user.Lookup(cfg.Owner); err != nil {
+				return
+			}
+			if uid, err = strconv.Atoi(u.Uid); err != nil {
+				return
+			}
+		}
+	}
+	if cfg.Group != "" {
+		if gid, err = strconv.Atoi(cfg.Group); err != nil {
+			var g *user.Group
+			if g, err = user.LookupGroup(cfg.Group); err != nil {
+				return
+			}
+			if gid, err = strconv.Atoi(g.Gid); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+func (cfg UnixSocketConfig) apply(pth string) (err error) {
+	if cfg.Mode != 0 {
+		if err = os.Chmod(pth, cfg.Mode); err != nil {
+			return
+		}
+	}
+	if cfg.Owner != "" || cfg.Group != "" {
+		var uid, gid int
+		if uid, gid, err = cfg.ids(); err != nil {
+			return
+		}
+		err = os.Chown(pth, uid, gid)
+	}
+	return
+}
+
 type ListenerConfig struct {
 	Addr  Addr
 	Tls   *TlsConfig
 	Http2 Http2Config
 
+	// ResolveAll binds the listener to all IPs of Addr hostname, like
+	// 127.0.0.1 and ::1 for "localhost:8080".
+	ResolveAll bool `mapstructure:"resolve_all" yaml:"resolve_all"`
+
+	// Unix is the unix socket file options.
+	Unix UnixSocketConfig `mapstructure:"unix" yaml:"unix"`
+
+	// Socket is the low-level socket options.
+	Socket SocketConfig `mapstructure:"socket" yaml:"socket"`
+
 	// DefaultKeepAliveCount specifies maximal number of keepalive messages
 	// sent before marking connection as dead.
 	KeepAliveCount int
@@ -68,6 +150,60 @@ type ListenerConfig struct {
 	Timeouts TimeoutsConfig `mapstructure:"timeouts" yaml:"timeouts"`
 }
 
+// CreateListener creates the network listener of Addr with the socket options.
+// If ResolveAll, binds to every resolved IP of the hostname using
+// a MultiListener.
+func (cfg *ListenerConfig) CreateListener() (l net.Listener, err error) {
+	var p *ParsedAddr
+	if p, err = cfg.Addr.Parse(); err != nil {
+		return
+	}
+	if p.IsUnix() {
+		if l, err = cfg.listen(p); err != nil || p.IsAbstract() {
+			return
+		}
+		if err = cfg.Unix.apply(p.UnixPath); err != nil {
+			l.Close()
+			return nil, fmt.Errorf("unix socket %q: %v", p.UnixPath, err)
+		}
+		return
+	}
+	if !cfg.ResolveAll {
+		return cfg.listen(p)
+	}
+	var addrs []*ParsedAddr
+	if addrs, err = p.Resolve(context.Background()); err != nil {
+		return
+	}
+	if len(addrs) == 1 {
+		return cfg.listen(addrs[0])
+	}
+	listeners := make([]net.Listener, 0, len(addrs))
+	for _, addr := range addrs {
+		if l, err = cfg.listen(addr); err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+	return NewMultiListener(listeners...), nil
+}
+
+func (cfg *ListenerConfig) listen(p *ParsedAddr) (l net.Listener, err error) {
+	if l, err = p.ListenConfig(cfg.Socket.listenConfig()); err != nil {
+		return
+	}
+	if cfg.Socket.Backlog > 0 {
+		if err = setBacklog(l, cfg.Socket.Backlog); err != nil {
+			l.Close()
+			return nil, fmt.Errorf("set backlog of %s failed: %v", p, err)
+		}
+	}
+	return
+}
+
 func (cfg *ListenerConfig) CreateServer() (s *http.Server, err error) {
 	cfg.Timeouts.init()
 	s = &http.Server{
@@ -149,4 +285,31 @@ type Config struct {
 	MaxPostSize                   int64  `mapstructure:"max_post_size" yaml:"max_post_size"`
 	UnlimitedPostSize             bool   `mapstructure:"unlimited_request_size" yaml:"unlimited_post_size"`
 	NotFoundDisabled              bool   `mapstructure:"not_found_disabled" yaml:"not_found_disabled"`
+
+	// BodyLimits are the request body size limits by path prefix, relative to
+	// Prefix, and content type, overriding MaxPostSize and UnlimitedPostSize.
+	BodyLimits BodyLimits `mapstructure:"body_limits" yaml:"body_limits"`
+
+	// Compress is the response compression config.
+	Compress CompressConfig `mapstructure:"compress" yaml:"compress"`
+
+	// Cache is the response cache config.
+	Cache CacheConfig `mapstructure:"cache" yaml:"cache"`
+
+	// Recovery is the handler panic recovery config.
+	Recovery RecoveryConfig `mapstructure:"recovery" yaml:"recovery"`
+
+	// ErrorLog is the http.Server error log config.
+	ErrorLog ErrorLogConfig `mapstructure:"error_log" yaml:"error_log"`
+
+	// Prefork is the multi-process prefork mode config.
+	Prefork PreforkConfig `mapstructure:"prefork" yaml:"prefork"`
+}
+
+// Clone returns a copy of config with its own listeners slice.
+func (cfg *Config) Clone() *Config {
+	clone := *cfg
+	clone.Listeners = append([]ListenerConfig(nil), cfg.Listeners...)
+	clone.BodyLimits = append(BodyLimits(nil), cfg.BodyLimits...)
+	return &clone
 }
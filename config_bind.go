@@ -0,0 +1,384 @@
+package httpu
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+var (
+	durationType        = reflect.TypeOf(time.Duration(0))
+	keepAliveConfigType = reflect.TypeOf(KeepAliveConfig{})
+	fileModeType        = reflect.TypeOf(os.FileMode(0))
+	// bindSkipTypes are the types of config values not bound to env and flags.
+	bindSkipTypes = map[reflect.Type]bool{
+		reflect.TypeOf(http2.Server{}): true,
+	}
+)
+
+// ConfigBinder binds the environment variables and command line flags to the
+// Config values. The names are derived from the config keys (the mapstructure
+// tags or lower case field names): the key `listeners[0].tls.cert_file` is
+// bound to env `HTTPU_LISTENERS_0_TLS_CERT_FILE` and flag
+// `-listeners.0.tls.cert-file`. Call BindEnv before parsing the flags, so the
+// flags override the environment values.
+type ConfigBinder struct {
+	// EnvPrefix is the prefix of environment variables. If empty,
+	// DefaultConfigEnvPrefix is used.
+	EnvPrefix string
+	// FlagPrefix is the prefix of flag names.
+	FlagPrefix string
+	// Listeners is the number of listeners which flags are registered. If zero,
+	// registers flags for the config listeners or one listener if empty.
+	Listeners int
+}
+
+func NewConfigBinder() *ConfigBinder {
+	return &ConfigBinder{}
+}
+
+func (b *ConfigBinder) envPrefix() string {
+	if b.EnvPrefix == "" {
+		return DefaultConfigEnvPrefix + "_"
+	}
+	return strings.ToUpper(b.EnvPrefix) + "_"
+}
+
+// BindEnv sets the values of environ variables, in the form "key=value", to cfg.
+// The variables with unknown names are ignored.
+func (b *ConfigBinder) BindEnv(cfg *Config, environ []string) error {
+	var (
+		errs   ConfigErrors
+		prefix = b.envPrefix()
+		v      = reflect.ValueOf(cfg).Elem()
+	)
+	for _, kv := range environ {
+		if !strings.HasPrefix(kv, prefix) {
+			continue
+		}
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		path := envPath(v.Type(), strings.Split(strings.ToUpper(parts[0][len(prefix):]), "_"))
+		if path == nil {
+			continue
+		}
+		if err := setConfigValue(v, path, parts[1]); err != nil {
+			errs.add(parts[0], err)
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// RegisterFlags registers the flags of config values on fs. The parsed values
+// are set to cfg.
+func (b *ConfigBinder) RegisterFlags(fs *flag.FlagSet, cfg *Config) {
+	for _, e := range b.entries(cfg) {
+		var value flag.Value = &configFlag{cfg, e.path}
+		if e.typ.Kind() == reflect.Bool {
+			value = &configBoolFlag{configFlag{cfg, e.path}}
+		}
+		fs.Var(value, b.FlagPrefix+e.flagName(), e.usage())
+	}
+}
+
+// Help writes the list of environment variables and flags.
+func (b *ConfigBinder) Help(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ENV\tFLAG\tTYPE")
+	prefix := b.envPrefix()
+	for _, e := range configEntries(reflect.TypeOf(Config{}), nil, []string{"<N>"}) {
+		fmt.Fprintf(tw, "%s%s\t-%s%s\t%s\n", prefix, e.envName(), b.FlagPrefix, e.flagName(), e.typeName())
+	}
+	return tw.Flush()
+}
+
+func (b *ConfigBinder) entries(cfg *Config) []configEntry {
+	count := b.Listeners
+	if count == 0 {
+		if count = len(cfg.Listeners); count == 0 {
+			count = 1
+		}
+	}
+	indexes := make([]string, count)
+	for i := range indexes {
+		indexes[i] = strconv.Itoa(i)
+	}
+	return configEntries(reflect.TypeOf(Config{}), nil, indexes)
+}
+
+// configEntry is a bindable config value.
+type configEntry struct {
+	path []string
+	typ  reflect.Type
+}
+
+func (e configEntry) envName() string {
+	return strings.ToUpper(strings.Join(e.path, "_"))
+}
+
+func (e configEntry) flagName() string {
+	return strings.Replace(strings.Join(e.path, "."), "_", "-", -1)
+}
+
+func (e configEntry) typeName() string {
+	switch {
+	case e.typ == durationType:
+		return "duration"
+	case e.typ == keepAliveConfigType:
+		return "duration|seconds"
+	case e.typ == fileModeType:
+		return "octal"
+	case e.typ.Kind() == reflect.Slice:
+		return "[]" + e.typ.Elem().Kind().String() + " (comma separated)"
+	}
+	return e.typ.Kind().String()
+}
+
+func (e configEntry) usage() string {
+	return "set " + strings.Join(e.path, ".") + " config value (" + e.typeName() + ")"
+}
+
+// configEntries returns the bindable values of struct typ. The slices of
+// structs are expanded using indexes.
+func configEntries(typ reflect.Type, path []string, indexes []string) (entries []configEntry) {
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		fpath := append(append([]string(nil), path...), configFieldKey(f))
+		ft := f.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		switch {
+		case bindSkipTypes[ft]:
+		case isConfigScalar(ft):
+			entries = append(entries, configEntry{fpath, ft})
+		case ft.Kind() == reflect.Struct:
+			entries = append(entries, configEntries(ft, fpath, indexes)...)
+		case ft.Kind() == reflect.Slice && ft.Elem().Kind() == reflect.Struct:
+			for _, index := range indexes {
+				entries = append(entries, configEntries(ft.Elem(), append(fpath, index), indexes)...)
+			}
+		}
+	}
+	return
+}
+
+func isConfigScalar(typ reflect.Type) bool {
+	if typ == keepAliveConfigType {
+		return true
+	}
+	switch typ.Kind() {
+	case reflect.Bool, reflect.String,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	case reflect.Slice:
+		return typ.Elem().Kind() == reflect.String
+	}
+	return false
+}
+
+// envPath returns the config path of env name segments or nil if not found.
+func envPath(typ reflect.Type, segs []string) []string {
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		key := configFieldKey(f)
+		keySegs := strings.Split(strings.ToUpper(key), "_")
+		if len(segs) < len(keySegs) || strings.Join(segs[:len(keySegs)], "_") != strings.Join(keySegs, "_") {
+			continue
+		}
+		rest := segs[len(keySegs):]
+		ft := f.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		switch {
+		case bindSkipTypes[ft]:
+		case isConfigScalar(ft):
+			if len(rest) == 0 {
+				return []string{key}
+			}
+		case ft.Kind() == reflect.Struct:
+			if sub := envPath(ft, rest); sub != nil {
+				return append([]string{key}, sub...)
+			}
+		case ft.Kind() == reflect.Slice && ft.Elem().Kind() == reflect.Struct:
+			if len(rest) > 1 {
+				if _, err := strconv.Atoi(rest[0]); err != nil {
+					continue
+				}
+				if sub := envPath(ft.Elem(), rest[1:]); sub != nil {
+					return append([]string{key, rest[0]}, sub...)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// configValue returns the value of path in v. If create, allocates the nil
+// pointers and grows the slices, otherwise returns invalid value if not found.
+func configValue(v reflect.Value, path []string, create bool) (reflect.Value, error) {
+	for _, key := range path {
+		for v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				if !create {
+					return reflect.Value{}, nil
+				}
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		switch v.Kind() {
+		case reflect.Struct:
+			var found bool
+			for i := 0; i < v.NumField(); i++ {
+				if configFieldKey(v.Type().Field(i)) == key {
+					v, found = v.Field(i), true
+					break
+				}
+			}
+			if !found {
+				return reflect.Value{}, fmt.Errorf("unknown key %q", key)
+			}
+		case reflect.Slice:
+			index, err := strconv.Atoi(key)
+			if err != nil || index < 0 {
+				return reflect.Value{}, fmt.Errorf("bad index %q", key)
+			}
+			if index >= v.Len() {
+				if !create {
+					return reflect.Value{}, nil
+				}
+				v.Set(reflect.AppendSlice(v, reflect.MakeSlice(v.Type(), index-v.Len()+1, index-v.Len()+1)))
+			}
+			v = v.Index(index)
+		default:
+			return reflect.Value{}, fmt.Errorf("bad key %q", key)
+		}
+	}
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			if !create {
+				return reflect.Value{}, nil
+			}
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		v = v.Elem()
+	}
+	return v, nil
+}
+
+func setConfigValue(root reflect.Value, path []string, s string) (err error) {
+	var v reflect.Value
+	if v, err = configValue(root, path, true); err != nil {
+		return
+	}
+	switch {
+	case v.Type() == durationType:
+		var d time.Duration
+		if d, err = time.ParseDuration(s); err != nil {
+			return
+		}
+		v.SetInt(int64(d))
+		return
+	case v.Type() == keepAliveConfigType:
+		ka := KeepAliveConfig{Value: s}
+		if _, err = ka.Get(); err != nil {
+			return
+		}
+		v.Set(reflect.ValueOf(ka))
+		return
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		var b bool
+		if b, err = strconv.ParseBool(s); err == nil {
+			v.SetBool(b)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var i int64
+		if i, err = strconv.ParseInt(s, 0, v.Type().Bits()); err == nil {
+			v.SetInt(i)
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		var i uint64
+		if i, err = strconv.ParseUint(s, 0, v.Type().Bits()); err == nil {
+			v.SetUint(i)
+		}
+	case reflect.Float32, reflect.Float64:
+		var f float64
+		if f, err = strconv.ParseFloat(s, v.Type().Bits()); err == nil {
+			v.SetFloat(f)
+		}
+	case reflect.Slice:
+		var items []string
+		if s != "" {
+			items = strings.Split(s, ",")
+		}
+		v.Set(reflect.ValueOf(items).Convert(v.Type()))
+	default:
+		err = fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return
+}
+
+// configFlag is the flag.Value of config value at path.
+type configFlag struct {
+	cfg  *Config
+	path []string
+}
+
+func (f *configFlag) String() string {
+	if f.cfg == nil {
+		return ""
+	}
+	v, err := configValue(reflect.ValueOf(f.cfg).Elem(), f.path, false)
+	if err != nil || !v.IsValid() || v.IsZero() {
+		return ""
+	}
+	switch {
+	case v.Type() == fileModeType:
+		return "0" + strconv.FormatUint(v.Uint(), 8)
+	case v.Type() == keepAliveConfigType:
+		return v.Interface().(KeepAliveConfig).Value
+	case v.Kind() == reflect.Slice:
+		return strings.Join(v.Convert(reflect.TypeOf([]string{})).Interface().([]string), ",")
+	}
+	return fmt.Sprint(v.Interface())
+}
+
+func (f *configFlag) Set(s string) error {
+	return setConfigValue(reflect.ValueOf(f.cfg).Elem(), f.path, s)
+}
+
+type configBoolFlag struct {
+	configFlag
+}
+
+func (f *configBoolFlag) IsBoolFlag() bool {
+	return true
+}
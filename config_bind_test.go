@@ -0,0 +1,141 @@
+package httpu
+
+import (
+	"bytes"
+	"flag"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfigBinderBindEnv(t *testing.T) {
+	cfg := &Config{Listeners: []ListenerConfig{{Addr: ":80"}}}
+	err := (&ConfigBinder{}).BindEnv(cfg, []string{
+		"HTTPU_LISTENERS_0_ADDR=:8080",
+		"HTTPU_LISTENERS_0_TIMEOUTS_READ_TIMEOUT=5s",
+		"HTTPU_LISTENERS_0_KEEPALIVEIDLEINTERVAL=30",
+		"HTTPU_LISTENERS_0_UNIX_MODE=0660",
+		"HTTPU_LISTENERS_1_TLS_CERT_FILE=cert.pem",
+		"HTTPU_LISTENERS_1_SOCKET_NO_DELAY=false",
+		"HTTPU_MAX_POST_SIZE=100",
+		"HTTPU_NOT_FOUND_DISABLED=true",
+		"HTTPU_COMPRESS_ENCODINGS=br,gzip",
+		"HTTPU_UNKNOWN=1",
+		"HTTPU_LISTENERS_X_ADDR=:1",
+		"OTHER_MAX_POST_SIZE=200",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Listeners) != 2 {
+		t.Fatalf("listeners = %+v", cfg.Listeners)
+	}
+	l0, l1 := cfg.Listeners[0], cfg.Listeners[1]
+	if l0.Addr != ":8080" || l0.Timeouts.ReadTimeout != 5*time.Second || l0.Unix.Mode != 0660 {
+		t.Errorf("listeners[0] = %+v", l0)
+	}
+	if d, _ := l0.KeepAliveIdleInterval.Get(); d != 30*time.Second {
+		t.Errorf("listeners[0].keepaliveidleinterval = %v", d)
+	}
+	if l1.Tls == nil || l1.Tls.CertFile != "cert.pem" || l1.Socket.NoDelay == nil || *l1.Socket.NoDelay {
+		t.Errorf("listeners[1] = %+v", l1)
+	}
+	if cfg.MaxPostSize != 100 || !cfg.NotFoundDisabled || !reflect.DeepEqual(cfg.Compress.Encodings, []string{"br", "gzip"}) {
+		t.Errorf("config = %+v", cfg)
+	}
+
+	err = (&ConfigBinder{EnvPrefix: "app"}).BindEnv(cfg, []string{
+		"APP_MAX_POST_SIZE=big",
+		"APP_LISTENERS_0_TIMEOUTS_READ_TIMEOUT=5",
+		"HTTPU_MAX_POST_SIZE=300",
+	})
+	errs, _ := err.(ConfigErrors)
+	if len(errs) != 2 || errs[0].Path != "APP_MAX_POST_SIZE" || errs[1].Path != "APP_LISTENERS_0_TIMEOUTS_READ_TIMEOUT" {
+		t.Errorf("errors = %v", err)
+	}
+	if cfg.MaxPostSize != 100 {
+		t.Errorf("max_post_size = %d", cfg.MaxPostSize)
+	}
+}
+
+func TestConfigBinderRegisterFlags(t *testing.T) {
+	cfg := &Config{}
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	(&ConfigBinder{FlagPrefix: "http.", Listeners: 2}).RegisterFlags(fs, cfg)
+	err := fs.Parse([]string{
+		"-http.listeners.0.addr", ":8080",
+		"-http.listeners.1.tls.cert-file", "cert.pem",
+		"-http.listeners.1.timeouts.read-timeout=5s",
+		"-http.max-post-size=100",
+		"-http.not-found-disabled",
+		"-http.compress.encodings", "gzip",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Listeners) != 2 || cfg.Listeners[0].Addr != ":8080" || cfg.Listeners[1].Tls == nil ||
+		cfg.Listeners[1].Tls.CertFile != "cert.pem" || cfg.Listeners[1].Timeouts.ReadTimeout != 5*time.Second {
+		t.Errorf("listeners = %+v", cfg.Listeners)
+	}
+	if cfg.MaxPostSize != 100 || !cfg.NotFoundDisabled || !reflect.DeepEqual(cfg.Compress.Encodings, []string{"gzip"}) {
+		t.Errorf("config = %+v", cfg)
+	}
+	if fs.Lookup("http.listeners.2.addr") != nil {
+		t.Error("flags registered for more listeners than Listeners")
+	}
+	if f := fs.Lookup("http.listeners.1.timeouts.read-timeout"); f == nil || f.Value.String() != "5s" {
+		t.Errorf("read-timeout flag = %+v", f)
+	}
+
+	fs = flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	(&ConfigBinder{}).RegisterFlags(fs, &Config{})
+	if err = fs.Parse([]string{"-listeners.0.timeouts.read-timeout=5"}); err == nil {
+		t.Error("invalid duration parsed")
+	}
+}
+
+func TestConfigBinderPrecedence(t *testing.T) {
+	cfg := &Config{MaxPostSize: 1, Prefix: "/file/"}
+	b := &ConfigBinder{}
+	if err := b.BindEnv(cfg, []string{"HTTPU_MAX_POST_SIZE=2", "HTTPU_PREFIX=/env/"}); err != nil {
+		t.Fatal(err)
+	}
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	b.RegisterFlags(fs, cfg)
+	if err := fs.Parse([]string{"-max-post-size=3"}); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.MaxPostSize != 3 || cfg.Prefix != "/env/" {
+		t.Errorf("max_post_size = %d, prefix = %q", cfg.MaxPostSize, cfg.Prefix)
+	}
+}
+
+func TestConfigBinderHelp(t *testing.T) {
+	var buf bytes.Buffer
+	if err := (&ConfigBinder{EnvPrefix: "app", FlagPrefix: "http."}).Help(&buf); err != nil {
+		t.Fatal(err)
+	}
+	help := buf.String()
+	lines := map[string]bool{}
+	for _, line := range strings.Split(help, "\n") {
+		lines[strings.Join(strings.Fields(line), " ")] = true
+	}
+	for _, line := range []string{
+		"ENV FLAG TYPE",
+		"APP_LISTENERS_<N>_TLS_CERT_FILE -http.listeners.<N>.tls.cert-file string",
+		"APP_LISTENERS_<N>_TIMEOUTS_READ_TIMEOUT -http.listeners.<N>.timeouts.read-timeout duration",
+		"APP_LISTENERS_<N>_UNIX_MODE -http.listeners.<N>.unix.mode octal",
+		"APP_MAX_POST_SIZE -http.max-post-size int64",
+	} {
+		if !lines[line] {
+			t.Errorf("help has no %q:\n%s", line, help)
+		}
+	}
+	if strings.Contains(help, "HTTP2_CONFIG") {
+		t.Error("help has the skipped http2.Server values")
+	}
+}
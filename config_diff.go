@@ -0,0 +1,131 @@
+package httpu
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// ConfigChange describes a changed value between two configs.
+type ConfigChange struct {
+	// Path is the path of changed value, like `listeners[1].timeouts`.
+	Path     string
+	Old, New interface{}
+	// Restart reports if the change requires a server restart to take effect.
+	Restart bool
+}
+
+func (c ConfigChange) String() string {
+	s := fmt.Sprintf("%s: %v -> %v", c.Path, c.Old, c.New)
+	if c.Restart {
+		s += " (requires restart)"
+	}
+	return s
+}
+
+type ConfigDiff []ConfigChange
+
+// Live returns the changes applied without restart.
+func (d ConfigDiff) Live() (live ConfigDiff) {
+	for _, c := range d {
+		if !c.Restart {
+			live = append(live, c)
+		}
+	}
+	return
+}
+
+// Restart returns the changes that requires a server restart.
+func (d ConfigDiff) Restart() (restart ConfigDiff) {
+	for _, c := range d {
+		if c.Restart {
+			restart = append(restart, c)
+		}
+	}
+	return
+}
+
+// DiffConfig compares the configs old and new. The listeners are matched by
+// addr: the added and removed listeners, the global options, except prefork,
+// the listeners timeouts and TLS files are live changes.
+func DiffConfig(old, new *Config) (diff ConfigDiff) {
+	var (
+		ov, nv = reflect.ValueOf(old).Elem(), reflect.ValueOf(new).Elem()
+		typ    = ov.Type()
+	)
+	for i := 0; i < typ.NumField(); i++ {
+		if f := typ.Field(i); f.Name != "Listeners" {
+			if o, n := ov.Field(i).Interface(), nv.Field(i).Interface(); !reflect.DeepEqual(o, n) {
+				diff = append(diff, ConfigChange{Path: configFieldKey(f), Old: o, New: n, Restart: f.Name == "Prefork"})
+			}
+		}
+	}
+
+	oldByAddr := make(map[Addr]ListenerConfig, len(old.Listeners))
+	for _, l := range old.Listeners {
+		oldByAddr[l.Addr] = l
+	}
+	newByAddr := make(map[Addr]bool, len(new.Listeners))
+
+	for i, n := range new.Listeners {
+		newByAddr[n.Addr] = true
+		path := fmt.Sprintf("listeners[%d]", i)
+		o, ok := oldByAddr[n.Addr]
+		if !ok {
+			diff = append(diff, ConfigChange{Path: path, New: n.Addr})
+			continue
+		}
+		diff = append(diff, diffListenerConfig(path, o, n)...)
+	}
+
+	for i, o := range old.Listeners {
+		if !newByAddr[o.Addr] {
+			diff = append(diff, ConfigChange{Path: fmt.Sprintf("listeners[%d]", i), Old: o.Addr})
+		}
+	}
+	return
+}
+
+func diffListenerConfig(path string, old, new ListenerConfig) (diff ConfigDiff) {
+	var (
+		ov, nv = reflect.ValueOf(old), reflect.ValueOf(new)
+		typ    = ov.Type()
+	)
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		o, n := ov.Field(i).Interface(), nv.Field(i).Interface()
+		if reflect.DeepEqual(o, n) {
+			continue
+		}
+		fpath := path + "." + configFieldKey(f)
+		switch f.Name {
+		case "Timeouts":
+			diff = append(diff, ConfigChange{Path: fpath, Old: o, New: n})
+		case "Tls":
+			if old.Tls == nil || new.Tls == nil {
+				diff = append(diff, ConfigChange{Path: fpath, Old: o, New: n, Restart: true})
+				continue
+			}
+			if old.Tls.CertFile != new.Tls.CertFile {
+				diff = append(diff, ConfigChange{Path: fpath + ".cert_file", Old: old.Tls.CertFile, New: new.Tls.CertFile})
+			}
+			if old.Tls.KeyFile != new.Tls.KeyFile {
+				diff = append(diff, ConfigChange{Path: fpath + ".key_file", Old: old.Tls.KeyFile, New: new.Tls.KeyFile})
+			}
+			if !reflect.DeepEqual(old.Tls.Generate, new.Tls.Generate) {
+				diff = append(diff, ConfigChange{Path: fpath + ".generate", Old: old.Tls.Generate, New: new.Tls.Generate, Restart: true})
+			}
+			if old.Tls.NPNDisabled != new.Tls.NPNDisabled {
+				diff = append(diff, ConfigChange{Path: fpath + ".npndisabled", Old: old.Tls.NPNDisabled, New: new.Tls.NPNDisabled, Restart: true})
+			}
+			if old.Tls.HandshakeTimeout != new.Tls.HandshakeTimeout {
+				diff = append(diff, ConfigChange{Path: fpath + ".handshake_timeout", Old: old.Tls.HandshakeTimeout, New: new.Tls.HandshakeTimeout, Restart: true})
+			}
+			if old.Tls.MaxHandshakes != new.Tls.MaxHandshakes {
+				diff = append(diff, ConfigChange{Path: fpath + ".max_handshakes", Old: old.Tls.MaxHandshakes, New: new.Tls.MaxHandshakes, Restart: true})
+			}
+		default:
+			diff = append(diff, ConfigChange{Path: fpath, Old: o, New: n, Restart: true})
+		}
+	}
+	return
+}
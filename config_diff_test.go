@@ -0,0 +1,118 @@
+package httpu
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDiffConfig(t *testing.T) {
+	base := func() *Config {
+		return &Config{
+			Prefix: "/",
+			Listeners: []ListenerConfig{
+				{Addr: ":80"},
+				{Addr: ":443", Tls: &TlsConfig{CertFile: "cert.pem", KeyFile: "key.pem"}},
+			},
+		}
+	}
+	type change struct {
+		path    string
+		restart bool
+	}
+	for _, tt := range []struct {
+		name   string
+		change func(cfg *Config)
+		want   []change
+	}{
+		{"equal", func(cfg *Config) {}, nil},
+		{"global", func(cfg *Config) {
+			cfg.Prefix = "/app/"
+			cfg.MaxPostSize = 100
+		}, []change{{"prefix", false}, {"max_post_size", false}}},
+		{"prefork", func(cfg *Config) { cfg.Prefork.Workers = 2 }, []change{{"prefork", true}}},
+		{"added listener", func(cfg *Config) {
+			cfg.Listeners = append(cfg.Listeners, ListenerConfig{Addr: ":8080"})
+		}, []change{{"listeners[2]", false}}},
+		{"removed listener", func(cfg *Config) {
+			cfg.Listeners = cfg.Listeners[1:]
+		}, []change{{"listeners[0]", false}}},
+		{"reordered listeners", func(cfg *Config) {
+			cfg.Listeners[0], cfg.Listeners[1] = cfg.Listeners[1], cfg.Listeners[0]
+		}, nil},
+		{"timeouts", func(cfg *Config) {
+			cfg.Listeners[0].Timeouts.ReadTimeout = time.Second
+		}, []change{{"listeners[0].timeouts", false}}},
+		{"tls files", func(cfg *Config) {
+			cfg.Listeners[1].Tls = &TlsConfig{CertFile: "new.pem", KeyFile: "new-key.pem"}
+		}, []change{{"listeners[1].tls.cert_file", false}, {"listeners[1].tls.key_file", false}}},
+		{"tls options", func(cfg *Config) {
+			cfg.Listeners[1].Tls = &TlsConfig{CertFile: "cert.pem", KeyFile: "key.pem", HandshakeTimeout: time.Second, MaxHandshakes: 10}
+		}, []change{{"listeners[1].tls.handshake_timeout", true}, {"listeners[1].tls.max_handshakes", true}}},
+		{"tls enabled", func(cfg *Config) {
+			cfg.Listeners[0].Tls = &TlsConfig{CertFile: "cert.pem", KeyFile: "key.pem"}
+		}, []change{{"listeners[0].tls", true}}},
+		{"socket", func(cfg *Config) {
+			cfg.Listeners[0].Socket.Backlog = 10
+			cfg.Listeners[0].ResolveAll = true
+		}, []change{{"listeners[0].resolve_all", true}, {"listeners[0].socket", true}}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			old, cfg := base(), base()
+			tt.change(cfg)
+			var got []change
+			for _, c := range DiffConfig(old, cfg) {
+				got = append(got, change{c.Path, c.Restart})
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServerApplyConfig(t *testing.T) {
+	dir := t.TempDir()
+	first, second := Addr("unix:"+filepath.Join(dir, "a.sock")), Addr("unix:"+filepath.Join(dir, "b.sock"))
+	s := startTestServer(t, &Config{Listeners: []ListenerConfig{{Addr: first}}}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+
+	cfg := s.Config.Clone()
+	cfg.MaxPostSize = 100
+	cfg.Listeners[0].Timeouts.ReadTimeout = time.Minute
+	cfg.Listeners[0].Socket.Backlog = 10
+	cfg.Listeners = append(cfg.Listeners, ListenerConfig{Addr: second})
+	diff, err := s.ApplyConfig(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if live, restart := diff.Live(), diff.Restart(); len(live) != 3 || len(restart) != 1 || restart[0].Path != "listeners[0].socket" {
+		t.Fatalf("live = %v, restart = %v", live, restart)
+	}
+	if s.Config.MaxPostSize != 100 || s.Config.Listeners[0].Timeouts.ReadTimeout != time.Minute {
+		t.Errorf("live changes not applied: %+v", s.Config)
+	}
+	if s.Config.Listeners[0].Socket.Backlog != 0 {
+		t.Error("the running config has the change that requires restart")
+	}
+	if body, err := unixGet(second); err != nil || body != "ok" {
+		t.Errorf("GET added listener: %q, %v", body, err)
+	}
+
+	// the invalid config is rejected and the running config is kept
+	running := s.Config
+	invalid := running.Clone()
+	invalid.MaxPostSize = -1
+	invalid.Listeners = invalid.Listeners[:1]
+	if _, err = s.ApplyConfig(context.Background(), invalid); err == nil {
+		t.Fatal("invalid config applied")
+	}
+	if s.Config != running || s.Listener(second) == nil {
+		t.Error("the running config changed by the invalid config")
+	}
+}
@@ -0,0 +1,226 @@
+package httpu
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/mitchellh/mapstructure"
+	"github.com/moisespsena-go/logging"
+	"github.com/moisespsena-go/task"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	DefaultConfigEnvPrefix     = "HTTPU"
+	DefaultConfigWatchInterval = 2 * time.Second
+)
+
+// ConfigLoader loads Config from YAML, JSON or TOML file and overrides its
+// values with the environment variables.
+type ConfigLoader struct {
+	// Path is the config file path.
+	Path string
+	// Format is the file format: "yaml", "json" or "toml". If empty, is
+	// detected by the file extension.
+	Format string
+	// EnvPrefix is the prefix of environment variables that overrides the file
+	// values, like `HTTPU_MAX_POST_SIZE` or `HTTPU_LISTENERS_0_ADDR`. See
+	// ConfigBinder. If empty, DefaultConfigEnvPrefix is used.
+	EnvPrefix string
+	// Environ returns the environment variables in the form "key=value".
+	// If nil, os.Environ is used.
+	Environ func() []string
+	// Interval specifies how often the file is checked for changes.
+	// If zero, DefaultConfigWatchInterval is used.
+	Interval time.Duration
+
+	// modTime and size are of the last loaded file
+	modTime time.Time
+	size    int64
+}
+
+func NewConfigLoader(path string) *ConfigLoader {
+	return &ConfigLoader{Path: path}
+}
+
+// Load reads the config file and applies the environment overrides.
+func (l *ConfigLoader) Load() (cfg *Config, err error) {
+	// the stat before the read, so the writes while reading are reloaded
+	var info os.FileInfo
+	if info, err = os.Stat(l.Path); err != nil {
+		return
+	}
+	l.modTime, l.size = info.ModTime(), info.Size()
+
+	var data []byte
+	if data, err = ioutil.ReadFile(l.Path); err != nil {
+		return
+	}
+
+	format := l.Format
+	if format == "" {
+		format = strings.TrimPrefix(filepath.Ext(l.Path), ".")
+	}
+
+	var raw = map[string]interface{}{}
+	switch format {
+	case "yaml", "yml":
+		err = yaml.Unmarshal(data, &raw)
+	case "json":
+		err = json.Unmarshal(data, &raw)
+	case "toml":
+		err = toml.Unmarshal(data, &raw)
+	default:
+		err = fmt.Errorf("unsupported format %q", format)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("load config %q failed: %v", l.Path, err)
+	}
+
+	cfg = &Config{}
+	if err = DecodeConfig(raw, cfg); err != nil {
+		return nil, fmt.Errorf("load config %q failed: %v", l.Path, err)
+	}
+
+	environ := l.Environ
+	if environ == nil {
+		environ = os.Environ
+	}
+	if err = (&ConfigBinder{EnvPrefix: l.EnvPrefix}).BindEnv(cfg, environ()); err != nil {
+		return nil, fmt.Errorf("load config %q environment failed: %v", l.Path, err)
+	}
+	return
+}
+
+// Watch checks the config file every interval and calls cb with the loaded
+// config when it changes since the last Load, or since the Watch call if not
+// loaded, until ctx is done.
+func (l *ConfigLoader) Watch(ctx context.Context, cb func(cfg *Config, err error)) {
+	interval := l.Interval
+	if interval == 0 {
+		interval = DefaultConfigWatchInterval
+	}
+
+	if l.modTime.IsZero() {
+		if info, err := os.Stat(l.Path); err == nil {
+			l.modTime, l.size = info.ModTime(), info.Size()
+		}
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			info, err := os.Stat(l.Path)
+			if err != nil {
+				// the file may be replaced by the editor
+				continue
+			}
+			if info.ModTime().Equal(l.modTime) && info.Size() == l.size {
+				continue
+			}
+			cb(l.Load())
+		}
+	}
+}
+
+// DecodeConfig decodes the raw map, like parsed from config file, into cfg.
+// Durations accepts strings like "2h45m" and the KeepAliveConfig accepts
+// the string or integer (seconds) value.
+func DecodeConfig(raw map[string]interface{}, cfg *Config) (err error) {
+	var decoder *mapstructure.Decoder
+	if decoder, err = mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		DecodeHook: mapstructure.ComposeDecodeHookFunc(
+			mapstructure.StringToTimeDurationHookFunc(),
+			keepAliveConfigHook,
+		),
+		WeaklyTypedInput: true,
+		Result:           cfg,
+	}); err != nil {
+		return
+	}
+	return decoder.Decode(raw)
+}
+
+func keepAliveConfigHook(from, to reflect.Type, data interface{}) (interface{}, error) {
+	if to != reflect.TypeOf(KeepAliveConfig{}) && to != reflect.TypeOf(&KeepAliveConfig{}) {
+		return data, nil
+	}
+	switch from.Kind() {
+	case reflect.String, reflect.Int, reflect.Int64, reflect.Float64:
+		return map[string]interface{}{"str": fmt.Sprint(data)}, nil
+	}
+	return data, nil
+}
+
+// configFieldKey returns the config key of the struct field: the mapstructure
+// tag name or the lower case field name.
+func configFieldKey(f reflect.StructField) string {
+	if tag := strings.Split(f.Tag.Get("mapstructure"), ",")[0]; tag != "" {
+		return tag
+	}
+	return strings.ToLower(f.Name)
+}
+
+// ConfigWatcher is a task that watches the config file and applies the
+// changes to the server.
+type ConfigWatcher struct {
+	Loader *ConfigLoader
+	Server *Server
+	// ShutdownTimeout is the max duration to drain the removed listeners.
+	ShutdownTimeout time.Duration
+	Log             logging.Logger
+	cancel          context.CancelFunc
+}
+
+func NewConfigWatcher(loader *ConfigLoader, server *Server) *ConfigWatcher {
+	return &ConfigWatcher{Loader: loader, Server: server, ShutdownTimeout: 5 * time.Second}
+}
+
+func (w *ConfigWatcher) Start(done func()) (stop task.Stoper, err error) {
+	if w.Log == nil {
+		w.Log = logging.WithPrefix(w.Server.log, "{config "+w.Loader.Path+"}", ":")
+	}
+	var ctx context.Context
+	ctx, w.cancel = context.WithCancel(context.Background())
+	stop, setDone := task.NewStopDoner(w.cancel)
+	go func() {
+		defer func() {
+			setDone()
+			done()
+		}()
+		w.Loader.Watch(ctx, w.apply)
+	}()
+	return
+}
+
+func (w *ConfigWatcher) apply(cfg *Config, err error) {
+	if err != nil {
+		w.Log.Error(err.Error())
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), w.ShutdownTimeout)
+	defer cancel()
+	diff, err := w.Server.ApplyConfig(ctx, cfg)
+	if err != nil {
+		w.Log.Errorf("new config rejected: %v", err)
+		return
+	}
+	for _, c := range diff.Live() {
+		w.Log.Infof("applied %s", c)
+	}
+	for _, c := range diff.Restart() {
+		w.Log.Warningf("changed %s", c)
+	}
+}
@@ -0,0 +1,141 @@
+package httpu
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestConfigLoaderLoad(t *testing.T) {
+	dir := t.TempDir()
+	for _, tt := range []struct {
+		file, data string
+		ok         bool
+	}{
+		{"config.yaml", "prefix: /app/\nmax_post_size: 100\nlisteners:\n  - addr: \":8080\"\n    timeouts:\n      read_timeout: 5s\n", true},
+		{"config.json", `{"prefix": "/app/", "max_post_size": 100, "listeners": [{"addr": ":8080", "timeouts": {"read_timeout": "5s"}}]}`, true},
+		{"config.toml", "prefix = \"/app/\"\nmax_post_size = 100\n[[listeners]]\naddr = \":8080\"\n[listeners.timeouts]\nread_timeout = \"5s\"\n", true},
+		{"syntax.yaml", "prefix: [", false},
+		{"decode.yaml", "max_post_size: big\n", false},
+		{"config.ini", "prefix=/app/", false},
+	} {
+		path := filepath.Join(dir, tt.file)
+		if err := os.WriteFile(path, []byte(tt.data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		l := NewConfigLoader(path)
+		l.Environ = func() []string { return nil }
+		cfg, err := l.Load()
+		if !tt.ok {
+			if err == nil {
+				t.Errorf("%s: loaded %+v", tt.file, cfg)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.file, err)
+			continue
+		}
+		if cfg.Prefix != "/app/" || cfg.MaxPostSize != 100 || len(cfg.Listeners) != 1 ||
+			cfg.Listeners[0].Addr != ":8080" || cfg.Listeners[0].Timeouts.ReadTimeout != 5*time.Second {
+			t.Errorf("%s: got %+v", tt.file, cfg)
+		}
+	}
+}
+
+func TestConfigLoaderLoadEnv(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte("max_post_size: 100\nlisteners:\n  - addr: \":8080\"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	l := NewConfigLoader(path)
+	l.Environ = func() []string {
+		return []string{"HTTPU_MAX_POST_SIZE=200", "HTTPU_LISTENERS_0_ADDR=:9090", "OTHER_MAX_POST_SIZE=300"}
+	}
+	cfg, err := l.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.MaxPostSize != 200 || cfg.Listeners[0].Addr != ":9090" {
+		t.Errorf("got %+v", cfg)
+	}
+
+	l.Environ = func() []string { return []string{"HTTPU_MAX_POST_SIZE=big"} }
+	if _, err = l.Load(); err == nil {
+		t.Error("invalid env value loaded")
+	}
+}
+
+func TestConfigWatcher(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+	write := func(data string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	listeners := "listeners:\n  - addr: unix:" + filepath.Join(dir, "http.sock") + "\n"
+	write(listeners + "max_post_size: 100\n")
+
+	l := NewConfigLoader(path)
+	l.Environ = func() []string { return nil }
+	l.Interval = 5 * time.Millisecond
+	cfg, err := l.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(cfg, nil)
+	w := NewConfigWatcher(l, s)
+	applied := make(chan struct{}, 10)
+	watch := func(cfg *Config, err error) {
+		w.apply(cfg, err)
+		applied <- struct{}{}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	w.Log = s.log
+	go func() {
+		defer close(done)
+		l.Watch(ctx, watch)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	maxPostSize := func() int64 {
+		s.listenersMu.RLock()
+		defer s.listenersMu.RUnlock()
+		return s.Config.MaxPostSize
+	}
+	waitApplied := func() {
+		t.Helper()
+		select {
+		case <-applied:
+		case <-time.After(5 * time.Second):
+			t.Fatal("the config change was not detected")
+		}
+	}
+
+	write(listeners + "max_post_size: 2000\n")
+	waitApplied()
+	if n := maxPostSize(); n != 2000 {
+		t.Fatalf("max_post_size = %d", n)
+	}
+
+	// the decode errors keep the running config
+	write(listeners + "max_post_size: invalid\n")
+	waitApplied()
+	if n := maxPostSize(); n != 2000 {
+		t.Errorf("max_post_size = %d after decode error", n)
+	}
+
+	// the invalid config is rejected
+	write(listeners + "max_post_size: -1000\n")
+	waitApplied()
+	if n := maxPostSize(); n != 2000 {
+		t.Errorf("max_post_size = %d after invalid config", n)
+	}
+}
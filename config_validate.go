@@ -0,0 +1,325 @@
+package httpu
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ConfigError is a validation error of the config value at Path.
+type ConfigError struct {
+	// Path is the path of value, like `listeners[2].tls.cert_file`.
+	Path string
+	Err  error
+}
+
+func (e *ConfigError) Error() string {
+	return e.Path + ": " + e.Err.Error()
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+// ConfigErrors is the list of all validation errors of a config.
+type ConfigErrors []*ConfigError
+
+func (e ConfigErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return "invalid config:\n  " + strings.Join(msgs, "\n  ")
+}
+
+func (e *ConfigErrors) add(path string, err error) {
+	*e = append(*e, &ConfigError{path, err})
+}
+
+func (e *ConfigErrors) addf(path string, format string, args ...interface{}) {
+	e.add(path, fmt.Errorf(format, args...))
+}
+
+// Validate checks all config values and returns the ConfigErrors with every
+// problem found, or nil if config is valid.
+func (cfg *Config) Validate() error {
+	var errs ConfigErrors
+
+	if cfg.Prefix != "" && cfg.Prefix[0] != '/' {
+		errs.addf("prefix", "%q does not start with '/'", cfg.Prefix)
+	}
+	if cfg.MaxPostSize < 0 {
+		errs.addf("max_post_size", "negative value %d", cfg.MaxPostSize)
+	}
+	for i, l := range cfg.BodyLimits {
+		path := fmt.Sprintf("body_limits[%d]", i)
+		if l.Prefix != "" && !strings.HasPrefix(l.Prefix, "/") {
+			errs.addf(path+".prefix", "%q does not start with '/'", l.Prefix)
+		}
+		if l.ContentType != "" {
+			if _, _, err := mime.ParseMediaType(l.ContentType); err != nil {
+				errs.add(path+".content_type", err)
+			}
+		}
+		if l.MaxSize < 0 {
+			errs.addf(path+".max_size", "negative value %d", l.MaxSize)
+		}
+	}
+
+	for _, name := range cfg.Compress.Encodings {
+		if GetEncoding(name) == nil {
+			errs.addf("compress.encodings", "unsupported encoding %q", name)
+		}
+	}
+	if cfg.Compress.MinSize < -1 {
+		errs.addf("compress.min_size", "invalid value %d", cfg.Compress.MinSize)
+	}
+	if cfg.Cache.MaxSize < 0 {
+		errs.addf("cache.max_size", "negative value %d", cfg.Cache.MaxSize)
+	}
+	if cfg.Cache.MaxAge < 0 {
+		errs.addf("cache.max_age", "negative duration %s", cfg.Cache.MaxAge)
+	}
+	if cfg.Cache.MaxBodySize < 0 {
+		errs.addf("cache.max_body_size", "negative value %d", cfg.Cache.MaxBodySize)
+	}
+	if cfg.Recovery.ErrorPage != "" {
+		if _, err := os.Stat(cfg.Recovery.ErrorPage); err != nil {
+			errs.add("recovery.error_page", err)
+		}
+	}
+	if cfg.ErrorLog.RateLimit < -1 {
+		errs.addf("error_log.rate_limit", "invalid value %d", cfg.ErrorLog.RateLimit)
+	}
+	if cfg.ErrorLog.RateInterval < 0 {
+		errs.addf("error_log.rate_interval", "negative duration %s", cfg.ErrorLog.RateInterval)
+	}
+	cfg.Prefork.validate("prefork", &errs)
+
+	addrs := make(map[string]int, len(cfg.Listeners))
+	for i, l := range cfg.Listeners {
+		path := fmt.Sprintf("listeners[%d]", i)
+		if key := listenKey(l.Addr); key != "" {
+			if j, ok := addrs[key]; ok {
+				errs.addf(path+".addr", "%q is duplicated of listeners[%d]", l.Addr, j)
+			} else {
+				addrs[key] = i
+			}
+		}
+		l.validate(path, &errs)
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+func (cfg *ListenerConfig) validate(path string, errs *ConfigErrors) {
+	if err := validateAddr(cfg.Addr); err != nil {
+		errs.add(path+".addr", err)
+	}
+
+	if !cfg.Unix.IsZero() {
+		if !cfg.Addr.IsUnix() {
+			errs.addf(path+".unix", "options require a unix socket address")
+		} else if p, err := cfg.Addr.Parse(); err == nil && p.IsAbstract() {
+			errs.addf(path+".unix", "options not supported by abstract socket")
+		}
+		if _, _, err := cfg.Unix.ids(); err != nil {
+			errs.add(path+".unix", err)
+		}
+		if cfg.Unix.Mode&^os.ModePerm != 0 {
+			errs.addf(path+".unix.mode", "invalid permission bits %#o", uint32(cfg.Unix.Mode))
+		}
+	}
+
+	if cfg.Tls != nil {
+		cfg.Tls.validate(path+".tls", errs)
+	}
+
+	if cfg.KeepAliveCount < 0 {
+		errs.addf(path+".keepalivecount", "negative value %d", cfg.KeepAliveCount)
+	}
+	for _, ka := range []struct {
+		key   string
+		value *KeepAliveConfig
+	}{
+		{"keepaliveidleinterval", cfg.KeepAliveIdleInterval},
+		{"keepaliveinterval", cfg.KeepAliveInterval},
+	} {
+		if ka.value == nil {
+			continue
+		}
+		if dur, err := ka.value.Get(); err != nil {
+			errs.add(path+"."+ka.key, err)
+		} else if dur < 0 {
+			errs.addf(path+"."+ka.key, "negative duration %s", dur)
+		}
+	}
+
+	cfg.Socket.validate(path+".socket", errs)
+	cfg.Timeouts.validate(path+".timeouts", errs)
+}
+
+func (cfg *PreforkConfig) validate(path string, errs *ConfigErrors) {
+	if cfg.Workers < -1 {
+		errs.addf(path+".workers", "invalid value %d", cfg.Workers)
+	}
+	if cfg.MaxRestarts < 0 {
+		errs.addf(path+".max_restarts", "negative value %d", cfg.MaxRestarts)
+	}
+	for _, t := range []struct {
+		key string
+		dur time.Duration
+	}{
+		{"restart_delay", cfg.RestartDelay},
+		{"max_restart_delay", cfg.MaxRestartDelay},
+		{"shutdown_timeout", cfg.ShutdownTimeout},
+	} {
+		if t.dur < 0 {
+			errs.addf(path+"."+t.key, "negative duration %s", t.dur)
+		}
+	}
+	if cfg.Enabled() && runtime.GOOS == "windows" {
+		errs.addf(path, "not supported on windows")
+	}
+}
+
+func (cfg *SocketConfig) validate(path string, errs *ConfigErrors) {
+	for _, v := range []struct {
+		key   string
+		value int64
+	}{
+		{"backlog", int64(cfg.Backlog)},
+		{"fast_open", int64(cfg.FastOpen)},
+		{"defer_accept", int64(cfg.DeferAccept)},
+		{"send_buffer", int64(cfg.SendBuffer)},
+		{"receive_buffer", int64(cfg.ReceiveBuffer)},
+		{"user_timeout", int64(cfg.UserTimeout)},
+	} {
+		if v.value < 0 {
+			errs.addf(path+"."+v.key, "negative value %d", v.value)
+		}
+	}
+	if runtime.GOOS != "linux" && (cfg.ReusePort || cfg.Backlog > 0 || cfg.FastOpen > 0 || cfg.DeferAccept > 0 ||
+		cfg.V6Only != nil || cfg.SendBuffer > 0 || cfg.ReceiveBuffer > 0 || cfg.UserTimeout > 0) {
+		errs.addf(path, "options are supported on linux only, except no_delay")
+	}
+}
+
+func validateAddr(a Addr) (err error) {
+	var p *ParsedAddr
+	if p, err = a.Parse(); err != nil {
+		return
+	}
+	if p.IsAbstract() {
+		if runtime.GOOS != "linux" {
+			return errors.New("abstract unix socket requires linux")
+		}
+	} else if p.IsUnix() {
+		if err = dirWritable(filepath.Dir(p.UnixPath)); err != nil {
+			return fmt.Errorf("unix socket directory is not writable: %v", err)
+		}
+	}
+	return
+}
+
+// listenKey returns the key of the bound address of a, equal for the
+// addresses binding the same socket, like ":8080" and "0.0.0.0:8080", or
+// empty if a is invalid or binds a random port.
+func listenKey(a Addr) string {
+	p, err := a.Parse()
+	if err != nil {
+		return ""
+	}
+	if p.IsUnix() {
+		if p.IsAbstract() {
+			return "unix:" + p.UnixPath
+		}
+		return "unix:" + filepath.Clean(p.UnixPath)
+	}
+	if p.Port == 0 {
+		return ""
+	}
+	host := strings.ToLower(p.Host)
+	if ip := net.ParseIP(host); ip != nil {
+		if ip.IsUnspecified() {
+			host = ""
+		} else {
+			host = ip.String()
+		}
+	}
+	if p.Zone != "" {
+		host += "%" + p.Zone
+	}
+	return net.JoinHostPort(host, strconv.Itoa(p.Port))
+}
+
+func (cfg *TlsConfig) validate(path string, errs *ConfigErrors) {
+	if cfg.HandshakeTimeout < 0 {
+		errs.addf(path+".handshake_timeout", "negative duration %s", cfg.HandshakeTimeout)
+	}
+	if cfg.MaxHandshakes < 0 {
+		errs.addf(path+".max_handshakes", "negative value %d", cfg.MaxHandshakes)
+	}
+	if cfg.CertFile == "" {
+		errs.addf(path+".cert_file", "is required")
+	}
+	if cfg.KeyFile == "" {
+		errs.addf(path+".key_file", "is required")
+	}
+	if cfg.CertFile == "" || cfg.KeyFile == "" {
+		return
+	}
+
+	var missing bool
+	for _, f := range []struct{ key, path string }{
+		{"cert_file", cfg.CertFile},
+		{"key_file", cfg.KeyFile},
+	} {
+		if _, err := os.Stat(f.path); err != nil {
+			missing = true
+			// the generator creates the missing files
+			if cfg.Generate == nil || !os.IsNotExist(err) {
+				errs.add(path+"."+f.key, err)
+			}
+		}
+	}
+	if !missing {
+		if _, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile); err != nil {
+			errs.add(path+".key_file", err)
+		}
+	}
+}
+
+func (cfg *TimeoutsConfig) validate(path string, errs *ConfigErrors) {
+	for _, t := range []struct {
+		key string
+		dur time.Duration
+	}{
+		{"read_timeout", cfg.ReadTimeout},
+		{"read_header_timeout", cfg.ReadHeaderTimeout},
+		{"write_timeout", cfg.WriteTimeout},
+		{"idle_timeout", cfg.IdleTimeout},
+	} {
+		// -1 disables the timeout
+		if t.dur < -1 {
+			errs.addf(path+"."+t.key, "negative duration %s", t.dur)
+		}
+	}
+	if cfg.ReadTimeout > 0 && cfg.ReadHeaderTimeout > cfg.ReadTimeout {
+		errs.addf(path+".read_header_timeout", "%s is greater than read_timeout %s", cfg.ReadHeaderTimeout, cfg.ReadTimeout)
+	}
+	if cfg.MaxHeaderBytes < 0 {
+		errs.addf(path+".max_header_bytes", "negative value %d", cfg.MaxHeaderBytes)
+	}
+}
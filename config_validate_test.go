@@ -0,0 +1,63 @@
+package httpu
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConfigValidateDuplicatedAddr(t *testing.T) {
+	for _, tt := range []struct {
+		a, b Addr
+		dup  bool
+	}{
+		{":8080", "0.0.0.0:8080", true},
+		{":8080", "tcp::8080", true},
+		{"[::]:8080", ":8080", true},
+		{"127.0.0.1:http", "127.0.0.1:80", true},
+		{"LOCALHOST:80", "localhost:80", true},
+		{"127.0.0.1:8080", "127.0.0.2:8080", false},
+		{"127.0.0.1:0", "127.0.0.1:0", false},
+		{"unix:/tmp/a.sock", "unix:/tmp/../tmp/a.sock", true},
+	} {
+		cfg := &Config{Listeners: []ListenerConfig{{Addr: tt.a}, {Addr: tt.b}}}
+		var dup bool
+		if errs, ok := cfg.Validate().(ConfigErrors); ok {
+			for _, e := range errs {
+				if e.Path == "listeners[1].addr" {
+					dup = true
+				}
+			}
+		}
+		if dup != tt.dup {
+			t.Errorf("%q and %q: duplicated = %v, want %v", tt.a, tt.b, dup, tt.dup)
+		}
+	}
+}
+
+func TestConfigValidateInvalidAddr(t *testing.T) {
+	for _, addr := range []Addr{"tcp", "tcp6", "unix", "unix:"} {
+		cfg := &Config{Listeners: []ListenerConfig{{Addr: addr}, {Addr: addr}}}
+		errs, _ := cfg.Validate().(ConfigErrors)
+		if len(errs) != 2 || errs[0].Path != "listeners[0].addr" {
+			t.Errorf("%q: errors = %v", addr, errs)
+		}
+	}
+}
+
+func TestConfigValidateUnixDir(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &Config{Listeners: []ListenerConfig{{Addr: Addr("unix:" + filepath.Join(dir, "http.sock"))}}}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	// the validation has no side effects
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("files created: %v", entries)
+	}
+
+	cfg.Listeners[0].Addr = Addr("unix:" + filepath.Join(dir, "missing", "http.sock"))
+	if err := cfg.Validate(); err == nil {
+		t.Error("missing directory is valid")
+	}
+}
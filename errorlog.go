@@ -0,0 +1,231 @@
+package httpu
+
+import (
+	"fmt"
+	stdlog "log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/moisespsena-go/logging"
+)
+
+const (
+	DefaultErrorLogRateLimit    = 10
+	DefaultErrorLogRateInterval = time.Minute
+
+	tlsHandshakeErrorPrefix = "http: TLS handshake error from "
+	// errorLogMaxKeys is the max number of rate limited messages tracked.
+	errorLogMaxKeys = 1000
+)
+
+// ErrorLogConfig specifies the handling of http.Server error log messages,
+// like handler panics and protocol errors, written to the listeners Log.
+type ErrorLogConfig struct {
+	// RateLimit is the max number of similar messages logged per RateInterval,
+	// the suppressed messages are counted and reported on the next logged one.
+	// If zero, DefaultErrorLogRateLimit is used. If -1, the rate limit is
+	// disabled.
+	RateLimit int `mapstructure:"rate_limit" yaml:"rate_limit"`
+	// RateInterval is the rate limit interval. If zero,
+	// DefaultErrorLogRateInterval is used.
+	RateInterval time.Duration `mapstructure:"rate_interval" yaml:"rate_interval"`
+}
+
+func (cfg ErrorLogConfig) rateLimit() int {
+	if cfg.RateLimit == 0 {
+		return DefaultErrorLogRateLimit
+	}
+	return cfg.RateLimit
+}
+
+func (cfg ErrorLogConfig) rateInterval() time.Duration {
+	if cfg.RateInterval == 0 {
+		return DefaultErrorLogRateInterval
+	}
+	return cfg.RateInterval
+}
+
+// ErrorLogEntry is a message of http.Server error log.
+type ErrorLogEntry struct {
+	Listener *Listener
+	Level    logging.Level
+	Message  string
+	Time     time.Time
+}
+
+// errorLogLevels are the log levels of http.Server error log messages by
+// prefix. The messages not found are logged as ERROR.
+var errorLogLevels = []struct {
+	prefix string
+	level  logging.Level
+}{
+	{"http: panic serving", logging.ERROR},
+	{"http: Accept error", logging.WARNING},
+	{"http: superfluous response.WriteHeader", logging.WARNING},
+	{"http: response.Write on hijacked", logging.WARNING},
+	{"http: response.WriteHeader on hijacked", logging.WARNING},
+	{"http: request method or response status code does not allow body", logging.WARNING},
+	{"http: invalid ", logging.WARNING},
+	{"http2: server: error reading preface", logging.DEBUG},
+	{"http2: received GOAWAY", logging.DEBUG},
+	{"http2: server connection error", logging.DEBUG},
+	{"http2: timeout waiting", logging.DEBUG},
+	{"http2: ", logging.NOTICE},
+}
+
+// ErrorLogLevel returns the log level of http.Server error log message.
+func ErrorLogLevel(msg string) logging.Level {
+	for _, l := range errorLogLevels {
+		if strings.HasPrefix(msg, l.prefix) {
+			return l.level
+		}
+	}
+	return logging.ERROR
+}
+
+// errorLogKey returns the rate limit key of message: the first line, with
+// numbers, like addresses and ports, replaced by "#".
+func errorLogKey(msg string) string {
+	if i := strings.IndexByte(msg, '\n'); i >= 0 {
+		msg = msg[:i]
+	}
+	var (
+		b     strings.Builder
+		digit bool
+	)
+	for _, r := range msg {
+		if r >= '0' && r <= '9' {
+			if !digit {
+				b.WriteByte('#')
+			}
+			digit = true
+			continue
+		}
+		digit = false
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+type errorLogWindow struct {
+	start time.Time
+	count int
+}
+
+// errorLogger rate limits the listeners error log messages and calls the
+// server error log hooks.
+type errorLogger struct {
+	s       *Server
+	mu      sync.Mutex
+	cfg     ErrorLogConfig
+	windows map[string]*errorLogWindow
+}
+
+func (el *errorLogger) setConfig(cfg ErrorLogConfig) {
+	el.mu.Lock()
+	defer el.mu.Unlock()
+	el.cfg = cfg
+}
+
+// allow reports if message with key is logged and the number of similar
+// messages suppressed on previous interval.
+func (el *errorLogger) allow(key string, now time.Time) (ok bool, suppressed int) {
+	el.mu.Lock()
+	defer el.mu.Unlock()
+	limit, interval := el.cfg.rateLimit(), el.cfg.rateInterval()
+	if limit < 0 {
+		return true, 0
+	}
+	if el.windows == nil {
+		el.windows = map[string]*errorLogWindow{}
+	}
+	w := el.windows[key]
+	if w == nil || now.Sub(w.start) >= interval {
+		if w != nil && w.count > limit {
+			suppressed = w.count - limit
+		}
+		if w == nil && len(el.windows) >= errorLogMaxKeys {
+			// evicts the expired windows, or else the oldest one, so the
+			// new key does not exceed the max
+			var oldest *errorLogWindow
+			var oldestKey string
+			for k, w := range el.windows {
+				if now.Sub(w.start) >= interval {
+					delete(el.windows, k)
+				} else if oldest == nil || w.start.Before(oldest.start) {
+					oldest, oldestKey = w, k
+				}
+			}
+			if len(el.windows) >= errorLogMaxKeys {
+				delete(el.windows, oldestKey)
+			}
+		}
+		el.windows[key] = &errorLogWindow{now, 1}
+		return true, suppressed
+	}
+	w.count++
+	return w.count <= limit, 0
+}
+
+func (el *errorLogger) log(l *Listener, level logging.Level, msg string) {
+	e := &ErrorLogEntry{Listener: l, Level: level, Message: msg, Time: time.Now()}
+	for _, f := range el.s.errorLogHooks {
+		f(e)
+	}
+	ok, suppressed := el.allow(errorLogKey(msg), e.Time)
+	if !ok {
+		return
+	}
+	if suppressed > 0 {
+		// the note is added to first line, before the stack of panics
+		line, rest := msg, ""
+		if i := strings.IndexByte(msg, '\n'); i >= 0 {
+			line, rest = msg[:i], msg[i:]
+		}
+		msg = fmt.Sprintf("%s (%d similar messages suppressed)%s", line, suppressed, rest)
+	}
+	logAt(l.Log, level, msg)
+}
+
+func logAt(log logging.Logger, level logging.Level, msg string) {
+	switch level {
+	case logging.CRITICAL:
+		log.Critical(msg)
+	case logging.ERROR:
+		log.Error(msg)
+	case logging.WARNING:
+		log.Warning(msg)
+	case logging.NOTICE:
+		log.Notice(msg)
+	case logging.INFO:
+		log.Info(msg)
+	default:
+		log.Debug(msg)
+	}
+}
+
+// listenerErrorLog writes the http.Server error log messages to the listener
+// Log.
+type listenerErrorLog struct {
+	l *Listener
+}
+
+// newServerErrorLog returns the http.Server.ErrorLog of listener.
+func newServerErrorLog(l *Listener) *stdlog.Logger {
+	return stdlog.New(&listenerErrorLog{l}, "", 0)
+}
+
+func (w *listenerErrorLog) Write(p []byte) (int, error) {
+	msg := strings.TrimSpace(string(p))
+	if strings.HasPrefix(msg, tlsHandshakeErrorPrefix) {
+		// "http: TLS handshake error from ADDR: ERROR"
+		msg := msg[len(tlsHandshakeErrorPrefix):]
+		if i := strings.Index(msg, ": "); i > 0 {
+			w.l.tlsHandshakeFailed(msg[:i], msg[i+2:])
+			return len(p), nil
+		}
+	}
+	w.l.logError(ErrorLogLevel(msg), msg)
+	return len(p), nil
+}
@@ -0,0 +1,26 @@
+package httpu
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestErrorLoggerMaxKeys(t *testing.T) {
+	el := &errorLogger{}
+	now := time.Now()
+	for i := 0; i < errorLogMaxKeys+10; i++ {
+		if ok, _ := el.allow("key"+strconv.Itoa(i), now.Add(time.Duration(i)*time.Millisecond)); !ok {
+			t.Fatalf("key%d not allowed", i)
+		}
+		if len(el.windows) > errorLogMaxKeys {
+			t.Fatalf("windows = %d after key%d", len(el.windows), i)
+		}
+	}
+	if _, ok := el.windows["key0"]; ok {
+		t.Error("the oldest window is not evicted")
+	}
+	if _, ok := el.windows["key"+strconv.Itoa(errorLogMaxKeys+9)]; !ok {
+		t.Error("the newest window is evicted")
+	}
+}
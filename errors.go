@@ -0,0 +1,247 @@
+package httpu
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const CtxErrorRenderer ContextKey = 2
+
+// HttpError is an error response.
+type HttpError struct {
+	// Status is the HTTP status code.
+	Status int
+	// Type is the URI of problem type. If empty, "about:blank" is used.
+	Type string
+	// Title is the short summary. If empty, the status text is used.
+	Title string
+	// Detail is the explanation sent to the client.
+	Detail string
+	// Err is the cause, it is not sent to the client.
+	Err error
+}
+
+func NewHttpError(status int, detail string) *HttpError {
+	return &HttpError{Status: status, Detail: detail}
+}
+
+func (e *HttpError) Error() string {
+	msg := strconv.Itoa(e.Status) + " " + e.GetTitle()
+	if e.Detail != "" {
+		msg += ": " + e.Detail
+	}
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *HttpError) Unwrap() error {
+	return e.Err
+}
+
+// GetTitle returns the Title or the status text.
+func (e *HttpError) GetTitle() string {
+	if e.Title != "" {
+		return e.Title
+	}
+	return http.StatusText(e.Status)
+}
+
+// Problem returns the RFC 7807 problem details of error.
+func (e *HttpError) Problem(instance string) *Problem {
+	typ := e.Type
+	if typ == "" {
+		typ = "about:blank"
+	}
+	return &Problem{Type: typ, Title: e.GetTitle(), Status: e.Status, Detail: e.Detail, Instance: instance}
+}
+
+// Problem is the RFC 7807 problem details object.
+type Problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+}
+
+// ErrorRenderer writes the error responses.
+type ErrorRenderer interface {
+	RenderError(w http.ResponseWriter, r *http.Request, err *HttpError)
+}
+
+type ErrorRendererFunc func(w http.ResponseWriter, r *http.Request, err *HttpError)
+
+func (f ErrorRendererFunc) RenderError(w http.ResponseWriter, r *http.Request, err *HttpError) {
+	f(w, r, err)
+}
+
+// DefaultErrorTemplate is the HTML template of errors. The template data is
+// the *HttpError.
+var DefaultErrorTemplate = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Status}} {{.GetTitle}}</title>
+</head>
+<body>
+<h1>{{.Status}} {{.GetTitle}}</h1>
+{{with .Detail}}<p>{{.}}</p>
+{{end}}</body>
+</html>
+`))
+
+const (
+	mimeTextPlain   = "text/plain"
+	mimeTextHtml    = "text/html"
+	mimeJson        = "application/json"
+	mimeProblemJson = "application/problem+json"
+)
+
+// NegotiatedErrorRenderer renders the errors as plain text, HTML or RFC 7807
+// problem details JSON, chosen by the request Accept header.
+type NegotiatedErrorRenderer struct {
+	// Template is the HTML template. If nil, DefaultErrorTemplate is used.
+	Template *template.Template
+}
+
+// DefaultErrorRenderer is the ErrorRenderer used if none is set.
+var DefaultErrorRenderer ErrorRenderer = &NegotiatedErrorRenderer{}
+
+func (er *NegotiatedErrorRenderer) RenderError(w http.ResponseWriter, r *http.Request, err *HttpError) {
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Del("Content-Encoding")
+	h.Set("X-Content-Type-Options", "nosniff")
+
+	switch NegotiateContentType(w, r, mimeTextPlain, mimeTextHtml, mimeProblemJson, mimeJson) {
+	case mimeTextHtml:
+		tmpl := er.Template
+		if tmpl == nil {
+			tmpl = DefaultErrorTemplate
+		}
+		h.Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(err.Status)
+		tmpl.Execute(w, err)
+	case mimeProblemJson, mimeJson:
+		h.Set("Content-Type", mimeProblemJson)
+		w.WriteHeader(err.Status)
+		json.NewEncoder(w).Encode(err.Problem(r.URL.RequestURI()))
+	default:
+		h.Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(err.Status)
+		msg := err.GetTitle()
+		if err.Detail != "" {
+			msg = err.Detail
+		}
+		io.WriteString(w, msg+"\n")
+	}
+}
+
+type prefixErrorRenderer struct {
+	prefix   string
+	renderer ErrorRenderer
+}
+
+// ErrorRenderers selects the ErrorRenderer by the longest prefix of request
+// path.
+type ErrorRenderers []prefixErrorRenderer
+
+// Get returns the renderer of the longest prefix of pth or nil.
+func (rs ErrorRenderers) Get(pth string) ErrorRenderer {
+	for _, el := range rs {
+		if strings.HasPrefix(pth, el.prefix) {
+			return el.renderer
+		}
+	}
+	return nil
+}
+
+// Set sets the renderer of prefix. If renderer is nil, removes the prefix.
+func (rs *ErrorRenderers) Set(prefix string, renderer ErrorRenderer) {
+	if prefix == "" {
+		prefix = "/"
+	}
+	for i, el := range *rs {
+		if el.prefix == prefix {
+			if renderer == nil {
+				*rs = append((*rs)[:i:i], (*rs)[i+1:]...)
+			} else {
+				(*rs)[i].renderer = renderer
+			}
+			return
+		}
+	}
+	if renderer == nil {
+		return
+	}
+	*rs = append(*rs, prefixErrorRenderer{prefix, renderer})
+	sort.Slice(*rs, func(i, j int) bool {
+		return (*rs)[i].prefix > (*rs)[j].prefix
+	})
+}
+
+// RenderError renders err using the renderer of the request full path, or
+// DefaultErrorRenderer.
+func (rs ErrorRenderers) RenderError(w http.ResponseWriter, r *http.Request, err *HttpError) {
+	renderer := rs.Get(strings.TrimSuffix(PrefixR(r), "/") + r.URL.Path)
+	if renderer == nil {
+		renderer = DefaultErrorRenderer
+	}
+	renderer.RenderError(w, r, err)
+}
+
+func SetErrorRenderer(ctx context.Context, renderer ErrorRenderer) context.Context {
+	return context.WithValue(ctx, CtxErrorRenderer, renderer)
+}
+
+func SetErrorRendererR(r *http.Request, renderer ErrorRenderer) *http.Request {
+	return r.WithContext(SetErrorRenderer(r.Context(), renderer))
+}
+
+// ErrorRendererOf returns the ErrorRenderer of context or
+// DefaultErrorRenderer.
+func ErrorRendererOf(ctx context.Context) ErrorRenderer {
+	if renderer, ok := ctx.Value(CtxErrorRenderer).(ErrorRenderer); ok {
+		return renderer
+	}
+	return DefaultErrorRenderer
+}
+
+// RenderError writes the error response using the request ErrorRenderer. If
+// err is not an *HttpError, responds 413 Request Entity Too Large to the
+// http.MaxBytesError, or 500 Internal Server Error.
+func RenderError(w http.ResponseWriter, r *http.Request, err error) {
+	var (
+		he          *HttpError
+		maxBytesErr *http.MaxBytesError
+	)
+	switch {
+	case errors.As(err, &he):
+	case errors.As(err, &maxBytesErr):
+		he = NewBodyTooLargeError(maxBytesErr.Limit)
+	default:
+		he = &HttpError{Status: http.StatusInternalServerError, Err: err}
+	}
+	ErrorRendererOf(r.Context()).RenderError(w, r, he)
+}
+
+// NotFound responds 404 Not Found using the request ErrorRenderer.
+func NotFound(w http.ResponseWriter, r *http.Request) {
+	RenderError(w, r, NewHttpError(http.StatusNotFound, ""))
+}
+
+// NewBodyTooLargeError returns the 413 Request Entity Too Large error of the
+// request bodies bigger than maxSize bytes.
+func NewBodyTooLargeError(maxSize int64) *HttpError {
+	return NewHttpError(http.StatusRequestEntityTooLarge, fmt.Sprintf("max post size of %d bytes exceeded", maxSize))
+}
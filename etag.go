@@ -0,0 +1,205 @@
+package httpu
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultETagCacheSize is the max entries of ETagCache if its size is zero.
+const DefaultETagCacheSize = 4096
+
+// ContentETag returns the strong etag of content hash, reading it until EOF.
+func ContentETag(content io.Reader) (etag string, err error) {
+	h := sha256.New()
+	if _, err = io.Copy(h, content); err != nil {
+		return
+	}
+	return hashETag(h.Sum(nil)), nil
+}
+
+// hashETag returns the strong etag of sha256 sum.
+func hashETag(sum []byte) string {
+	return `"` + base64.RawURLEncoding.EncodeToString(sum[:18]) + `"`
+}
+
+type etagKey struct {
+	name    string
+	size    int64
+	modTime int64
+}
+
+type etagEntry struct {
+	key  etagKey
+	etag string
+}
+
+// ETagCache is a LRU cache of content etags, keyed by name, size and
+// modification time, so the changed contents are hashed again.
+type ETagCache struct {
+	size  int
+	mu    sync.Mutex
+	ll    *list.List
+	items map[etagKey]*list.Element
+}
+
+// NewETagCache creates the ETagCache with max size entries. If size is zero,
+// DefaultETagCacheSize is used.
+func NewETagCache(size int) *ETagCache {
+	if size <= 0 {
+		size = DefaultETagCacheSize
+	}
+	return &ETagCache{size: size, ll: list.New(), items: map[etagKey]*list.Element{}}
+}
+
+// Len returns the number of cached etags.
+func (c *ETagCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ll.Len()
+}
+
+func (c *ETagCache) get(key etagKey) (etag string, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var el *list.Element
+	if el, ok = c.items[key]; ok {
+		c.ll.MoveToFront(el)
+		etag = el.Value.(*etagEntry).etag
+	}
+	return
+}
+
+func (c *ETagCache) add(key etagKey, etag string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		c.ll.MoveToFront(el)
+		el.Value.(*etagEntry).etag = etag
+		return
+	}
+	c.items[key] = c.ll.PushFront(&etagEntry{key, etag})
+	for c.ll.Len() > c.size {
+		el := c.ll.Back()
+		c.ll.Remove(el)
+		delete(c.items, el.Value.(*etagEntry).key)
+	}
+}
+
+// ETag returns the cached content etag of name with size and modTime, or
+// computes it by ContentETag. The content is seeked back to start after
+// hashing.
+func (c *ETagCache) ETag(name string, size int64, modTime time.Time, content io.ReadSeeker) (etag string, err error) {
+	key := etagKey{name, size, modTime.UnixNano()}
+	if etag, ok := c.get(key); ok {
+		return etag, nil
+	}
+	if etag, err = ContentETag(io.LimitReader(content, size)); err != nil {
+		return
+	}
+	if _, err = content.Seek(0, io.SeekStart); err != nil {
+		return
+	}
+	c.add(key, etag)
+	return
+}
+
+// fingerprintRe matches the file names with a lower case hex content hash,
+// like "app.3f2a9c1b.js" or "app-3f2a9c1b.js".
+var fingerprintRe = regexp.MustCompile(`[.-]([0-9a-f]{8}|[0-9a-f]{12}|[0-9a-f]{16}|[0-9a-f]{20}|[0-9a-f]{32}|[0-9a-f]{40}|[0-9a-f]{64})\.[^./]+$`)
+
+// IsFingerprinted reports if the base name of pth has a content hash
+// fingerprint, like "app.3f2a9c1b.js": a lower case hex digest of 8, 12, 16,
+// 20, 32, 40 or 64 digits, with digits and letters. It is a name heuristic,
+// so names like "app.deadbeef1.js" match too.
+func IsFingerprinted(pth string) bool {
+	m := fingerprintRe.FindStringSubmatch(path.Base(pth))
+	if m == nil {
+		return false
+	}
+	return strings.ContainsAny(m[1], "0123456789") && strings.ContainsAny(m[1], "abcdef")
+}
+
+// CacheControlRule is the Cache-Control of request paths.
+type CacheControlRule struct {
+	// Pattern is the path.Match pattern of request path, or of the base name
+	// if it has no slashes, like "*.css". If ends with "/", matches by path
+	// prefix. If empty, matches all paths.
+	Pattern string `mapstructure:"pattern" yaml:"pattern"`
+	// Fingerprinted restricts the rule to fingerprinted file names, by
+	// IsFingerprinted.
+	Fingerprinted bool `mapstructure:"fingerprinted" yaml:"fingerprinted"`
+	// MaxAge is the max-age directive.
+	MaxAge time.Duration `mapstructure:"max_age" yaml:"max_age"`
+	// Immutable adds the immutable directive.
+	Immutable bool `mapstructure:"immutable" yaml:"immutable"`
+	// NoCache replaces the max-age directive by no-cache.
+	NoCache bool `mapstructure:"no_cache" yaml:"no_cache"`
+	// Private uses the private directive instead of public.
+	Private bool `mapstructure:"private" yaml:"private"`
+}
+
+// Match reports if the rule matches the request path.
+func (rule *CacheControlRule) Match(pth string) bool {
+	if rule.Fingerprinted && !IsFingerprinted(pth) {
+		return false
+	}
+	switch {
+	case rule.Pattern == "":
+		return true
+	case strings.HasSuffix(rule.Pattern, "/"):
+		return strings.HasPrefix(pth, rule.Pattern)
+	case !strings.Contains(rule.Pattern, "/"):
+		pth = path.Base(pth)
+	}
+	ok, _ := path.Match(rule.Pattern, pth)
+	return ok
+}
+
+// Value returns the Cache-Control header value.
+func (rule *CacheControlRule) Value() string {
+	v := "public"
+	if rule.Private {
+		v = "private"
+	}
+	if rule.NoCache {
+		return v + ", no-cache"
+	}
+	v += ", max-age=" + strconv.FormatInt(int64(rule.MaxAge/time.Second), 10)
+	if rule.Immutable {
+		v += ", immutable"
+	}
+	return v
+}
+
+// CacheControlPolicy is the list of Cache-Control rules, in match order.
+type CacheControlPolicy []CacheControlRule
+
+// Get returns the first rule matching the request path or nil.
+func (p CacheControlPolicy) Get(pth string) *CacheControlRule {
+	for i := range p {
+		if p[i].Match(pth) {
+			return &p[i]
+		}
+	}
+	return nil
+}
+
+// Apply sets the Cache-Control header of the rule matching the request path,
+// if not set.
+func (p CacheControlPolicy) Apply(w http.ResponseWriter, pth string) {
+	if w.Header().Get("Cache-Control") != "" {
+		return
+	}
+	if rule := p.Get(pth); rule != nil {
+		w.Header().Set("Cache-Control", rule.Value())
+	}
+}
@@ -0,0 +1,25 @@
+package httpu
+
+import "testing"
+
+func TestIsFingerprinted(t *testing.T) {
+	for pth, want := range map[string]bool{
+		"/static/app.3f2a9c1b.js":      true,
+		"app-3f2a9c1b5e7d.css":         true,
+		"app.3f2a9c1b5e7d4a6b.min.js":  false,
+		"app.3f2a9c1b5e7d.min.js":      false,
+		"app-version2.js":              false,
+		"theme-2024dark.css":           false,
+		"app.12345678.js":              false,
+		"app.deadbeef.js":              false,
+		"app.3F2A9C1B.js":              false,
+		"app.3f2a9c1b5.js":             false,
+		"/3f2a9c1b.js":                 false,
+		"/static.3f2a9c1b/app.js":      false,
+		"vendor.0123456789abcdef01.js": false,
+	} {
+		if got := IsFingerprinted(pth); got != want {
+			t.Errorf("%s: got %v", pth, got)
+		}
+	}
+}
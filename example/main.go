@@ -38,7 +38,8 @@ func main() {
 	go func() {
 		<-time.After(10 * time.Second)
 		println("closing")
-		ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
 		log.Println(srv.Shutdown(ctx))
 		println("closed")
 	}()
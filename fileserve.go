@@ -1,6 +1,7 @@
 package httpu
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -9,6 +10,7 @@ import (
 	"net/http"
 	"net/textproto"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -19,6 +21,31 @@ import (
 // The algorithm uses at most sniffLen bytes to make its decision.
 const sniffLen = 512
 
+// DefaultMaxRanges is the max number of ranges, after coalescing the
+// overlapping and adjacent ones, of requests served by ServeContent. The
+// requests with more ranges are replied with the full content.
+const DefaultMaxRanges = 64
+
+// ContentOptions are the options of ServeContentOptions.
+type ContentOptions struct {
+	// MaxRanges is the max number of ranges, after coalescing the
+	// overlapping and adjacent ones. The requests with more ranges are
+	// replied with the full content. If zero, DefaultMaxRanges is used. If
+	// negative, there is no limit.
+	MaxRanges int
+	// OnError reports the errors after the response header is sent. If nil,
+	// the read errors are logged as ERROR and the write errors, like client
+	// disconnections, as DEBUG.
+	OnError func(r *http.Request, err *ContentError)
+}
+
+func (opts *ContentOptions) maxRanges() int {
+	if opts == nil || opts.MaxRanges == 0 {
+		return DefaultMaxRanges
+	}
+	return opts.MaxRanges
+}
+
 // errNoOverlap is returned by serveContent's parseRange if first-byte-pos of
 // all of the byte-range-spec values is greater than the content size.
 var errNoOverlap = errors.New("invalid range: failed to overlap")
@@ -46,14 +73,43 @@ var errNoOverlap = errors.New("invalid range: failed to overlap")
 //
 // If the caller has set w's ETag header formatted per RFC 7232, section 2.3,
 // ServeContent uses it to handle requests using If-Match, If-None-Match, or If-Range.
+// The strong content hash etags are computed by ContentETag or ETagCache.
 //
 // Note that *os.File implements the io.ReadSeeker interface.
 // if name is empty, filename is unknown. (used for mime type, before sniffing)
 // if modtime.IsZero(), modtime is unknown.
 // content must be seeked to the beginning of the file.
 // The sizeFunc is called at most once. Its error, if any, is sent in the HTTP response.
+// If sizeFunc is nil or returns a negative size, the size is taken from the
+// content Size method or by seeking, if possible, when the response starts.
+//
+// The ranges are served for io.ReadSeeker and io.ReaderAt contents of known
+// size, with the overlapping and adjacent ranges coalesced, up to
+// DefaultMaxRanges. For encoded contents, like gzipped readers or
+// precompressed files, the ranges are of the encoded bytes.
 func ServeContent(w http.ResponseWriter, r *http.Request, name string, modtime time.Time, content io.Reader, sizeFunc func() (int64, error)) {
+	ServeContentOptions(w, r, nil, name, modtime, content, sizeFunc)
+}
+
+// ServeContentOptions is ServeContent with options. If opts is nil, the
+// defaults are used.
+func ServeContentOptions(w http.ResponseWriter, r *http.Request, opts *ContentOptions, name string, modtime time.Time, content io.Reader, sizeFunc func() (int64, error)) {
 	setLastModified(w, modtime)
+
+	// the gzipped content is a gzip encoded representation, with its own etag
+	// and ranges over the encoded bytes
+	if gzipped, ok := content.(httpgzip.GzipedReader); ok {
+		if ok, err := gzipped.Gziped(); err != nil {
+			RenderError(w, r, err)
+			return
+		} else if ok {
+			w.Header().Set("Content-Encoding", "gzip")
+			if etag := w.Header().Get("Etag"); etag != "" {
+				w.Header().Set("Etag", VariantETag(etag, "gzip"))
+			}
+		}
+	}
+
 	done, rangeReq := checkPreconditions(w, r, modtime)
 	if done {
 		return
@@ -78,42 +134,38 @@ func ServeContent(w http.ResponseWriter, r *http.Request, name string, modtime t
 	if sizeFunc != nil {
 		var err error
 		if size, err = sizeFunc(); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			RenderError(w, r, err)
+			return
+		}
+	}
+	if size < 0 {
+		var err error
+		if size, err = contentSize(content); err != nil {
+			RenderError(w, r, err)
 			return
 		}
 	}
 
+	var sendContent = content
 	var noRangeSent = func() {
-		if gzipped, ok := content.(httpgzip.GzipedReader); ok {
-			if ok, err := gzipped.Gziped(); err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			} else if ok {
-				w.Header().Set("Content-Encoding", "gzip")
-			}
-			if r.Method == http.MethodGet {
-				if size > 0 {
-					io.CopyN(w, content, size)
-				} else {
-					io.Copy(w, content)
-				}
+		if size >= 0 {
+			w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+		}
+		send := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(code)
+			if r.Method != "HEAD" {
+				copyContent(w, r, opts, sendContent, size)
 			}
+		})
+		if w.Header().Get("Content-Encoding") != "" {
+			send(w, r)
 		} else {
-			httpgzip.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-				if r.Method != "HEAD" {
-					if size > 0 {
-						io.CopyN(w, content, size)
-					} else {
-						io.Copy(w, content)
-					}
-				}
-			}), nil).ServeHTTP(w, r)
+			NewCompressHandler(send, nil).ServeHTTP(w, r)
 		}
 	}
 
 	// handle Content-Range header.
 	sendSize := size
-	var sendContent = content
 	if sendSize < 0 {
 		noRangeSent()
 		return
@@ -121,20 +173,32 @@ func ServeContent(w http.ResponseWriter, r *http.Request, name string, modtime t
 	if size >= 0 {
 		readSeeker, _ := content.(io.ReadSeeker)
 		if readSeeker == nil {
-			noRangeSent()
-			return
+			if ra, ok := content.(io.ReaderAt); ok {
+				readSeeker = io.NewSectionReader(ra, 0, size)
+			} else {
+				noRangeSent()
+				return
+			}
 		}
+		sendContent = readSeeker
+		var max int
 		ranges, err := parseRange(rangeReq, size)
 		if err != nil {
 			if err == errNoOverlap {
 				w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
 			}
-			http.Error(w, err.Error(), http.StatusRequestedRangeNotSatisfiable)
+			RenderError(w, r, NewHttpError(http.StatusRequestedRangeNotSatisfiable, err.Error()))
 			return
 		} else if ranges == nil {
+			w.Header().Set("Accept-Ranges", "bytes")
 			noRangeSent()
 			return
 		}
+		if ranges, max = coalesceRanges(ranges), opts.maxRanges(); max > 0 && len(ranges) > max {
+			// Too many ranges are costly to serve and usually an
+			// attack, so the full content is sent.
+			ranges = nil
+		}
 		if sumRangesSize(ranges) > size {
 			// The total number of bytes in all the ranges
 			// is larger than the size of the file by
@@ -157,7 +221,7 @@ func ServeContent(w http.ResponseWriter, r *http.Request, name string, modtime t
 			// multipart responses."
 			ra := ranges[0]
 			if _, err := readSeeker.Seek(ra.start, io.SeekStart); err != nil {
-				http.Error(w, err.Error(), http.StatusRequestedRangeNotSatisfiable)
+				RenderError(w, r, NewHttpError(http.StatusRequestedRangeNotSatisfiable, err.Error()))
 				return
 			}
 			sendSize = ra.length
@@ -170,8 +234,16 @@ func ServeContent(w http.ResponseWriter, r *http.Request, name string, modtime t
 			pr, pw := io.Pipe()
 			mw := multipart.NewWriter(pw)
 			w.Header().Set("Content-Type", "multipart/byteranges; boundary="+mw.Boundary())
+			if r.Method == "HEAD" {
+				break
+			}
 			sendContent = pr
 			defer pr.Close() // cause writing goroutine to fail and exit if CopyN doesn't finish.
+			// the client disconnection also stops the writing goroutine
+			stop := context.AfterFunc(r.Context(), func() {
+				pr.CloseWithError(r.Context().Err())
+			})
+			defer stop()
 			go func() {
 				for _, ra := range ranges {
 					part, err := mw.CreatePart(ra.mimeHeader(ctype, size))
@@ -183,7 +255,7 @@ func ServeContent(w http.ResponseWriter, r *http.Request, name string, modtime t
 						pw.CloseWithError(err)
 						return
 					}
-					if _, err := io.CopyN(part, content, ra.length); err != nil {
+					if _, err := io.CopyN(part, readSeeker, ra.length); err != nil {
 						pw.CloseWithError(err)
 						return
 					}
@@ -193,16 +265,91 @@ func ServeContent(w http.ResponseWriter, r *http.Request, name string, modtime t
 			}()
 		}
 
+		// the ranges of encoded content, like precompressed files, are
+		// ranges of the encoded bytes
 		w.Header().Set("Accept-Ranges", "bytes")
-		if w.Header().Get("Content-Encoding") == "" {
-			w.Header().Set("Content-Length", strconv.FormatInt(sendSize, 10))
-		}
+		w.Header().Set("Content-Length", strconv.FormatInt(sendSize, 10))
 	}
 
 	w.WriteHeader(code)
 
 	if r.Method != "HEAD" {
-		io.CopyN(w, sendContent, sendSize)
+		copyContent(w, r, opts, sendContent, sendSize)
+	}
+}
+
+// ContentError is an error of ServeContent after the response header is sent.
+type ContentError struct {
+	// Op is "read" for content read errors, including short reads, or
+	// "write" for response write errors, like client disconnections.
+	Op  string
+	Err error
+	// Written is the number of bytes sent.
+	Written int64
+	// Size is the number of bytes expected, or -1 if unknown.
+	Size int64
+}
+
+func (e *ContentError) Error() string {
+	if e.Size >= 0 {
+		return fmt.Sprintf("%s content: %v (sent %d of %d bytes)", e.Op, e.Err, e.Written, e.Size)
+	}
+	return fmt.Sprintf("%s content: %v (sent %d bytes)", e.Op, e.Err, e.Written)
+}
+
+func (e *ContentError) Unwrap() error {
+	return e.Err
+}
+
+func (opts *ContentOptions) onError(r *http.Request, err *ContentError) {
+	if opts != nil && opts.OnError != nil {
+		opts.OnError(r, err)
+	} else if err.Op == "read" {
+		log.Errorf("serve content of %s %s: %v", r.Method, r.URL.Path, err)
+	} else {
+		log.Debugf("serve content of %s %s: %v", r.Method, r.URL.Path, err)
+	}
+}
+
+// contentReader records the content read error.
+type contentReader struct {
+	r   io.Reader
+	err error
+}
+
+func (cr *contentReader) Read(p []byte) (n int, err error) {
+	n, err = cr.r.Read(p)
+	cr.err = err
+	return
+}
+
+// copyContent copies size bytes of content, or until EOF if size is
+// negative, reporting the errors to opts.OnError. On content read errors, the
+// response is aborted, so the client does not take it as complete.
+func copyContent(w io.Writer, r *http.Request, opts *ContentOptions, content io.Reader, size int64) {
+	var (
+		cr  = &contentReader{r: content}
+		n   int64
+		err error
+	)
+	if size >= 0 {
+		n, err = io.CopyN(w, cr, size)
+	} else {
+		n, err = io.Copy(w, cr)
+	}
+	if err == nil {
+		return
+	}
+	ce := &ContentError{Op: "write", Err: err, Written: n, Size: size}
+	if cr.err != nil && err == cr.err && r.Context().Err() == nil {
+		ce.Op, ce.Err = "read", cr.err
+		if cr.err == io.EOF {
+			ce.Err = io.ErrUnexpectedEOF
+		}
+	}
+	opts.onError(r, ce)
+	if ce.Op == "read" {
+		panic(http.ErrAbortHandler)
 	}
 }
 
@@ -256,7 +403,7 @@ const (
 	condFalse
 )
 
-func checkIfMatch(w http.ResponseWriter, r *http.Request) condResult {
+func checkIfMatch(r *http.Request, etag string, exists bool) condResult {
 	im := r.Header.Get("If-Match")
 	if im == "" {
 		return condNone
@@ -271,13 +418,16 @@ func checkIfMatch(w http.ResponseWriter, r *http.Request) condResult {
 			continue
 		}
 		if im[0] == '*' {
-			return condTrue
+			if exists {
+				return condTrue
+			}
+			return condFalse
 		}
-		etag, remain := scanETag(im)
-		if etag == "" {
+		imEtag, remain := scanETag(im)
+		if imEtag == "" {
 			break
 		}
-		if etagStrongMatch(etag, w.Header().Get("Etag")) {
+		if etagStrongMatch(imEtag, etag) {
 			return condTrue
 		}
 		im = remain
@@ -305,7 +455,7 @@ func checkIfUnmodifiedSince(r *http.Request, modtime time.Time) condResult {
 	return condFalse
 }
 
-func checkIfNoneMatch(w http.ResponseWriter, r *http.Request) condResult {
+func checkIfNoneMatch(r *http.Request, etag string, exists bool) condResult {
 	inm := r.Header.Get("If-None-Match")
 	if inm == "" {
 		return condNone
@@ -318,15 +468,19 @@ func checkIfNoneMatch(w http.ResponseWriter, r *http.Request) condResult {
 		}
 		if buf[0] == ',' {
 			buf = buf[1:]
+			continue
 		}
 		if buf[0] == '*' {
-			return condFalse
+			if exists {
+				return condFalse
+			}
+			return condTrue
 		}
-		etag, remain := scanETag(buf)
-		if etag == "" {
+		inmEtag, remain := scanETag(buf)
+		if inmEtag == "" {
 			break
 		}
-		if etagWeakMatch(etag, w.Header().Get("Etag")) {
+		if etagWeakMatch(inmEtag, etag) {
 			return condFalse
 		}
 		buf = remain
@@ -355,7 +509,7 @@ func checkIfModifiedSince(r *http.Request, modtime time.Time) condResult {
 	return condTrue
 }
 
-func checkIfRange(w http.ResponseWriter, r *http.Request, modtime time.Time) condResult {
+func checkIfRange(r *http.Request, etag string, modtime time.Time) condResult {
 	if r.Method != "GET" && r.Method != "HEAD" {
 		return condNone
 	}
@@ -363,9 +517,9 @@ func checkIfRange(w http.ResponseWriter, r *http.Request, modtime time.Time) con
 	if ir == "" {
 		return condNone
 	}
-	etag, _ := scanETag(ir)
-	if etag != "" {
-		if etagStrongMatch(etag, w.Header().Get("Etag")) {
+	irEtag, _ := scanETag(ir)
+	if irEtag != "" {
+		if etagStrongMatch(irEtag, etag) {
 			return condTrue
 		} else {
 			return condFalse
@@ -417,33 +571,13 @@ func writeNotModified(w http.ResponseWriter) {
 // checkPreconditions evaluates request preconditions and reports whether a precondition
 // resulted in sending StatusNotModified or StatusPreconditionFailed.
 func checkPreconditions(w http.ResponseWriter, r *http.Request, modtime time.Time) (done bool, rangeHeader string) {
-	// This function carefully follows RFC 7232 section 6.
-	ch := checkIfMatch(w, r)
-	if ch == condNone {
-		ch = checkIfUnmodifiedSince(r, modtime)
-	}
-	if ch == condFalse {
-		w.WriteHeader(http.StatusPreconditionFailed)
+	etag := w.Header().Get("Etag")
+	if writePrecondition(w, r, evalPreconditions(r, etag, modtime, true)) {
 		return true, ""
 	}
-	switch checkIfNoneMatch(w, r) {
-	case condFalse:
-		if r.Method == "GET" || r.Method == "HEAD" {
-			writeNotModified(w)
-			return true, ""
-		} else {
-			w.WriteHeader(http.StatusPreconditionFailed)
-			return true, ""
-		}
-	case condNone:
-		if checkIfModifiedSince(r, modtime) == condFalse {
-			writeNotModified(w)
-			return true, ""
-		}
-	}
 
 	rangeHeader = r.Header.Get("Range")
-	if rangeHeader != "" && checkIfRange(w, r, modtime) == condFalse {
+	if rangeHeader != "" && checkIfRange(r, etag, modtime) == condFalse {
 		rangeHeader = ""
 	}
 	return false, rangeHeader
@@ -557,6 +691,55 @@ func rangesMIMESize(ranges []httpRange, contentType string, contentSize int64) (
 	return
 }
 
+// coalesceRanges merges the overlapping and adjacent ranges, sorted by start.
+// Returns ranges unchanged if none are merged.
+func coalesceRanges(ranges []httpRange) []httpRange {
+	if len(ranges) < 2 {
+		return ranges
+	}
+	sorted := append([]httpRange(nil), ranges...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].start < sorted[j].start
+	})
+	merged := sorted[:1]
+	for _, ra := range sorted[1:] {
+		last := &merged[len(merged)-1]
+		if end := last.start + last.length; ra.start <= end {
+			if raEnd := ra.start + ra.length; raEnd > end {
+				last.length = raEnd - last.start
+			}
+			continue
+		}
+		merged = append(merged, ra)
+	}
+	if len(merged) == len(ranges) {
+		return ranges
+	}
+	return merged
+}
+
+// contentSize returns the size of content by its Size method or by seeking,
+// or -1 if unknown. The content is seeked back to its current offset.
+func contentSize(content io.Reader) (size int64, err error) {
+	switch c := content.(type) {
+	case io.Seeker:
+		var cur int64
+		if cur, err = c.Seek(0, io.SeekCurrent); err != nil {
+			return
+		}
+		if size, err = c.Seek(0, io.SeekEnd); err != nil {
+			return
+		}
+		if _, err = c.Seek(cur, io.SeekStart); err != nil {
+			return
+		}
+		return size - cur, nil
+	case interface{ Size() int64 }:
+		return c.Size(), nil
+	}
+	return -1, nil
+}
+
 func sumRangesSize(ranges []httpRange) (size int64) {
 	for _, ra := range ranges {
 		size += ra.length
@@ -0,0 +1,333 @@
+package httpu
+
+import (
+	"context"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testContent = "0123456789abcdefghij"
+
+var testModTime = time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+
+// gzipedReader is a content that reports its gzip encoding.
+type gzipedReader struct {
+	*strings.Reader
+}
+
+func (gzipedReader) Gziped() (bool, error) {
+	return true, nil
+}
+
+// blockingReader blocks the reads until release is closed.
+type blockingReader struct {
+	*strings.Reader
+	release chan struct{}
+}
+
+func (r *blockingReader) Read(p []byte) (int, error) {
+	<-r.release
+	return r.Reader.Read(p)
+}
+
+// captureContentErrors returns the options recording the errors.
+func captureContentErrors() (opts *ContentOptions, errs *[]*ContentError) {
+	errs = new([]*ContentError)
+	opts = &ContentOptions{OnError: func(r *http.Request, err *ContentError) {
+		*errs = append(*errs, err)
+	}}
+	return
+}
+
+type rangePart struct {
+	contentRange, body string
+}
+
+func TestServeContent(t *testing.T) {
+	modTime := testModTime.Format(http.TimeFormat)
+	before := testModTime.Add(-time.Hour).Format(http.TimeFormat)
+	after := testModTime.Add(time.Hour).Format(http.TimeFormat)
+
+	for _, tt := range []struct {
+		name     string
+		method   string
+		header   map[string]string
+		opts     *ContentOptions
+		gziped   bool
+		code     int
+		body     string
+		headers  map[string]string
+		parts    []rangePart
+		noHeader []string
+	}{
+		{name: "full", code: 200, body: testContent,
+			headers: map[string]string{"Accept-Ranges": "bytes", "Content-Length": "20", "Etag": `"v1"`, "Last-Modified": modTime}},
+
+		// If-Match, RFC 7232 section 3.1
+		{name: "if-match", header: map[string]string{"If-Match": `"v1"`}, code: 200, body: testContent},
+		{name: "if-match list", header: map[string]string{"If-Match": `"x", "v1"`}, code: 200, body: testContent},
+		{name: "if-match star", header: map[string]string{"If-Match": "*"}, code: 200, body: testContent},
+		{name: "if-match mismatch", header: map[string]string{"If-Match": `"x"`}, code: 412},
+		{name: "if-match weak", header: map[string]string{"If-Match": `W/"v1"`}, code: 412},
+
+		// If-None-Match, RFC 7232 section 3.2
+		{name: "if-none-match", header: map[string]string{"If-None-Match": `"v1"`}, code: 304,
+			headers: map[string]string{"Etag": `"v1"`}, noHeader: []string{"Content-Length", "Content-Type", "Last-Modified"}},
+		{name: "if-none-match weak", header: map[string]string{"If-None-Match": `W/"v1"`}, code: 304},
+		{name: "if-none-match star", header: map[string]string{"If-None-Match": "*"}, code: 304},
+		{name: "if-none-match mismatch", header: map[string]string{"If-None-Match": `"x"`}, code: 200, body: testContent},
+		{name: "if-none-match head", method: "HEAD", header: map[string]string{"If-None-Match": `"v1"`}, code: 304},
+
+		// If-Modified-Since, RFC 7232 section 3.3
+		{name: "if-modified-since equal", header: map[string]string{"If-Modified-Since": modTime}, code: 304},
+		{name: "if-modified-since after", header: map[string]string{"If-Modified-Since": after}, code: 304},
+		{name: "if-modified-since before", header: map[string]string{"If-Modified-Since": before}, code: 200, body: testContent},
+		{name: "if-modified-since invalid", header: map[string]string{"If-Modified-Since": "yesterday"}, code: 200, body: testContent},
+		{name: "if-none-match precedence", header: map[string]string{"If-None-Match": `"x"`, "If-Modified-Since": modTime},
+			code: 200, body: testContent},
+
+		// If-Unmodified-Since, RFC 7232 section 3.4
+		{name: "if-unmodified-since equal", header: map[string]string{"If-Unmodified-Since": modTime}, code: 200, body: testContent},
+		{name: "if-unmodified-since before", header: map[string]string{"If-Unmodified-Since": before}, code: 412},
+		{name: "if-match precedence", header: map[string]string{"If-Match": `"v1"`, "If-Unmodified-Since": before},
+			code: 200, body: testContent},
+
+		// single range, RFC 7233 section 4.1
+		{name: "range", header: map[string]string{"Range": "bytes=0-4"}, code: 206, body: "01234",
+			headers: map[string]string{"Content-Range": "bytes 0-4/20", "Content-Length": "5"}},
+		{name: "range open", header: map[string]string{"Range": "bytes=15-"}, code: 206, body: "fghij",
+			headers: map[string]string{"Content-Range": "bytes 15-19/20"}},
+		{name: "range suffix", header: map[string]string{"Range": "bytes=-3"}, code: 206, body: "hij",
+			headers: map[string]string{"Content-Range": "bytes 17-19/20"}},
+		{name: "range end beyond size", header: map[string]string{"Range": "bytes=18-100"}, code: 206, body: "ij",
+			headers: map[string]string{"Content-Range": "bytes 18-19/20"}},
+		{name: "range not bytes", header: map[string]string{"Range": "items=0-1"}, code: 416},
+		{name: "range invalid", header: map[string]string{"Range": "bytes=5-1"}, code: 416},
+		{name: "range not satisfiable", header: map[string]string{"Range": "bytes=20-30"}, code: 416,
+			headers: map[string]string{"Content-Range": "bytes */20"}},
+
+		// multiple ranges
+		{name: "multi range", header: map[string]string{"Range": "bytes=0-1,5-6"}, code: 206,
+			parts: []rangePart{{"bytes 0-1/20", "01"}, {"bytes 5-6/20", "56"}}},
+		{name: "multi range unsorted", header: map[string]string{"Range": "bytes=10-11,0-0"}, code: 206,
+			parts: []rangePart{{"bytes 10-11/20", "ab"}, {"bytes 0-0/20", "0"}}},
+		{name: "multi range partially satisfiable", header: map[string]string{"Range": "bytes=0-1,30-40"}, code: 206, body: "01",
+			headers: map[string]string{"Content-Range": "bytes 0-1/20"}},
+		{name: "overlapping ranges coalesced", header: map[string]string{"Range": "bytes=0-4,3-7"}, code: 206, body: "01234567",
+			headers: map[string]string{"Content-Range": "bytes 0-7/20"}},
+		{name: "adjacent ranges coalesced", header: map[string]string{"Range": "bytes=0-1,2-3,8-9"}, code: 206,
+			parts: []rangePart{{"bytes 0-3/20", "0123"}, {"bytes 8-9/20", "89"}}},
+		{name: "max ranges", opts: &ContentOptions{MaxRanges: 1}, header: map[string]string{"Range": "bytes=0-1,5-6"},
+			code: 200, body: testContent},
+		{name: "ranges larger than content", header: map[string]string{"Range": "bytes=0-19,-20"}, code: 206, body: testContent,
+			headers: map[string]string{"Content-Range": "bytes 0-19/20"}},
+
+		// If-Range, RFC 7233 section 3.2
+		{name: "if-range etag", header: map[string]string{"Range": "bytes=0-1", "If-Range": `"v1"`}, code: 206, body: "01"},
+		{name: "if-range etag mismatch", header: map[string]string{"Range": "bytes=0-1", "If-Range": `"x"`}, code: 200, body: testContent},
+		{name: "if-range weak etag", header: map[string]string{"Range": "bytes=0-1", "If-Range": `W/"v1"`}, code: 200, body: testContent},
+		{name: "if-range date", header: map[string]string{"Range": "bytes=0-1", "If-Range": modTime}, code: 206, body: "01"},
+		{name: "if-range old date", header: map[string]string{"Range": "bytes=0-1", "If-Range": before}, code: 200, body: testContent},
+
+		// HEAD
+		{name: "head", method: "HEAD", code: 200, headers: map[string]string{"Content-Length": "20"}},
+		{name: "head range", method: "HEAD", header: map[string]string{"Range": "bytes=2-4"}, code: 206,
+			headers: map[string]string{"Content-Length": "3", "Content-Range": "bytes 2-4/20"}},
+		{name: "head multi range", method: "HEAD", header: map[string]string{"Range": "bytes=0-1,5-6"}, code: 206},
+
+		// gzip encoded content
+		{name: "gzip", gziped: true, code: 200, body: testContent,
+			headers: map[string]string{"Content-Encoding": "gzip", "Etag": `"v1-gzip"`}},
+		{name: "gzip if-none-match identity etag", gziped: true, header: map[string]string{"If-None-Match": `"v1"`},
+			code: 200, body: testContent},
+		{name: "gzip if-none-match", gziped: true, header: map[string]string{"If-None-Match": `"v1-gzip"`}, code: 304},
+		{name: "gzip range", gziped: true, header: map[string]string{"Range": "bytes=0-1"}, code: 206, body: "01",
+			headers: map[string]string{"Content-Encoding": "gzip", "Content-Range": "bytes 0-1/20"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			method := tt.method
+			if method == "" {
+				method = "GET"
+			}
+			r := httptest.NewRequest(method, "/file.txt", nil)
+			for name, value := range tt.header {
+				r.Header.Set(name, value)
+			}
+			var content io.Reader = strings.NewReader(testContent)
+			if tt.gziped {
+				content = gzipedReader{strings.NewReader(testContent)}
+			}
+			w := httptest.NewRecorder()
+			w.Header().Set("Etag", `"v1"`)
+			ServeContentOptions(w, r, tt.opts, "file.txt", testModTime, content, func() (int64, error) {
+				return int64(len(testContent)), nil
+			})
+
+			if w.Code != tt.code {
+				t.Fatalf("code = %d, want %d", w.Code, tt.code)
+			}
+			for name, value := range tt.headers {
+				if got := w.Header().Get(name); got != value {
+					t.Errorf("%s = %q, want %q", name, got, value)
+				}
+			}
+			for _, name := range tt.noHeader {
+				if got := w.Header().Get(name); got != "" {
+					t.Errorf("unexpected %s %q", name, got)
+				}
+			}
+			if method == "HEAD" || tt.code == 304 {
+				if w.Body.Len() != 0 {
+					t.Errorf("unexpected body %q", w.Body.String())
+				}
+				return
+			}
+			if tt.code >= 400 {
+				return
+			}
+			if cl := w.Header().Get("Content-Length"); cl != strconv.Itoa(w.Body.Len()) {
+				t.Errorf("Content-Length = %s, body size %d", cl, w.Body.Len())
+			}
+			if tt.parts == nil {
+				if w.Body.String() != tt.body {
+					t.Errorf("body = %q, want %q", w.Body.String(), tt.body)
+				}
+				return
+			}
+			if parts := readRangeParts(t, w); !equalRangeParts(parts, tt.parts) {
+				t.Errorf("parts = %q, want %q", parts, tt.parts)
+			}
+		})
+	}
+}
+
+func readRangeParts(t *testing.T, w *httptest.ResponseRecorder) (parts []rangePart) {
+	t.Helper()
+	mediaType, params, err := mime.ParseMediaType(w.Header().Get("Content-Type"))
+	if err != nil || mediaType != "multipart/byteranges" {
+		t.Fatalf("Content-Type = %q", w.Header().Get("Content-Type"))
+	}
+	mr := multipart.NewReader(w.Body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ct := part.Header.Get("Content-Type"); ct != "text/plain; charset=utf-8" {
+			t.Errorf("part Content-Type = %q", ct)
+		}
+		parts = append(parts, rangePart{part.Header.Get("Content-Range"), string(body)})
+	}
+}
+
+func equalRangeParts(a, b []rangePart) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestServeContentShortSize(t *testing.T) {
+	opts, errs := captureContentErrors()
+	r := httptest.NewRequest("GET", "/file.txt", nil)
+	w := httptest.NewRecorder()
+
+	func() {
+		defer func() {
+			if err := recover(); err != http.ErrAbortHandler {
+				t.Fatalf("recover = %v, want http.ErrAbortHandler", err)
+			}
+		}()
+		ServeContentOptions(w, r, opts, "file.txt", testModTime, strings.NewReader(testContent), func() (int64, error) {
+			return int64(len(testContent)) + 10, nil
+		})
+	}()
+
+	if w.Header().Get("Content-Length") != "30" {
+		t.Errorf("Content-Length = %q", w.Header().Get("Content-Length"))
+	}
+	if len(*errs) != 1 {
+		t.Fatalf("errors = %v", *errs)
+	}
+	ce := (*errs)[0]
+	if ce.Op != "read" || !errors.Is(ce, io.ErrUnexpectedEOF) || ce.Written != 20 || ce.Size != 30 {
+		t.Errorf("error = %+v", ce)
+	}
+}
+
+func TestServeContentSizeError(t *testing.T) {
+	r := httptest.NewRequest("GET", "/file.txt", nil)
+	w := httptest.NewRecorder()
+	ServeContent(w, r, "file.txt", testModTime, strings.NewReader(testContent), func() (int64, error) {
+		return 0, NewHttpError(http.StatusServiceUnavailable, "unavailable")
+	})
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("code = %d", w.Code)
+	}
+}
+
+func TestServeContentMultiRangeCancel(t *testing.T) {
+	opts, errs := captureContentErrors()
+	goroutines := runtime.NumGoroutine()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := httptest.NewRequest("GET", "/file.txt", nil).WithContext(ctx)
+	r.Header.Set("Range", "bytes=0-1,5-6")
+	w := httptest.NewRecorder()
+	content := &blockingReader{strings.NewReader(testContent), make(chan struct{})}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ServeContentOptions(w, r, opts, "file.txt", testModTime, content, func() (int64, error) {
+			return int64(len(testContent)), nil
+		})
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("ServeContent not returned after the context cancellation")
+	}
+	// unblocks the writing goroutine, that must exit on the closed pipe
+	close(content.release)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > goroutines {
+		if time.Now().After(deadline) {
+			t.Fatalf("goroutines = %d, want %d", runtime.NumGoroutine(), goroutines)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if w.Code != http.StatusPartialContent {
+		t.Errorf("code = %d", w.Code)
+	}
+	// the cancellation is not a content read error, so it is not aborted
+	if len(*errs) != 1 || (*errs)[0].Op != "write" {
+		t.Errorf("errors = %v", *errs)
+	}
+}
@@ -0,0 +1,364 @@
+package httpu
+
+import (
+	"encoding/json"
+	"errors"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultIndexFiles are the directory index files used if
+// FileServer.IndexFiles is empty.
+var DefaultIndexFiles = []string{"index.html"}
+
+// DefaultHiddenExceptions are the dot names not hidden if the
+// HiddenExceptions of FileServer or PrecompressedHandler is nil, like the RFC 8615 well-known URIs used by
+// ACME and security.txt.
+var DefaultHiddenExceptions = []string{".well-known"}
+
+// HiddenPolicy is the policy of hidden files, the dotfiles and files inside
+// dot directories, like ".env" or ".git/config".
+type HiddenPolicy int
+
+const (
+	// HiddenNotFound replies hidden files as not found and omits them from
+	// directory listings.
+	HiddenNotFound HiddenPolicy = iota
+	// HiddenForbidden replies hidden files as forbidden and omits them from
+	// directory listings.
+	HiddenForbidden
+	// HiddenAllow serves hidden files as the others.
+	HiddenAllow
+)
+
+// Reject replies the request of the clean path pth if it is hidden and not
+// allowed by the policy, reporting if replied. The exceptions are the dot
+// names served as not hidden. If nil, DefaultHiddenExceptions is used.
+func (p HiddenPolicy) Reject(w http.ResponseWriter, r *http.Request, pth string, exceptions []string) bool {
+	if p == HiddenAllow || !isHiddenPath(pth, exceptions) {
+		return false
+	}
+	if p == HiddenForbidden {
+		RenderError(w, r, NewHttpError(http.StatusForbidden, ""))
+	} else {
+		NotFound(w, r)
+	}
+	return true
+}
+
+// DirEntry is a directory listing entry.
+type DirEntry struct {
+	Name    string    `json:"name"`
+	URL     string    `json:"url"`
+	Dir     bool      `json:"dir,omitempty"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+// DirListing is the directory listing template data.
+type DirListing struct {
+	// Path is the directory URL path, with prefix.
+	Path string
+	// Parent is the parent directory URL or empty if root.
+	Parent  string
+	Entries []DirEntry
+}
+
+// DefaultDirListingTemplate is the HTML template of directory listings. The
+// template data is the *DirListing.
+var DefaultDirListingTemplate = template.Must(template.New("dir_listing").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Index of {{.Path}}</title>
+</head>
+<body>
+<h1>Index of {{.Path}}</h1>
+<pre>
+{{with .Parent}}<a href="{{.}}">../</a>
+{{end}}{{range .Entries}}<a href="{{.URL}}">{{.Name}}{{if .Dir}}/{{end}}</a>
+{{end}}</pre>
+</body>
+</html>
+`))
+
+// FileServer serves the files of FileSystem using ServeFile, by request path.
+// The links and redirects are relative to the context prefix, so it works
+// under Config.Prefix and PrefixHandlers.
+type FileServer struct {
+	FileSystem http.FileSystem
+	// IndexFiles are the files served as directory index. If empty,
+	// DefaultIndexFiles is used.
+	IndexFiles []string
+	// Listing enables the directory listing, as HTML or JSON by the request
+	// Accept header, of directories without index file.
+	Listing bool
+	// ListingTemplate is the HTML listing template. If nil,
+	// DefaultDirListingTemplate is used.
+	ListingTemplate *template.Template
+	// Hidden is the hidden files policy.
+	Hidden HiddenPolicy
+	// HiddenExceptions are the dot names, like ".well-known", served as not
+	// hidden. If nil, DefaultHiddenExceptions is used.
+	HiddenExceptions []string
+	// SPA enables the single page application mode: the HTML requests of
+	// not found paths without extension are served with the root index file.
+	SPA bool
+	// Precompressed are the precompressed variants of files. If empty,
+	// DefaultPrecompressed is used.
+	Precompressed []Precompressed
+	// ETagCache caches the content hash etags of files. If nil, the etags are
+	// generated by the file modification time and size.
+	ETagCache *ETagCache
+	// CacheControl is the Cache-Control policy of files. If nil, no
+	// Cache-Control is set. The immutable caching is opt-in, by a rule like
+	// {Fingerprinted: true, MaxAge: 365 * 24 * time.Hour, Immutable: true},
+	// or by AssetBundle, which knows its fingerprinted paths.
+	CacheControl CacheControlPolicy
+	// MaxRanges is the max number of ranges of requests. If zero,
+	// DefaultMaxRanges is used. If negative, there is no limit.
+	MaxRanges int
+	// OnContentError reports the errors after the response header is sent.
+	// If nil, they are logged. See ContentOptions.OnError.
+	OnContentError func(r *http.Request, err *ContentError)
+}
+
+// NewFileServer creates the FileServer of fsys with content hash etags.
+func NewFileServer(fsys http.FileSystem) *FileServer {
+	return &FileServer{FileSystem: fsys, ETagCache: NewETagCache(0)}
+}
+
+// NewFileServerFS creates the FileServer of fsys.
+func NewFileServerFS(fsys fs.FS) *FileServer {
+	return NewFileServer(http.FS(fsys))
+}
+
+func (s *FileServer) indexFiles() []string {
+	if len(s.IndexFiles) == 0 {
+		return DefaultIndexFiles
+	}
+	return s.IndexFiles
+}
+
+func (s *FileServer) serveFile(w http.ResponseWriter, r *http.Request, name string) {
+	s.CacheControl.Apply(w, name)
+	serveFile(w, r, s.FileSystem, name, s.Precompressed, s.ETagCache, &ContentOptions{MaxRanges: s.MaxRanges, OnError: s.OnContentError})
+}
+
+func (s *FileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		RenderError(w, r, NewHttpError(http.StatusMethodNotAllowed, ""))
+		return
+	}
+
+	upath := r.URL.Path
+	if !strings.HasPrefix(upath, "/") {
+		upath = "/" + upath
+	}
+	if !validFilePath(upath) {
+		RenderError(w, r, NewHttpError(http.StatusBadRequest, "invalid path"))
+		return
+	}
+	name := path.Clean(upath)
+
+	if s.Hidden.Reject(w, r, name, s.HiddenExceptions) {
+		return
+	}
+
+	f, err := s.FileSystem.Open(name)
+	if err != nil {
+		if s.SPA && s.serveSPA(w, r, name, err) {
+			return
+		}
+		serveFileError(w, r, err)
+		return
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		serveFileError(w, r, err)
+		return
+	}
+
+	if !info.IsDir() {
+		f.Close()
+		if strings.HasSuffix(upath, "/") {
+			localRedirect(w, r, strings.TrimSuffix(upath, "/"))
+			return
+		}
+		for _, index := range s.indexFiles() {
+			if path.Base(name) == index {
+				localRedirect(w, r, path.Dir(name)+"/")
+				return
+			}
+		}
+		s.serveFile(w, r, name)
+		return
+	}
+	defer f.Close()
+
+	if !strings.HasSuffix(upath, "/") {
+		localRedirect(w, r, upath+"/")
+		return
+	}
+	for _, index := range s.indexFiles() {
+		if ok, _ := isFile(s.FileSystem, path.Join(name, index)); ok {
+			s.serveFile(w, r, path.Join(name, index))
+			return
+		}
+	}
+	if !s.Listing {
+		NotFound(w, r)
+		return
+	}
+	s.serveListing(w, r, f, name)
+}
+
+// serveSPA serves the root index file if the request of not found name
+// accepts HTML and name has no extension. Reports if served.
+func (s *FileServer) serveSPA(w http.ResponseWriter, r *http.Request, name string, err error) bool {
+	if !isNotExist(err) || path.Ext(name) != "" || NegotiateContentType(nil, r, mimeTextHtml) == "" {
+		return false
+	}
+	for _, index := range s.indexFiles() {
+		if ok, _ := isFile(s.FileSystem, "/"+index); ok {
+			s.serveFile(w, r, "/"+index)
+			return true
+		}
+	}
+	return false
+}
+
+func (s *FileServer) serveListing(w http.ResponseWriter, r *http.Request, f http.File, name string) {
+	infos, err := f.Readdir(-1)
+	if err != nil {
+		RenderError(w, r, err)
+		return
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name() < infos[j].Name()
+	})
+
+	prefix := PrefixR(r)
+	dirURL := prefix + strings.TrimPrefix(name, "/")
+	if !strings.HasSuffix(dirURL, "/") {
+		dirURL += "/"
+	}
+	listing := &DirListing{Path: dirURL, Entries: make([]DirEntry, 0, len(infos))}
+	if name != "/" {
+		listing.Parent = "../"
+	}
+	for _, info := range infos {
+		if s.Hidden != HiddenAllow && isHidden(info.Name(), s.HiddenExceptions) {
+			continue
+		}
+		entry := DirEntry{
+			Name:    info.Name(),
+			URL:     dirURL + (&url.URL{Path: info.Name()}).EscapedPath(),
+			Dir:     info.IsDir(),
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		}
+		if entry.Dir {
+			entry.URL += "/"
+			entry.Size = 0
+		}
+		listing.Entries = append(listing.Entries, entry)
+	}
+
+	h := w.Header()
+	h.Set("Cache-Control", "no-cache")
+	switch NegotiateContentType(w, r, mimeTextHtml, mimeJson) {
+	case mimeJson:
+		h.Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		if r.Method == http.MethodHead {
+			return
+		}
+		json.NewEncoder(w).Encode(listing.Entries)
+	case mimeTextHtml:
+		tmpl := s.ListingTemplate
+		if tmpl == nil {
+			tmpl = DefaultDirListingTemplate
+		}
+		h.Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		if r.Method == http.MethodHead {
+			return
+		}
+		tmpl.Execute(w, listing)
+	default:
+		RenderError(w, r, NewHttpError(http.StatusNotAcceptable, ""))
+	}
+}
+
+// localRedirect redirects to pth, relative to the context prefix, keeping the
+// query string.
+func localRedirect(w http.ResponseWriter, r *http.Request, pth string) {
+	target := (&url.URL{Path: PrefixR(r) + strings.TrimPrefix(pth, "/")}).EscapedPath()
+	if r.URL.RawQuery != "" {
+		target += "?" + r.URL.RawQuery
+	}
+	w.Header().Set("Location", target)
+	w.WriteHeader(http.StatusMovedPermanently)
+}
+
+// validFilePath reports if the request path is free of parent directory
+// elements, backslashes and NUL bytes.
+func validFilePath(pth string) bool {
+	if strings.ContainsAny(pth, "\\\x00") {
+		return false
+	}
+	for _, el := range strings.Split(pth, "/") {
+		if el == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// isHidden reports if name is a dotfile, except the exceptions or, if nil,
+// the DefaultHiddenExceptions.
+func isHidden(name string, exceptions []string) bool {
+	if !strings.HasPrefix(name, ".") {
+		return false
+	}
+	if exceptions == nil {
+		exceptions = DefaultHiddenExceptions
+	}
+	return !containsString(exceptions, name)
+}
+
+// isHiddenPath reports if any element of clean pth is hidden.
+func isHiddenPath(pth string, exceptions []string) bool {
+	for _, el := range strings.Split(pth, "/") {
+		if isHidden(el, exceptions) {
+			return true
+		}
+	}
+	return false
+}
+
+func isFile(fsys http.FileSystem, name string) (ok bool, err error) {
+	var f http.File
+	if f, err = fsys.Open(name); err != nil {
+		return
+	}
+	defer f.Close()
+	var info fs.FileInfo
+	if info, err = f.Stat(); err != nil {
+		return
+	}
+	return !info.IsDir(), nil
+}
+
+func isNotExist(err error) bool {
+	return errors.Is(err, fs.ErrNotExist)
+}
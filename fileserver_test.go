@@ -0,0 +1,68 @@
+package httpu
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestFileServerHidden(t *testing.T) {
+	fsys := fstest.MapFS{
+		".env":                           {Data: []byte("SECRET=1")},
+		".git/config":                    {Data: []byte("[core]")},
+		".well-known/security.txt":       {Data: []byte("Contact: mailto:security@example.com")},
+		".well-known/acme-challenge/tok": {Data: []byte("tok.key")},
+		".well-known/.secret":            {Data: []byte("x")},
+		"index.html":                     {Data: []byte("<html></html>")},
+	}
+
+	for _, tt := range []struct {
+		exceptions []string
+		path       string
+		code       int
+	}{
+		{nil, "/.env", http.StatusNotFound},
+		{nil, "/.git/config", http.StatusNotFound},
+		{nil, "/.well-known/security.txt", http.StatusOK},
+		{nil, "/.well-known/acme-challenge/tok", http.StatusOK},
+		{nil, "/.well-known/.secret", http.StatusNotFound},
+		{[]string{}, "/.well-known/security.txt", http.StatusNotFound},
+		{[]string{".git"}, "/.git/config", http.StatusOK},
+	} {
+		s := NewFileServerFS(fsys)
+		s.HiddenExceptions = tt.exceptions
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("GET", tt.path, nil))
+		if w.Code != tt.code {
+			t.Errorf("%s with exceptions %v: code = %d, want %d", tt.path, tt.exceptions, w.Code, tt.code)
+		}
+	}
+}
+
+func TestFileServerCacheControl(t *testing.T) {
+	fsys := fstest.MapFS{
+		"app.3f2a9c1b.js": {Data: []byte("a")},
+		"app-version2.js": {Data: []byte("b")},
+	}
+	immutable := CacheControlPolicy{{Fingerprinted: true, MaxAge: 365 * 24 * time.Hour, Immutable: true}}
+	for _, tt := range []struct {
+		policy CacheControlPolicy
+		path   string
+		want   string
+	}{
+		{nil, "/app.3f2a9c1b.js", ""},
+		{nil, "/app-version2.js", ""},
+		{immutable, "/app.3f2a9c1b.js", "public, max-age=31536000, immutable"},
+		{immutable, "/app-version2.js", ""},
+	} {
+		s := NewFileServerFS(fsys)
+		s.CacheControl = tt.policy
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("GET", tt.path, nil))
+		if got := w.Header().Get("Cache-Control"); w.Code != http.StatusOK || got != tt.want {
+			t.Errorf("%s with policy %v: code = %d, Cache-Control = %q, want %q", tt.path, tt.policy, w.Code, got, tt.want)
+		}
+	}
+}
@@ -1,11 +1,13 @@
 module github.com/moisespsena-go/httpu
 
-go 1.15
+go 1.23
 
 require (
-	github.com/felixge/tcpkeepalive v0.0.0-20160804073959-5bb0b2dea91e
+	github.com/BurntSushi/toml v1.2.1
+	github.com/andybalholm/brotli v1.2.0
 	github.com/go-errors/errors v1.1.1
-	github.com/klauspost/compress v1.12.2 // indirect
+	github.com/klauspost/compress v1.18.0
+	github.com/mitchellh/mapstructure v1.5.0
 	github.com/moisespsena-go/default-logger v0.0.1
 	github.com/moisespsena-go/http-post-limit v0.0.1
 	github.com/moisespsena-go/logging v0.0.2
@@ -15,6 +17,16 @@ require (
 	github.com/unapu-go/tlsgen v0.0.1
 	github.com/xi2/httpgzip v0.0.0-20190509075255-932ab5e254ae
 	golang.org/x/net v0.0.0-20210423184538-5f58ad60dda6
+	golang.org/x/sys v0.0.0-20210423082822-04245dca01da
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	github.com/moisespsena-go/signald v0.0.3 // indirect
+	github.com/phayes/permbits v0.0.0-20190612203442-39d7c581d2ee // indirect
+	github.com/unapu-go/safewriter v0.0.1 // indirect
+	github.com/unapu-go/tlsloader v0.0.1 // indirect
+	golang.org/x/text v0.3.6 // indirect
 )
 
 replace github.com/xi2/httpgzip v0.0.0-20190509075255-932ab5e254ae => github.com/unapu-go/httpgzip v0.0.0-20210429175629-47c0df266ac9
@@ -2,6 +2,7 @@ package httpu
 
 import (
 	"context"
+	"encoding/json"
 	"net"
 	"net/http"
 	"net/url"
@@ -40,7 +41,7 @@ func StripPrefix(w http.ResponseWriter, r *http.Request, handler http.Handler, p
 			r2.URL.Path = p
 			handler.ServeHTTP(w, r2)
 		} else {
-			http.NotFound(w, r)
+			NotFound(w, r)
 		}
 		return
 	}
@@ -64,13 +65,23 @@ func IsXhrRequest(r *http.Request) bool {
 	return r.Header.Get(HeaderXRequestedWith) == "XMLHttpRequest"
 }
 
+// redirectBody is the JSON body of redirects to XHR and JSON clients.
+type redirectBody struct {
+	Location string `json:"location,omitempty"`
+	Window   string `json:"window,omitempty"`
+}
+
+// Redirect replies to the request with a redirect to url. The XHR and JSON
+// clients, chosen by the Accept header, receives the url in the X-Location
+// header and JSON body.
 func Redirect(w http.ResponseWriter, r *http.Request, url string, status int, force ...bool) {
 	RedirectHeader("X-Location", w, r, url, status, force...)
 }
 
 func RedirectHeader(headerName string, w http.ResponseWriter, r *http.Request, url string, status int, force ...bool) {
 	var force_ bool
-	for _, force_ = range force{}
+	for _, force_ = range force {
+	}
 
 	if IsActionFormRequest(r) {
 		if status < 400 {
@@ -79,16 +90,22 @@ func RedirectHeader(headerName string, w http.ResponseWriter, r *http.Request, u
 
 		w.Header().Set(headerName, url)
 		w.WriteHeader(status)
-	} else if IsXhrRequest(r) {
+	} else if IsXhrRequest(r) || WantsJSON(r) {
+		var body redirectBody
 		if r.Header.Get("X-Redirection-Disabled") != "true" {
 			w.Header().Set(headerName, url)
+			body.Location = url
 		} else if force_ {
 			w.Header().Set(headerName+"-Window", url)
+			body.Window = url
 		}
 		if status < 400 {
 			status = 201
 		}
+		AddVary(w, "Accept")
+		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(body)
 	} else {
 		http.Redirect(w, r, url, status)
 	}
@@ -1,11 +1,10 @@
 package httpu
 
 import (
-	"crypto/tls"
 	"net"
-	"reflect"
 	"time"
-	"unsafe"
+
+	"github.com/moisespsena-go/logging"
 )
 
 var (
@@ -20,6 +19,11 @@ var (
 	DefaultKeepAliveInterval = 5 * time.Second
 )
 
+// KeepAliveListener sets the TCP keep alive of accepted connections. It must
+// wrap the raw network listener, before the TLS: the server listeners stack is
+// network listener -> KeepAliveListener -> Listener -> TLS. The connections
+// wrapped by TLS are unwrapped using its NetConn method. Non TCP connections,
+// like unix sockets, are accepted unchanged.
 type KeepAliveListener struct {
 	net.Listener
 
@@ -32,6 +36,11 @@ type KeepAliveListener struct {
 	// DefaultKeepAliveInterval specifies how often retry sending keepalive
 	// messages when no response is received.
 	KeepAliveInterval time.Duration
+	// Socket specifies the per connection options (TCP_NODELAY and
+	// TCP_USER_TIMEOUT) set alongside the keep alive.
+	Socket *SocketConfig
+	// Log logs the connections closed because its options could not be set.
+	Log logging.Logger
 }
 
 func NewKeepAliveListener(listener net.Listener) *KeepAliveListener {
@@ -43,25 +52,58 @@ func NewKeepAliveListener(listener net.Listener) *KeepAliveListener {
 	}
 }
 
+// KeepAliveConfig returns the keep alive config of accepted connections.
+func (ln KeepAliveListener) KeepAliveConfig() net.KeepAliveConfig {
+	return net.KeepAliveConfig{
+		Enable:   true,
+		Idle:     ln.KeepAliveIdleInterval,
+		Interval: ln.KeepAliveInterval,
+		Count:    ln.KeepAliveCount,
+	}
+}
+
 func (ln KeepAliveListener) Accept() (net.Conn, error) {
-	c, err := ln.Listener.Accept()
-	if err != nil {
-		return nil, err
+	for {
+		c, err := ln.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		// a failure of one connection, like a peer that already reset its
+		// socket, is not a listener error: the http.Server returns on it
+		if err = ln.setOptions(netConn(c)); err != nil {
+			if ln.Log != nil {
+				ln.Log.Debugf("set options of connection from %s failed: %v", c.RemoteAddr(), err)
+			}
+			c.Close()
+			continue
+		}
+		return c, nil
 	}
+}
 
-	if tlsConn, ok := c.(*tls.Conn); ok {
-		var t time.Time
-		tlsConn.SetDeadline(t)
-		tlsConn.SetWriteDeadline(t)
-		v := reflect.ValueOf(tlsConn).Elem().FieldByName("conn")
-		ptrToY := unsafe.Pointer(v.UnsafeAddr())
-		realPtrToY := (*net.Conn)(ptrToY)
+func (ln KeepAliveListener) setOptions(c net.Conn) (err error) {
+	tc, ok := c.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	if err = tc.SetKeepAliveConfig(ln.KeepAliveConfig()); err != nil {
+		return
+	}
+	if ln.Socket != nil {
+		err = ln.Socket.setConnOptions(tc)
+	}
+	return
+}
 
-		if err = ln.keepAlive(*(realPtrToY)); err != nil {
-			return nil, err
+// netConn returns the underlying network connection of c, like the connection
+// wrapped by *tls.Conn.
+func netConn(c net.Conn) net.Conn {
+	for {
+		w, ok := c.(interface{ NetConn() net.Conn })
+		if !ok {
+			return c
 		}
-	} else if err = ln.keepAlive(c); err != nil {
-		return nil, err
+		c = w.NetConn()
 	}
-	return c, nil
 }
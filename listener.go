@@ -2,10 +2,13 @@ package httpu
 
 import (
 	"context"
+	"crypto/tls"
+	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/unapu-go/tlsgen"
@@ -19,15 +22,21 @@ type Listener struct {
 	net.Listener
 
 	Server      *http.Server
+	Config      ListenerConfig
 	KeepAlive   time.Duration
 	Tls         *TlsConfig
 	running     bool
 	Log         logging.Logger
 	stop        bool
+	closed      bool
+	drained     chan struct{}
 	connections map[net.Conn]interface{}
 	connWg      sync.WaitGroup
 	mu          sync.RWMutex
 	gen         *tlsgen.Generator
+	certs       atomic.Value
+	tlsFailures map[TlsHandshakeFailure]uint64
+	errorLog    *errorLogger
 }
 
 func (l *Listener) Connections() (cons []net.Conn) {
@@ -76,6 +85,13 @@ func (l *Listener) Start(done func()) (stop task.Stoper, err error) {
 		} else {
 			l.Log.Info("done")
 		}
+		// the server returns on shutdown start, waits for the connections
+		l.mu.RLock()
+		drained := l.drained
+		l.mu.RUnlock()
+		if drained != nil {
+			<-drained
+		}
 	}()
 	return l, nil
 }
@@ -92,29 +108,38 @@ func (l *Listener) Shutdown(ctx context.Context) (err error) {
 }
 
 func (l *Listener) shutdown(ctx context.Context) (err error) {
+	drained := make(chan struct{})
 	l.mu.Lock()
 	l.stop = true
+	l.drained = drained
 	l.mu.Unlock()
 
+	defer close(drained)
+	defer l.Close()
+
+	// closes the idle keep-alive connections and waits for the active ones.
+	if err = l.Server.Shutdown(ctx); err != nil {
+		for _, c := range l.Connections() {
+			c.Close()
+		}
+		return
+	}
+
 	finished := make(chan struct{}, 1)
 	go func() {
 		l.connWg.Wait()
 		finished <- struct{}{}
 	}()
 
-	defer l.Close()
-
 	select {
 	case <-ctx.Done():
-		for c := range l.connections {
+		for _, c := range l.Connections() {
 			c.Close()
 		}
 		return ctx.Err()
 	case <-finished:
 		return
 	}
-
-	return
 }
 
 func (l *Listener) ShutdownLog(ctx context.Context) (err error) {
@@ -142,8 +167,11 @@ func (l *Listener) Stop() {
 	if l.gen != nil {
 		l.gen.Stop()
 	}
-	ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
-	go l.ShutdownLog(ctx)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	go func() {
+		defer cancel()
+		l.ShutdownLog(ctx)
+	}()
 }
 
 func (l *Listener) Accept() (con net.Conn, err error) {
@@ -177,23 +205,116 @@ func (l *Listener) IsRunning() bool {
 
 func (l *Listener) ListenAndServe() error {
 	if l.Tls != nil && l.Tls.Valid() {
-		if l.Tls.Generate != nil {
-		}
 		defer l.Listener.Close()
-		return l.Server.ServeTLS(l, l.Tls.CertFile, l.Tls.KeyFile)
+		if l.certs.Load() == nil {
+			loader := &certificateLoader{certFile: l.Tls.CertFile, keyFile: l.Tls.KeyFile}
+			if err := loader.load(); err != nil {
+				return err
+			}
+			l.certs.Store(loader)
+		}
+		config := &tls.Config{}
+		if l.Server.TLSConfig != nil {
+			config = l.Server.TLSConfig.Clone()
+		}
+		if !containsString(config.NextProtos, "http/1.1") {
+			config.NextProtos = append(config.NextProtos, "http/1.1")
+		}
+		config.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return l.certs.Load().(*certificateLoader).GetCertificate(hello)
+		}
+		return l.Server.Serve(newTlsListener(l, config, l.Tls.HandshakeTimeout, l.Tls.MaxHandshakes))
 	}
 	return l.Server.Serve(l)
 }
 
+// SetTlsFiles loads the certificate pair from files and uses it on the next
+// TLS handshakes.
+func (l *Listener) SetTlsFiles(certFile, keyFile string) (err error) {
+	loader := &certificateLoader{certFile: certFile, keyFile: keyFile}
+	if err = loader.load(); err != nil {
+		return
+	}
+	l.setCertificateLoader(loader)
+	return
+}
+
+func (l *Listener) setCertificateLoader(loader *certificateLoader) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.Tls != nil {
+		l.Tls.CertFile, l.Tls.KeyFile = loader.certFile, loader.keyFile
+	}
+	if l.Config.Tls != nil {
+		tlsCfg := *l.Config.Tls
+		tlsCfg.CertFile, tlsCfg.KeyFile = loader.certFile, loader.keyFile
+		l.Config.Tls = &tlsCfg
+	}
+	l.certs.Store(loader)
+}
+
+// SetTimeouts updates the server timeouts. The new values are used by the
+// next requests.
+func (l *Listener) SetTimeouts(timeouts TimeoutsConfig) {
+	timeouts.init()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.Config.Timeouts = timeouts
+	l.Server.IdleTimeout = timeouts.IdleTimeout
+	l.Server.ReadTimeout = timeouts.ReadTimeout
+	l.Server.ReadHeaderTimeout = timeouts.ReadHeaderTimeout
+	l.Server.WriteTimeout = timeouts.WriteTimeout
+	l.Server.MaxHeaderBytes = timeouts.MaxHeaderBytes
+}
+
+// TlsHandshakeFailures returns the number of failed TLS handshakes by reason.
+func (l *Listener) TlsHandshakeFailures() map[TlsHandshakeFailure]uint64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	failures := make(map[TlsHandshakeFailure]uint64, len(l.tlsFailures))
+	for reason, count := range l.tlsFailures {
+		failures[reason] = count
+	}
+	return failures
+}
+
+func (l *Listener) tlsHandshakeFailed(remoteAddr, msg string) {
+	reason := ClassifyTlsHandshakeError(msg)
+	l.mu.Lock()
+	if l.tlsFailures == nil {
+		l.tlsFailures = map[TlsHandshakeFailure]uint64{}
+	}
+	l.tlsFailures[reason]++
+	l.mu.Unlock()
+
+	level := logging.DEBUG
+	switch reason {
+	case TlsHandshakeUnknownCA, TlsHandshakeProtocolMismatch, TlsHandshakeFailed:
+		level = logging.WARNING
+	}
+	l.logError(level, fmt.Sprintf("TLS handshake %s from %s: %s", reason, remoteAddr, msg))
+}
+
+// logError logs the server error message using the rate limit and hooks of
+// server error logger.
+func (l *Listener) logError(level logging.Level, msg string) {
+	if l.errorLog == nil {
+		logAt(l.Log, level, msg)
+		return
+	}
+	l.errorLog.log(l, level, msg)
+}
+
 func (l *Listener) Close() (err error) {
 	l.mu.Lock()
 	defer func() {
 		l.running = false
 		l.mu.Unlock()
 	}()
-	if !l.running {
+	if l.closed {
 		return
 	}
+	l.closed = true
 	return l.Listener.Close()
 }
 
@@ -206,3 +327,17 @@ func (con connection) Close() error {
 	defer con.closer()
 	return con.Conn.Close()
 }
+
+// NetConn returns the underlying network connection.
+func (con connection) NetConn() net.Conn {
+	return con.Conn
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,169 @@
+package httpu
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// startTestListener creates and starts the listener of cfg. The accepted
+// connections, as seen by the http.Server, are sent to conns.
+func startTestListener(t *testing.T, cfg ListenerConfig) (lis *Listener, conns chan net.Conn) {
+	t.Helper()
+	s := NewServer(&Config{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	var err error
+	if lis, err = s.createListener(cfg); err != nil {
+		t.Fatal(err)
+	}
+	conns = make(chan net.Conn, 1)
+	lis.Server.ConnContext = func(ctx context.Context, c net.Conn) context.Context {
+		conns <- c
+		return ctx
+	}
+	if _, err = lis.Start(func() {}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		lis.Shutdown(ctx)
+	})
+	return
+}
+
+func getsockopt(t *testing.T, c net.Conn, level, opt int) (value int) {
+	t.Helper()
+	rc, err := c.(syscall.Conn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var optErr error
+	if err = rc.Control(func(fd uintptr) {
+		value, optErr = unix.GetsockoptInt(int(fd), level, opt)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if optErr != nil {
+		t.Fatal(optErr)
+	}
+	return
+}
+
+func TestListenerConnOptions(t *testing.T) {
+	certFile, keyFile := writeTestCert(t, t.TempDir())
+	noDelay := false
+
+	for _, tt := range []struct {
+		name string
+		tls  bool
+	}{
+		{"plain", false},
+		{"tls", true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := ListenerConfig{
+				Addr:                  "127.0.0.1:0",
+				KeepAliveCount:        3,
+				KeepAliveIdleInterval: &KeepAliveConfig{Value: "42"},
+				KeepAliveInterval:     &KeepAliveConfig{Value: "7s"},
+				Socket: SocketConfig{
+					NoDelay:     &noDelay,
+					UserTimeout: 9 * time.Second,
+				},
+			}
+			if tt.tls {
+				cfg.Tls = &TlsConfig{CertFile: certFile, KeyFile: keyFile}
+			}
+			lis, conns := startTestListener(t, cfg)
+
+			client := &http.Client{Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			}}
+			defer client.CloseIdleConnections()
+			scheme := "http"
+			if tt.tls {
+				scheme = "https"
+			}
+			res, err := client.Get(scheme + "://" + lis.Addr().String() + "/")
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			if res.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d", res.StatusCode)
+			}
+
+			c := <-conns
+			if _, isTls := c.(*tls.Conn); isTls != tt.tls {
+				t.Fatalf("server conn is %T", c)
+			}
+			tc, ok := netConn(c).(*net.TCPConn)
+			if !ok {
+				t.Fatalf("raw conn of %T is %T, want *net.TCPConn", c, netConn(c))
+			}
+
+			for _, opt := range []struct {
+				name       string
+				level, opt int
+				want       int
+			}{
+				{"SO_KEEPALIVE", unix.SOL_SOCKET, unix.SO_KEEPALIVE, 1},
+				{"TCP_KEEPIDLE", unix.IPPROTO_TCP, unix.TCP_KEEPIDLE, 42},
+				{"TCP_KEEPINTVL", unix.IPPROTO_TCP, unix.TCP_KEEPINTVL, 7},
+				{"TCP_KEEPCNT", unix.IPPROTO_TCP, unix.TCP_KEEPCNT, 3},
+				{"TCP_NODELAY", unix.IPPROTO_TCP, unix.TCP_NODELAY, 0},
+				{"TCP_USER_TIMEOUT", unix.IPPROTO_TCP, unix.TCP_USER_TIMEOUT, 9000},
+			} {
+				if got := getsockopt(t, tc, opt.level, opt.opt); got != opt.want {
+					t.Errorf("%s = %d, want %d", opt.name, got, opt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestListenerUnixKeepAliveNoop(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "http.sock")
+	lis, conns := startTestListener(t, ListenerConfig{
+		Addr:           Addr("unix:" + sock),
+		KeepAliveCount: 3,
+	})
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", sock)
+		},
+	}}
+	defer client.CloseIdleConnections()
+	res, err := client.Get("http://unix/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d", res.StatusCode)
+	}
+	c := netConn(<-conns)
+	if _, ok := c.(*net.UnixConn); !ok {
+		t.Fatalf("raw conn is %T, want *net.UnixConn", c)
+	}
+	kl := NewKeepAliveListener(nil)
+	kl.Socket = &SocketConfig{UserTimeout: time.Second}
+	if err = kl.setOptions(c); err != nil {
+		t.Fatalf("setOptions of unix conn: %v", err)
+	}
+	if lis.Addr().Network() != "unix" {
+		t.Fatalf("listener network = %s", lis.Addr().Network())
+	}
+}
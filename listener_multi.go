@@ -0,0 +1,95 @@
+package httpu
+
+import (
+	"net"
+	"strings"
+	"sync"
+)
+
+// MultiListener accepts the connections of many listeners, like the listeners
+// of each resolved IP of a hostname.
+type MultiListener struct {
+	Listeners []net.Listener
+	accepts   chan acceptResult
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+func NewMultiListener(listeners ...net.Listener) *MultiListener {
+	l := &MultiListener{
+		Listeners: listeners,
+		accepts:   make(chan acceptResult),
+		done:      make(chan struct{}),
+	}
+	for _, lis := range listeners {
+		go l.accept(lis)
+	}
+	return l
+}
+
+func (l *MultiListener) accept(lis net.Listener) {
+	for {
+		con, err := lis.Accept()
+		select {
+		case l.accepts <- acceptResult{con, err}:
+		case <-l.done:
+			if con != nil {
+				con.Close()
+			}
+			return
+		}
+		if err != nil {
+			if ne, ok := err.(net.Error); !ok || !ne.Temporary() {
+				return
+			}
+		}
+	}
+}
+
+func (l *MultiListener) Accept() (net.Conn, error) {
+	select {
+	case r := <-l.accepts:
+		return r.conn, r.err
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *MultiListener) Close() (err error) {
+	l.closeOnce.Do(func() {
+		close(l.done)
+		for _, lis := range l.Listeners {
+			if err2 := lis.Close(); err == nil {
+				err = err2
+			}
+		}
+	})
+	return
+}
+
+func (l *MultiListener) Addr() net.Addr {
+	addrs := make(multiAddr, len(l.Listeners))
+	for i, lis := range l.Listeners {
+		addrs[i] = lis.Addr()
+	}
+	return addrs
+}
+
+type multiAddr []net.Addr
+
+func (a multiAddr) Network() string {
+	return a[0].Network()
+}
+
+func (a multiAddr) String() string {
+	s := make([]string, len(a))
+	for i, addr := range a {
+		s[i] = addr.String()
+	}
+	return strings.Join(s, ", ")
+}
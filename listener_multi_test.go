@@ -0,0 +1,25 @@
+package httpu
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestMultiListenerClosed(t *testing.T) {
+	var listeners []net.Listener
+	for i := 0; i < 2; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		listeners = append(listeners, l)
+	}
+	ml := NewMultiListener(listeners...)
+	if err := ml.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ml.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("Accept after Close: %v, want net.ErrClosed", err)
+	}
+}
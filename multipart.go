@@ -0,0 +1,263 @@
+package httpu
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+)
+
+const (
+	// DefaultMultipartMaxFieldSize is the max bytes of a field if
+	// MultipartLimits.MaxFieldSize is zero.
+	DefaultMultipartMaxFieldSize = 1 << 20
+	// DefaultMultipartMaxFieldsSize is the max bytes of all fields if
+	// MultipartLimits.MaxFieldsSize is zero.
+	DefaultMultipartMaxFieldsSize = 10 << 20
+	// DefaultMultipartMaxParts is the max number of parts if
+	// MultipartLimits.MaxParts is zero.
+	DefaultMultipartMaxParts = 1000
+)
+
+// MultipartLimits specifies the MultipartReader limits. The exceeded limits
+// fail with the 413 Request Entity Too Large *HttpError.
+type MultipartLimits struct {
+	// MaxFileSize is the max bytes of a file part. If zero, it is limited
+	// only by the request body limit.
+	MaxFileSize int64
+	// MaxFieldSize is the max bytes of a field, a part without file name. If
+	// zero, DefaultMultipartMaxFieldSize is used.
+	MaxFieldSize int64
+	// MaxFieldsSize is the max bytes of all fields, kept in memory by
+	// ReadForm. If zero, DefaultMultipartMaxFieldsSize is used.
+	MaxFieldsSize int64
+	// MaxParts is the max number of parts. If zero, DefaultMultipartMaxParts
+	// is used.
+	MaxParts int
+	// TempDir is the directory of the files spooled by ReadForm. If empty,
+	// os.TempDir is used.
+	TempDir string
+}
+
+// MultipartReader reads the multipart/form-data request body part by part,
+// without buffering, enforcing the MultipartLimits.
+type MultipartReader struct {
+	Limits     MultipartLimits
+	r          *multipart.Reader
+	parts      int
+	fieldsSize int64
+}
+
+// NewMultipartReader creates the MultipartReader of request. If limits is
+// nil, the defaults are used. If the request is not multipart/form-data,
+// fails with 415 Unsupported Media Type *HttpError.
+func NewMultipartReader(r *http.Request, limits *MultipartLimits) (mr *MultipartReader, err error) {
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/form-data" || params["boundary"] == "" {
+		return nil, NewHttpError(http.StatusUnsupportedMediaType, "the content type must be multipart/form-data")
+	}
+	mr = &MultipartReader{r: multipart.NewReader(r.Body, params["boundary"])}
+	if limits != nil {
+		mr.Limits = *limits
+	}
+	return
+}
+
+// MultipartPart is a part of MultipartReader. Its reads fail after the part
+// limit.
+type MultipartPart struct {
+	*multipart.Part
+	r io.Reader
+}
+
+func (p *MultipartPart) Read(b []byte) (int, error) {
+	return p.r.Read(b)
+}
+
+// IsFile reports if the part has a file name.
+func (p *MultipartPart) IsFile() bool {
+	return p.FileName() != ""
+}
+
+// NextPart returns the next part or io.EOF if there are no more parts. The
+// previous part is discarded.
+func (mr *MultipartReader) NextPart() (part *MultipartPart, err error) {
+	p, err := mr.r.NextPart()
+	if err != nil {
+		return nil, multipartError(err)
+	}
+	maxParts := mr.Limits.MaxParts
+	if maxParts == 0 {
+		maxParts = DefaultMultipartMaxParts
+	}
+	if mr.parts++; mr.parts > maxParts {
+		return nil, NewHttpError(http.StatusRequestEntityTooLarge, fmt.Sprintf("max multipart parts of %d exceeded", maxParts))
+	}
+	part = &MultipartPart{Part: p}
+	if p.FileName() != "" {
+		part.r = p
+		if mr.Limits.MaxFileSize > 0 {
+			part.r = &multipartLimitReader{p: p, n: mr.Limits.MaxFileSize, limit: mr.Limits.MaxFileSize}
+		}
+	} else {
+		maxSize := mr.Limits.MaxFieldSize
+		if maxSize == 0 {
+			maxSize = DefaultMultipartMaxFieldSize
+		}
+		part.r = &multipartLimitReader{p: p, n: maxSize, limit: maxSize}
+	}
+	return
+}
+
+// multipartError returns the reader error, with the request body limit
+// errors kept for RenderError.
+func multipartError(err error) error {
+	var maxBytesErr *http.MaxBytesError
+	if err == io.EOF || errors.As(err, &maxBytesErr) {
+		return err
+	}
+	return &HttpError{Status: http.StatusBadRequest, Detail: "invalid multipart body", Err: err}
+}
+
+// multipartLimitReader reads up to limit bytes of part, failing if it has
+// more.
+type multipartLimitReader struct {
+	p        *multipart.Part
+	n, limit int64
+}
+
+func (l *multipartLimitReader) Read(b []byte) (n int, err error) {
+	if l.n < 0 {
+		return 0, l.exceeded()
+	}
+	if int64(len(b)) > l.n+1 {
+		b = b[:l.n+1]
+	}
+	n, err = l.p.Read(b)
+	if l.n -= int64(n); l.n < 0 {
+		return n - 1, l.exceeded()
+	}
+	if err != nil && err != io.EOF {
+		err = multipartError(err)
+	}
+	return
+}
+
+func (l *multipartLimitReader) exceeded() error {
+	return NewHttpError(http.StatusRequestEntityTooLarge, fmt.Sprintf("max size of %d bytes of part %q exceeded", l.limit, l.p.FormName()))
+}
+
+// MultipartFile is a file part spooled by ReadForm.
+type MultipartFile struct {
+	// Field is the form field name.
+	Field    string
+	Filename string
+	Header   textproto.MIMEHeader
+	Size     int64
+	// Path is the temporary file path, removed by MultipartForm.RemoveAll.
+	Path string
+}
+
+// Open opens the spooled file for reading.
+func (f *MultipartFile) Open() (*os.File, error) {
+	return os.Open(f.Path)
+}
+
+// MultipartForm is the form read by ReadForm.
+type MultipartForm struct {
+	Values url.Values
+	Files  map[string][]*MultipartFile
+}
+
+// RemoveAll removes the spooled files.
+func (f *MultipartForm) RemoveAll() (err error) {
+	for _, files := range f.Files {
+		for _, file := range files {
+			if rerr := os.Remove(file.Path); rerr != nil && !errors.Is(rerr, os.ErrNotExist) && err == nil {
+				err = rerr
+			}
+		}
+	}
+	return
+}
+
+// ReadForm reads all parts, keeping the fields in memory and spooling the
+// files to the Limits.TempDir. On error, the spooled files are removed.
+func (mr *MultipartReader) ReadForm() (form *MultipartForm, err error) {
+	form = &MultipartForm{Values: url.Values{}, Files: map[string][]*MultipartFile{}}
+	defer func() {
+		if err != nil {
+			form.RemoveAll()
+			form = nil
+		}
+	}()
+	maxFieldsSize := mr.Limits.MaxFieldsSize
+	if maxFieldsSize == 0 {
+		maxFieldsSize = DefaultMultipartMaxFieldsSize
+	}
+	for {
+		var part *MultipartPart
+		if part, err = mr.NextPart(); err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return
+		}
+		name := part.FormName()
+		if !part.IsFile() {
+			var buf bytes.Buffer
+			if _, err = buf.ReadFrom(part); err != nil {
+				return
+			}
+			if mr.fieldsSize += int64(buf.Len()); mr.fieldsSize > maxFieldsSize {
+				err = NewHttpError(http.StatusRequestEntityTooLarge, fmt.Sprintf("max fields size of %d bytes exceeded", maxFieldsSize))
+				return
+			}
+			form.Values.Add(name, buf.String())
+			continue
+		}
+		var file *MultipartFile
+		if file, err = mr.spool(part); err != nil {
+			return
+		}
+		form.Files[name] = append(form.Files[name], file)
+	}
+}
+
+func (mr *MultipartReader) spool(part *MultipartPart) (file *MultipartFile, err error) {
+	f, err := os.CreateTemp(mr.Limits.TempDir, "multipart-")
+	if err != nil {
+		return
+	}
+	file = &MultipartFile{
+		Field:    part.FormName(),
+		Filename: part.FileName(),
+		Header:   part.Header,
+		Path:     f.Name(),
+	}
+	file.Size, err = io.Copy(f, part)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return
+}
+
+// ReadMultipartForm reads the multipart/form-data request body by
+// MultipartReader.ReadForm.
+func ReadMultipartForm(r *http.Request, limits *MultipartLimits) (form *MultipartForm, err error) {
+	mr, err := NewMultipartReader(r, limits)
+	if err != nil {
+		return
+	}
+	return mr.ReadForm()
+}
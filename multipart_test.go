@@ -0,0 +1,100 @@
+package httpu
+
+import (
+	"bytes"
+	"errors"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestNewMultipartReaderContentType(t *testing.T) {
+	for contentType, ok := range map[string]bool{
+		"multipart/form-data; boundary=x": true,
+		"multipart/mixed; boundary=x":     false,
+		"multipart/form-data":             false,
+		"application/json":                false,
+	} {
+		r := httptest.NewRequest("POST", "/", strings.NewReader(""))
+		r.Header.Set("Content-Type", contentType)
+		_, err := NewMultipartReader(r, nil)
+		if (err == nil) != ok {
+			t.Errorf("%s: err = %v", contentType, err)
+		}
+	}
+}
+
+// multipartTestRequest creates the multipart/form-data request of parts,
+// pairs of name and value. The names prefixed by "@" are files.
+func multipartTestRequest(parts ...string) *http.Request {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for i := 0; i < len(parts); i += 2 {
+		if name, ok := strings.CutPrefix(parts[i], "@"); ok {
+			w, _ := mw.CreateFormFile(name, name+".txt")
+			w.Write([]byte(parts[i+1]))
+		} else {
+			mw.WriteField(parts[i], parts[i+1])
+		}
+	}
+	mw.Close()
+	r := httptest.NewRequest("POST", "/", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	return r
+}
+
+func TestMultipartReaderReadForm(t *testing.T) {
+	ten := strings.Repeat("x", 10)
+	for _, tt := range []struct {
+		name   string
+		limits MultipartLimits
+		parts  []string
+		ok     bool
+	}{
+		{"ok", MultipartLimits{MaxParts: 3, MaxFieldSize: 10, MaxFieldsSize: 20, MaxFileSize: 10},
+			[]string{"a", ten, "b", ten, "@f", ten}, true},
+		{"parts", MultipartLimits{MaxParts: 2},
+			[]string{"@f", ten, "a", "1", "b", "2"}, false},
+		{"field size", MultipartLimits{MaxFieldSize: 9},
+			[]string{"@f", ten, "a", ten}, false},
+		{"fields size", MultipartLimits{MaxFieldsSize: 15},
+			[]string{"@f", ten, "a", ten, "b", ten}, false},
+		{"file size", MultipartLimits{MaxFileSize: 9},
+			[]string{"@f", "123456789", "@g", ten}, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.limits.TempDir = t.TempDir()
+			form, err := ReadMultipartForm(multipartTestRequest(tt.parts...), &tt.limits)
+			entries, _ := os.ReadDir(tt.limits.TempDir)
+			if !tt.ok {
+				var herr *HttpError
+				if !errors.As(err, &herr) || herr.Status != http.StatusRequestEntityTooLarge {
+					t.Fatalf("err = %v", err)
+				}
+				if form != nil {
+					t.Errorf("form = %+v", form)
+				}
+				if len(entries) != 0 {
+					t.Errorf("%d spooled files not removed", len(entries))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer form.RemoveAll()
+			if form.Values.Get("a") != ten || form.Values.Get("b") != ten {
+				t.Errorf("values = %v", form.Values)
+			}
+			if files := form.Files["f"]; len(files) != 1 || files[0].Size != 10 || files[0].Filename != "f.txt" {
+				t.Errorf("files = %+v", form.Files)
+			}
+			if len(entries) != 1 {
+				t.Errorf("spooled files = %d", len(entries))
+			}
+		})
+	}
+}
@@ -0,0 +1,213 @@
+package httpu
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// AcceptSpec is a value of Accept, Accept-Language, Accept-Charset or
+// Accept-Encoding header with its quality.
+type AcceptSpec struct {
+	// Value is the lower case media range, language range, charset or
+	// content coding, like "text/*" or "en-us".
+	Value string
+	// Q is the quality, from 0 to 1.
+	Q float64
+}
+
+// ParseAccept parses the Accept-* header values, sorted by quality in
+// descending order, keeping the header order on ties. The values with invalid
+// quality are ignored.
+func ParseAccept(header string) (specs []AcceptSpec) {
+	for _, part := range strings.Split(header, ",") {
+		params := strings.Split(part, ";")
+		spec := AcceptSpec{Value: strings.ToLower(strings.TrimSpace(params[0])), Q: 1}
+		if spec.Value == "" {
+			continue
+		}
+		valid := true
+		for _, p := range params[1:] {
+			p = strings.TrimSpace(p)
+			if len(p) < 2 || (p[0] != 'q' && p[0] != 'Q') || p[1] != '=' {
+				continue
+			}
+			q, err := strconv.ParseFloat(p[2:], 64)
+			if err != nil || q < 0 || q > 1 {
+				valid = false
+				break
+			}
+			spec.Q = q
+		}
+		if valid {
+			specs = append(specs, spec)
+		}
+	}
+	sort.SliceStable(specs, func(i, j int) bool {
+		return specs[i].Q > specs[j].Q
+	})
+	return
+}
+
+// AddVary adds the header names to the Vary response header, if not present.
+func AddVary(w http.ResponseWriter, names ...string) {
+	h := w.Header()
+	current := strings.ToLower(strings.Join(h.Values("Vary"), ","))
+	for _, name := range names {
+		found := false
+		for _, v := range strings.Split(current, ",") {
+			if v = strings.TrimSpace(v); v == "*" || v == strings.ToLower(name) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			h.Add("Vary", name)
+			current += "," + strings.ToLower(name)
+		}
+	}
+}
+
+// negotiateSpecs returns the offer with highest quality. The match function
+// returns the specificity of spec matching offer, or -1 if it does not match:
+// the quality of offer is the quality of most specific matching spec. The
+// defaultQ is the quality of offers without matching spec.
+func negotiateSpecs(specs []AcceptSpec, offers []string, match func(spec, offer string) int, defaultQ func(offer string) float64) (best string) {
+	var bestQ float64
+	for _, offer := range offers {
+		lower := strings.ToLower(offer)
+		q, specificity := -1.0, -1
+		for _, spec := range specs {
+			if s := match(spec.Value, lower); s > specificity {
+				q, specificity = spec.Q, s
+			}
+		}
+		if specificity < 0 && defaultQ != nil {
+			q = defaultQ(lower)
+		}
+		if q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	return
+}
+
+func negotiate(w http.ResponseWriter, r *http.Request, header string, offers []string, match func(spec, offer string) int, defaultQ func(offer string) float64) string {
+	if w != nil {
+		AddVary(w, header)
+	}
+	if len(offers) == 0 {
+		return ""
+	}
+	value := r.Header.Get(header)
+	if value == "" {
+		return offers[0]
+	}
+	return negotiateSpecs(ParseAccept(value), offers, match, defaultQ)
+}
+
+// NegotiateContentType returns the best offered media type, like
+// "application/json", for the request Accept header, or empty string if none
+// is acceptable. The most specific media range defines the offer quality:
+// "text/html" precedes "text/*" and "*/*". On ties, the first offer is
+// chosen. If the request does not have the header, returns the first offer.
+// If w is not nil, adds "Accept" to the Vary header.
+func NegotiateContentType(w http.ResponseWriter, r *http.Request, offers ...string) string {
+	return negotiate(w, r, "Accept", offers, matchMediaType, nil)
+}
+
+func matchMediaType(spec, offer string) int {
+	if i := strings.IndexByte(offer, ';'); i >= 0 {
+		offer = strings.TrimSpace(offer[:i])
+	}
+	switch {
+	case spec == offer:
+		return 2
+	case spec == "*/*":
+		return 0
+	case strings.HasSuffix(spec, "/*") && strings.HasPrefix(offer, spec[:len(spec)-1]):
+		return 1
+	}
+	return -1
+}
+
+// NegotiateLanguage returns the best offered language tag, like "pt-BR", for
+// the request Accept-Language header, or empty string if none is acceptable.
+// A language range matches the tags equal to it or starting with it followed
+// by "-", like "en" matches "en-US", and the longest range defines the offer
+// quality. If the request does not have the header, returns the first offer.
+// If w is not nil, adds "Accept-Language" to the Vary header.
+func NegotiateLanguage(w http.ResponseWriter, r *http.Request, offers ...string) string {
+	return negotiate(w, r, "Accept-Language", offers, matchLanguage, nil)
+}
+
+func matchLanguage(spec, offer string) int {
+	switch {
+	case spec == "*":
+		return 0
+	case spec == offer || strings.HasPrefix(offer, spec+"-"):
+		return len(spec)
+	}
+	return -1
+}
+
+// NegotiateCharset returns the best offered charset, like "utf-8", for the
+// request Accept-Charset header, or empty string if none is acceptable. If
+// the request does not have the header, returns the first offer. If w is not
+// nil, adds "Accept-Charset" to the Vary header.
+func NegotiateCharset(w http.ResponseWriter, r *http.Request, offers ...string) string {
+	return negotiate(w, r, "Accept-Charset", offers, matchToken, nil)
+}
+
+// NegotiateEncoding returns the best offered content coding, like "gzip", for
+// the request Accept-Encoding header, or empty string if none is acceptable.
+// The "identity" coding is acceptable, with lowest quality, unless refused by
+// "identity;q=0" or "*;q=0". If the request does not have the header, returns
+// "identity" if offered, otherwise the first offer. If w is not nil, adds
+// "Accept-Encoding" to the Vary header.
+func NegotiateEncoding(w http.ResponseWriter, r *http.Request, offers ...string) string {
+	if r.Header.Get("Accept-Encoding") == "" {
+		if w != nil {
+			AddVary(w, "Accept-Encoding")
+		}
+		for _, offer := range offers {
+			if strings.EqualFold(offer, "identity") {
+				return offer
+			}
+		}
+	}
+	return negotiate(w, r, "Accept-Encoding", offers, matchEncoding, func(offer string) float64 {
+		if offer == "identity" {
+			return 0.001
+		}
+		return -1
+	})
+}
+
+func matchEncoding(spec, offer string) int {
+	if spec == "x-gzip" {
+		spec = "gzip"
+	}
+	return matchToken(spec, offer)
+}
+
+func matchToken(spec, offer string) int {
+	switch spec {
+	case offer:
+		return 1
+	case "*":
+		return 0
+	}
+	return -1
+}
+
+// WantsJSON reports if the request prefers JSON over HTML responses by the
+// Accept header.
+func WantsJSON(r *http.Request) bool {
+	switch NegotiateContentType(nil, r, "text/html", "application/json", "application/problem+json") {
+	case "application/json", "application/problem+json":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,196 @@
+package httpu
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Precompressed is a precompressed file variant, stored side by side with the
+// original file, like "app.js.br" of "app.js".
+type Precompressed struct {
+	// Encoding is the content coding of variant, like "br".
+	Encoding string
+	// Ext is the file name extension of variant, like ".br".
+	Ext string
+}
+
+// DefaultPrecompressed are the precompressed variants looked up by ServeFile
+// if none are given, in server preference order.
+var DefaultPrecompressed = []Precompressed{
+	{"br", ".br"},
+	{"zstd", ".zst"},
+	{"gzip", ".gz"},
+}
+
+// VariantETag returns the etag of the encoding variant of the representation
+// with etag, like `"abc-br"` of `"abc"`. Returns etag if empty or encoding is
+// "identity".
+func VariantETag(etag, encoding string) string {
+	if etag == "" || encoding == "" || encoding == "identity" || !strings.HasSuffix(etag, `"`) {
+		return etag
+	}
+	return etag[:len(etag)-1] + "-" + encoding + `"`
+}
+
+// fileETag returns the etag of file by modification time and size.
+func fileETag(info fs.FileInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size())
+}
+
+// openPrecompressed opens the variant of file name negotiated by the request
+// Accept-Encoding header. The variants older than the original file are
+// ignored. Returns nil file if identity is preferred.
+func openPrecompressed(r *http.Request, fsys http.FileSystem, name string, orig fs.FileInfo, precompressed []Precompressed) (f http.File, info fs.FileInfo, encoding string) {
+	if r.Header.Get("Accept-Encoding") == "" {
+		return
+	}
+	var (
+		offers = make([]string, 0, len(precompressed)+1)
+		files  = make(map[string]http.File, len(precompressed))
+		infos  = make(map[string]fs.FileInfo, len(precompressed))
+	)
+	defer func() {
+		for enc, f := range files {
+			if enc != encoding {
+				f.Close()
+			}
+		}
+	}()
+	for _, p := range precompressed {
+		if _, ok := files[p.Encoding]; ok {
+			continue
+		}
+		vf, err := fsys.Open(name + p.Ext)
+		if err != nil {
+			continue
+		}
+		vinfo, err := vf.Stat()
+		if err != nil || vinfo.IsDir() || vinfo.ModTime().Before(orig.ModTime()) {
+			vf.Close()
+			continue
+		}
+		files[p.Encoding], infos[p.Encoding] = vf, vinfo
+		offers = append(offers, p.Encoding)
+	}
+	if len(offers) == 0 {
+		return
+	}
+	if encoding = NegotiateEncoding(nil, r, append(offers, "identity")...); encoding == "identity" || encoding == "" {
+		encoding = ""
+		return
+	}
+	return files[encoding], infos[encoding], encoding
+}
+
+// ServeFile replies to the request with the file name of fsys using
+// ServeContent. If the client accepts, a precompressed variant of the file is
+// served with its Content-Encoding, Content-Length and variant ETag, otherwise
+// the file is served as is, compressed on the fly if possible. If
+// precompressed is empty, DefaultPrecompressed is used.
+//
+// If the response ETag header is not set, an etag is generated by the file
+// modification time and size.
+func ServeFile(w http.ResponseWriter, r *http.Request, fsys http.FileSystem, name string, precompressed ...Precompressed) {
+	serveFile(w, r, fsys, name, precompressed, nil, nil)
+}
+
+// serveFile serves the file like ServeFile. If etags is not nil, the etag is
+// the content hash.
+func serveFile(w http.ResponseWriter, r *http.Request, fsys http.FileSystem, name string, precompressed []Precompressed, etags *ETagCache, opts *ContentOptions) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		serveFileError(w, r, err)
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		serveFileError(w, r, err)
+		return
+	}
+	if info.IsDir() {
+		NotFound(w, r)
+		return
+	}
+
+	if len(precompressed) == 0 {
+		precompressed = DefaultPrecompressed
+	}
+	AddVary(w, "Accept-Encoding")
+
+	h := w.Header()
+	if h.Get("Etag") == "" {
+		if etags == nil {
+			h.Set("Etag", fileETag(info))
+		} else if etag, err := etags.ETag(name, info.Size(), info.ModTime(), f); err != nil {
+			RenderError(w, r, err)
+			return
+		} else {
+			h.Set("Etag", etag)
+		}
+	}
+
+	content, contentInfo := f, info
+	if vf, vinfo, encoding := openPrecompressed(r, fsys, name, info, precompressed); vf != nil {
+		defer vf.Close()
+		content, contentInfo = vf, vinfo
+		if _, haveType := h["Content-Type"]; !haveType {
+			ctype := mime.TypeByExtension(filepath.Ext(name))
+			if ctype == "" {
+				ctype = "application/octet-stream"
+			}
+			h.Set("Content-Type", ctype)
+		}
+		h.Set("Content-Encoding", encoding)
+		h.Set("Etag", VariantETag(h.Get("Etag"), encoding))
+	}
+
+	ServeContentOptions(w, r, opts, path.Base(name), info.ModTime(), content, func() (int64, error) {
+		return contentInfo.Size(), nil
+	})
+}
+
+func serveFileError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		NotFound(w, r)
+	case errors.Is(err, fs.ErrPermission):
+		RenderError(w, r, NewHttpError(http.StatusForbidden, err.Error()))
+	default:
+		RenderError(w, r, err)
+	}
+}
+
+// PrecompressedHandler serves the files of FileSystem by request path, with
+// their precompressed variants. The hidden files are replied by the Hidden
+// policy, not found by default.
+type PrecompressedHandler struct {
+	FileSystem    http.FileSystem
+	Precompressed []Precompressed
+	// Hidden is the hidden files policy.
+	Hidden HiddenPolicy
+	// HiddenExceptions are the dot names, like ".well-known", served as not
+	// hidden. If nil, DefaultHiddenExceptions is used.
+	HiddenExceptions []string
+}
+
+// NewPrecompressedHandler creates the PrecompressedHandler. If precompressed
+// is empty, DefaultPrecompressed is used.
+func NewPrecompressedHandler(fsys http.FileSystem, precompressed ...Precompressed) *PrecompressedHandler {
+	return &PrecompressedHandler{FileSystem: fsys, Precompressed: precompressed}
+}
+
+func (h *PrecompressedHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := path.Clean("/" + r.URL.Path)
+	if h.Hidden.Reject(w, r, name, h.HiddenExceptions) {
+		return
+	}
+	ServeFile(w, r, h.FileSystem, name, h.Precompressed...)
+}
@@ -0,0 +1,46 @@
+package httpu
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"testing/fstest"
+)
+
+func TestPrecompressedHandlerHidden(t *testing.T) {
+	fsys := http.FS(fstest.MapFS{
+		".env":                     {Data: []byte("SECRET=1")},
+		".env.gz":                  {Data: []byte("gzip")},
+		".git/config":              {Data: []byte("[core]")},
+		".git/config.br":           {Data: []byte("br")},
+		".well-known/security.txt": {Data: []byte("Contact: mailto:security@example.com")},
+		"app.js":                   {Data: []byte("app")},
+	})
+	for _, tt := range []struct {
+		hidden HiddenPolicy
+		path   string
+		code   int
+	}{
+		{HiddenNotFound, "/.env", http.StatusNotFound},
+		{HiddenNotFound, "/.env.gz", http.StatusNotFound},
+		{HiddenNotFound, "/.git/config", http.StatusNotFound},
+		{HiddenNotFound, "/.git/config.br", http.StatusNotFound},
+		{HiddenNotFound, "/x/../.env", http.StatusNotFound},
+		{HiddenNotFound, "/.well-known/security.txt", http.StatusOK},
+		{HiddenNotFound, "/app.js", http.StatusOK},
+		{HiddenForbidden, "/.env", http.StatusForbidden},
+		{HiddenAllow, "/.env", http.StatusOK},
+	} {
+		h := NewPrecompressedHandler(fsys)
+		h.Hidden = tt.hidden
+		for _, encoding := range []string{"", "gzip, br"} {
+			r := httptest.NewRequest("GET", tt.path, nil)
+			r.Header.Set("Accept-Encoding", encoding)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tt.code {
+				t.Errorf("%s with policy %d and Accept-Encoding %q: code = %d, want %d", tt.path, tt.hidden, encoding, w.Code, tt.code)
+			}
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package httpu
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Precondition is the outcome of the request preconditions evaluation, as of
+// RFC 7232 section 6.
+type Precondition int
+
+const (
+	// PreconditionPassed is the request to be performed.
+	PreconditionPassed Precondition = iota
+	// PreconditionNotModified is the GET or HEAD request replied with
+	// 304 Not Modified.
+	PreconditionNotModified
+	// PreconditionFailed is the request replied with 412 Precondition Failed.
+	PreconditionFailed
+)
+
+// Status returns the HTTP status of the outcome, or 0 if passed.
+func (p Precondition) Status() int {
+	switch p {
+	case PreconditionNotModified:
+		return http.StatusNotModified
+	case PreconditionFailed:
+		return http.StatusPreconditionFailed
+	}
+	return 0
+}
+
+// ResourceState is the current state of a resource.
+type ResourceState struct {
+	// ETag is the current etag, like `"v1"` or `W/"v1"`.
+	ETag string
+	// ModTime is the last modification time. If zero, the If-Modified-Since
+	// and If-Unmodified-Since headers are ignored.
+	ModTime time.Time
+}
+
+// ResourceStateFunc returns the current state of the requested resource, or
+// nil if it does not exist.
+type ResourceStateFunc func() (state *ResourceState, err error)
+
+// hasPreconditions reports if the request has conditional headers.
+func hasPreconditions(r *http.Request) bool {
+	for _, name := range []string{"If-Match", "If-None-Match", "If-Unmodified-Since", "If-Modified-Since"} {
+		if r.Header.Get(name) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// evalPreconditions evaluates the request preconditions following RFC 7232
+// section 6.
+func evalPreconditions(r *http.Request, etag string, modtime time.Time, exists bool) Precondition {
+	ch := checkIfMatch(r, etag, exists)
+	if ch == condNone && exists {
+		ch = checkIfUnmodifiedSince(r, modtime)
+	}
+	if ch == condFalse {
+		return PreconditionFailed
+	}
+	switch checkIfNoneMatch(r, etag, exists) {
+	case condFalse:
+		if r.Method == "GET" || r.Method == "HEAD" {
+			return PreconditionNotModified
+		}
+		return PreconditionFailed
+	case condNone:
+		if exists && checkIfModifiedSince(r, modtime) == condFalse {
+			return PreconditionNotModified
+		}
+	}
+	return PreconditionPassed
+}
+
+// EvaluatePreconditions evaluates the If-Match, If-Unmodified-Since,
+// If-None-Match and If-Modified-Since headers of the request against the
+// resource state, following RFC 7232 section 6. The state is loaded only if
+// the request has conditional headers.
+func EvaluatePreconditions(r *http.Request, state ResourceStateFunc) (result Precondition, err error) {
+	if !hasPreconditions(r) {
+		return PreconditionPassed, nil
+	}
+	var st *ResourceState
+	if st, err = state(); err != nil {
+		return
+	}
+	if st == nil {
+		return evalPreconditions(r, "", time.Time{}, false), nil
+	}
+	return evalPreconditions(r, st.ETag, st.ModTime, true), nil
+}
+
+// writePrecondition writes the 304 or 412 response of result and reports if
+// written.
+func writePrecondition(w http.ResponseWriter, r *http.Request, result Precondition) bool {
+	switch result {
+	case PreconditionNotModified:
+		writeNotModified(w)
+	case PreconditionFailed:
+		RenderError(w, r, NewHttpError(http.StatusPreconditionFailed, ""))
+	default:
+		return false
+	}
+	return true
+}
+
+// CheckPreconditions evaluates the request preconditions by
+// EvaluatePreconditions and writes the 304 Not Modified, with the resource
+// ETag and Last-Modified, or 412 Precondition Failed responses. Reports if a
+// response was written, including the error response if state fails.
+//
+// It is used by the write method handlers, like PUT or DELETE, for
+// optimistic concurrency:
+//
+//	if httpu.CheckPreconditions(w, r, loadState) {
+//		return
+//	}
+func CheckPreconditions(w http.ResponseWriter, r *http.Request, state ResourceStateFunc) (done bool) {
+	var st *ResourceState
+	result, err := EvaluatePreconditions(r, func() (_ *ResourceState, err error) {
+		st, err = state()
+		return st, err
+	})
+	if err != nil {
+		RenderError(w, r, err)
+		return true
+	}
+	if result == PreconditionNotModified && st != nil {
+		if st.ETag != "" {
+			w.Header().Set("Etag", st.ETag)
+		}
+		setLastModified(w, st.ModTime)
+	}
+	return writePrecondition(w, r, result)
+}
+
+// StrongETag returns the strong etag of tag, like `"v1"` of "v1". The double
+// quotes of tag are removed.
+func StrongETag(tag string) string {
+	return `"` + strings.ReplaceAll(tag, `"`, "") + `"`
+}
+
+// WeakETag returns the weak etag of tag, like `W/"v1"` of "v1". The double
+// quotes of tag are removed.
+func WeakETag(tag string) string {
+	return "W/" + StrongETag(tag)
+}
+
+// IsWeakETag reports if etag is weak.
+func IsWeakETag(etag string) bool {
+	return strings.HasPrefix(etag, "W/")
+}
+
+// ETagMatch reports if the etags match. If weak, uses the weak comparison,
+// otherwise the strong comparison, as of RFC 7232 section 2.3.2.
+func ETagMatch(a, b string, weak bool) bool {
+	if weak {
+		return etagWeakMatch(a, b)
+	}
+	return etagStrongMatch(a, b)
+}
+
+// DefaultPreconditionMethods are the methods used by RequirePreconditions if
+// none are given.
+var DefaultPreconditionMethods = []string{http.MethodPut, http.MethodPatch, http.MethodDelete}
+
+// RequirePreconditions returns a handler that replies 428 Precondition
+// Required to the requests with methods without If-Match or
+// If-Unmodified-Since headers, so the clients must not overwrite changes of
+// others. If methods is empty, DefaultPreconditionMethods is used.
+func RequirePreconditions(handler http.Handler, methods ...string) http.Handler {
+	if len(methods) == 0 {
+		methods = DefaultPreconditionMethods
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if containsString(methods, r.Method) && r.Header.Get("If-Match") == "" && r.Header.Get("If-Unmodified-Since") == "" {
+			RenderError(w, r, NewHttpError(http.StatusPreconditionRequired, "the request must be conditional, with If-Match or If-Unmodified-Since header"))
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,416 @@
+package httpu
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/moisespsena-go/logging"
+	"github.com/moisespsena-go/task"
+)
+
+const (
+	// PreforkWorkerEnv is the environment variable with the worker id of the
+	// prefork worker processes.
+	PreforkWorkerEnv = "HTTPU_PREFORK_WORKER"
+
+	// preforkListenersEnv is the number of inherited files of each config
+	// listener, like "1,2,1".
+	preforkListenersEnv = "HTTPU_PREFORK_LISTENERS"
+
+	// preforkFirstFd is the file descriptor of first exec.Cmd.ExtraFiles.
+	preforkFirstFd = 3
+
+	DefaultPreforkRestartDelay    = time.Second
+	DefaultPreforkMaxRestartDelay = time.Minute
+	DefaultPreforkShutdownTimeout = 10 * time.Second
+)
+
+var ErrPreforkMaster = errors.New("not supported by prefork master")
+
+// PreforkConfig specifies the multi-process prefork mode: the master process
+// binds the listeners and spawns the workers processes, running the same
+// executable with the same arguments, that inherit the listeners sockets and
+// serve the requests.
+type PreforkConfig struct {
+	// Workers is the number of worker processes. If zero, the prefork mode is
+	// disabled. If -1, runtime.NumCPU() is used.
+	Workers int `mapstructure:"workers" yaml:"workers"`
+	// RestartDelay is the delay to restart a crashed worker, doubled on each
+	// consecutive crash up to MaxRestartDelay. If zero,
+	// DefaultPreforkRestartDelay is used.
+	RestartDelay time.Duration `mapstructure:"restart_delay" yaml:"restart_delay"`
+	// MaxRestartDelay is the max delay to restart a crashed worker. The worker
+	// running longer than it resets the delay. If zero,
+	// DefaultPreforkMaxRestartDelay is used.
+	MaxRestartDelay time.Duration `mapstructure:"max_restart_delay" yaml:"max_restart_delay"`
+	// MaxRestarts is the max number of consecutive restarts of a worker before
+	// give up. If zero, the workers are always restarted.
+	MaxRestarts int `mapstructure:"max_restarts" yaml:"max_restarts"`
+	// ShutdownTimeout is the max duration the workers have to drain its
+	// connections before be killed. If zero, DefaultPreforkShutdownTimeout is
+	// used.
+	ShutdownTimeout time.Duration `mapstructure:"shutdown_timeout" yaml:"shutdown_timeout"`
+}
+
+// Enabled reports if the prefork mode is enabled.
+func (cfg PreforkConfig) Enabled() bool {
+	return cfg.Workers != 0
+}
+
+func (cfg PreforkConfig) workers() int {
+	if cfg.Workers == -1 {
+		return runtime.NumCPU()
+	}
+	return cfg.Workers
+}
+
+// restartDelay returns the delay of the nth consecutive restart.
+func (cfg PreforkConfig) restartDelay(n int) (delay time.Duration) {
+	delay, max := cfg.RestartDelay, cfg.maxRestartDelay()
+	if delay == 0 {
+		delay = DefaultPreforkRestartDelay
+	}
+	for i := 1; i < n && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return
+}
+
+func (cfg PreforkConfig) maxRestartDelay() time.Duration {
+	if cfg.MaxRestartDelay == 0 {
+		return DefaultPreforkMaxRestartDelay
+	}
+	return cfg.MaxRestartDelay
+}
+
+func (cfg PreforkConfig) shutdownTimeout() time.Duration {
+	if cfg.ShutdownTimeout == 0 {
+		return DefaultPreforkShutdownTimeout
+	}
+	return cfg.ShutdownTimeout
+}
+
+// PreforkWorkerID returns the id, starting from 1, of the current prefork
+// worker process, or 0 if is not a worker.
+func PreforkWorkerID() int {
+	id, _ := strconv.Atoi(os.Getenv(PreforkWorkerEnv))
+	return id
+}
+
+// preforkMaster is the task that supervises the prefork workers.
+type preforkMaster struct {
+	cfg       PreforkConfig
+	log       logging.Logger
+	listeners []net.Listener
+	files     []*os.File
+	counts    string
+	mu        sync.Mutex
+	workers   map[int]*os.Process
+	stopping  bool
+	stopc     chan struct{}
+	finished  chan struct{}
+	wg        sync.WaitGroup
+}
+
+// setupPreforkMaster binds the listeners and creates the master task.
+func (s *Server) setupPreforkMaster() (err error) {
+	m := &preforkMaster{
+		cfg:     s.Config.Prefork,
+		log:     logging.WithPrefix(s.log, "{prefork}", ":"),
+		workers: map[int]*os.Process{},
+	}
+	defer func() {
+		if err != nil {
+			m.close()
+		}
+	}()
+
+	counts := make([]string, len(s.Config.Listeners))
+	for i, cfg := range s.Config.Listeners {
+		var (
+			l     net.Listener
+			files []*os.File
+		)
+		if l, err = cfg.CreateListener(); err != nil {
+			return
+		}
+		m.listeners = append(m.listeners, l)
+		if files, err = listenerFiles(l); err != nil {
+			return fmt.Errorf("listener %q: %v", cfg.Addr, err)
+		}
+		m.files = append(m.files, files...)
+		counts[i] = strconv.Itoa(len(files))
+		s.log.Infof("listening on %s", l.Addr().String())
+	}
+	m.counts = strings.Join(counts, ",")
+
+	s.prefork = m
+	s.tasks = append(s.tasks, m)
+	return
+}
+
+// listenerFiles returns the files of network listener sockets.
+func listenerFiles(l net.Listener) (files []*os.File, err error) {
+	if ml, ok := l.(*MultiListener); ok {
+		for _, l := range ml.Listeners {
+			var f []*os.File
+			if f, err = listenerFiles(l); err != nil {
+				return
+			}
+			files = append(files, f...)
+		}
+		return
+	}
+	fl, ok := l.(interface{ File() (*os.File, error) })
+	if !ok {
+		return nil, fmt.Errorf("%T does not provides the socket file", l)
+	}
+	var f *os.File
+	if f, err = fl.File(); err != nil {
+		return
+	}
+	return []*os.File{f}, nil
+}
+
+func (m *preforkMaster) Start(done func()) (stop task.Stoper, err error) {
+	m.stopc = make(chan struct{})
+	m.finished = make(chan struct{})
+
+	sigs := make(chan os.Signal, 1)
+	if len(preforkSignals) > 0 {
+		signal.Notify(sigs, preforkSignals...)
+	}
+
+	workers := m.cfg.workers()
+	m.wg.Add(workers)
+	for id := 1; id <= workers; id++ {
+		go m.supervise(id)
+	}
+
+	go func() {
+		for {
+			select {
+			case sig := <-sigs:
+				m.signal(sig)
+			case <-m.finished:
+				return
+			}
+		}
+	}()
+
+	go func() {
+		defer done()
+		m.wg.Wait()
+		signal.Stop(sigs)
+		m.close()
+		close(m.finished)
+		m.log.Info("done")
+	}()
+	return task.NewStoper(m.Stop, m.IsRunning), nil
+}
+
+// supervise runs the worker id and restarts it on crash.
+func (m *preforkMaster) supervise(id int) {
+	defer m.wg.Done()
+	var restarts int
+	for {
+		started := time.Now()
+		err := m.run(id)
+		if m.isStopping() {
+			return
+		}
+		if err == nil {
+			err = errors.New("unexpected exit")
+		}
+		if time.Since(started) > m.cfg.maxRestartDelay() {
+			restarts = 0
+		}
+		if restarts++; m.cfg.MaxRestarts > 0 && restarts > m.cfg.MaxRestarts {
+			m.log.Errorf("worker %d: %v: max restarts reached", id, err)
+			return
+		}
+		delay := m.cfg.restartDelay(restarts)
+		m.log.Errorf("worker %d: %v: restarting in %s", id, err, delay)
+		select {
+		case <-time.After(delay):
+		case <-m.stopc:
+			return
+		}
+	}
+}
+
+// run starts the worker process id and waits for it exits.
+func (m *preforkMaster) run(id int) (err error) {
+	var exe string
+	if exe, err = os.Executable(); err != nil {
+		return
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.Env = append(os.Environ(),
+		PreforkWorkerEnv+"="+strconv.Itoa(id),
+		preforkListenersEnv+"="+m.counts,
+	)
+	cmd.ExtraFiles = m.files
+
+	m.mu.Lock()
+	if m.stopping {
+		m.mu.Unlock()
+		return
+	}
+	if err = cmd.Start(); err != nil {
+		m.mu.Unlock()
+		return
+	}
+	m.workers[id] = cmd.Process
+	m.mu.Unlock()
+
+	m.log.Infof("worker %d started with pid %d", id, cmd.Process.Pid)
+	err = cmd.Wait()
+
+	m.mu.Lock()
+	delete(m.workers, id)
+	m.mu.Unlock()
+	return
+}
+
+func (m *preforkMaster) isStopping() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.stopping
+}
+
+// signal sends sig to all workers.
+func (m *preforkMaster) signal(sig os.Signal) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, p := range m.workers {
+		if err := p.Signal(sig); err != nil {
+			m.log.Errorf("worker %d: send signal %v failed: %v", id, sig, err)
+		}
+	}
+}
+
+// Stop sends SIGTERM to the workers, that drains its connections, and kills
+// the workers still running after ShutdownTimeout.
+func (m *preforkMaster) Stop() {
+	m.mu.Lock()
+	if m.stopping {
+		m.mu.Unlock()
+		return
+	}
+	m.stopping = true
+	close(m.stopc)
+	m.mu.Unlock()
+
+	m.signal(syscall.SIGTERM)
+
+	go func() {
+		timer := time.NewTimer(m.cfg.shutdownTimeout())
+		defer timer.Stop()
+		select {
+		case <-m.finished:
+		case <-timer.C:
+			m.log.Warning("shutdown timeout: killing workers")
+			m.signal(os.Kill)
+		}
+	}()
+}
+
+func (m *preforkMaster) IsRunning() bool {
+	select {
+	case <-m.finished:
+		return false
+	default:
+		return true
+	}
+}
+
+func (m *preforkMaster) close() {
+	for _, f := range m.files {
+		f.Close()
+	}
+	for _, l := range m.listeners {
+		l.Close()
+	}
+}
+
+// inheritedListeners returns the listeners inherited by the prefork worker
+// process, by addr.
+func inheritedListeners(cfgs []ListenerConfig) (listeners map[Addr]net.Listener, err error) {
+	counts := strings.Split(os.Getenv(preforkListenersEnv), ",")
+	if len(counts) != len(cfgs) {
+		return nil, fmt.Errorf("prefork worker: %d listeners inherited, but %d configured", len(counts), len(cfgs))
+	}
+	listeners = make(map[Addr]net.Listener, len(cfgs))
+	fd := preforkFirstFd
+	for i, cfg := range cfgs {
+		var count int
+		if count, err = strconv.Atoi(counts[i]); err != nil {
+			return nil, fmt.Errorf("prefork worker: bad %s value: %v", preforkListenersEnv, err)
+		}
+		ls := make([]net.Listener, count)
+		for j := range ls {
+			f := os.NewFile(uintptr(fd), string(cfg.Addr))
+			fd++
+			ls[j], err = net.FileListener(f)
+			f.Close()
+			if err != nil {
+				return nil, fmt.Errorf("prefork worker: listener %q: %v", cfg.Addr, err)
+			}
+		}
+		if count == 1 {
+			listeners[cfg.Addr] = ls[0]
+		} else {
+			listeners[cfg.Addr] = NewMultiListener(ls...)
+		}
+	}
+	return
+}
+
+// startPreforkWorker gracefully shutdowns the worker on SIGINT or SIGTERM or
+// when the master process exits.
+func (s *Server) startPreforkWorker() {
+	var (
+		sigs = make(chan os.Signal, 1)
+		done = make(chan struct{})
+		ppid = os.Getppid()
+	)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	s.PostShutdown(func() {
+		signal.Stop(sigs)
+		close(done)
+	})
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case sig := <-sigs:
+				s.log.Infof("prefork worker %d: %v received, shutting down", PreforkWorkerID(), sig)
+			case <-ticker.C:
+				if os.Getppid() == ppid {
+					continue
+				}
+				s.log.Warningf("prefork worker %d: master exited, shutting down", PreforkWorkerID())
+			}
+			go s.Close()
+			return
+		}
+	}()
+}
@@ -0,0 +1,12 @@
+//go:build !windows
+// +build !windows
+
+package httpu
+
+import (
+	"os"
+	"syscall"
+)
+
+// preforkSignals are the signals forwarded by master to the workers.
+var preforkSignals = []os.Signal{syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGUSR2}
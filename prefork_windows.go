@@ -0,0 +1,6 @@
+package httpu
+
+import "os"
+
+// preforkSignals are the signals forwarded by master to the workers.
+var preforkSignals []os.Signal
@@ -0,0 +1,115 @@
+package httpu
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/moisespsena-go/logging"
+)
+
+const DefaultRequestIdHeader = "X-Request-Id"
+
+// RecoveryConfig specifies the panic recovery handler.
+type RecoveryConfig struct {
+	// Enabled enables the recovery of handler panics.
+	Enabled bool `mapstructure:"enabled" yaml:"enabled"`
+	// RequestIdHeader is the request header with the request ID logged with
+	// the panic. If the request does not have it, a random ID is generated
+	// and sent in the response header. If empty, DefaultRequestIdHeader is
+	// used.
+	RequestIdHeader string `mapstructure:"request_id_header" yaml:"request_id_header"`
+	// ErrorPage is the HTML file sent as the 500 response body.
+	ErrorPage string `mapstructure:"error_page" yaml:"error_page"`
+}
+
+// Recovery recovers the panics of Handler, logs the stack and responds
+// 500 Internal Server Error if the header has not been sent yet, otherwise
+// aborts the response. The http.ErrAbortHandler panics are propagated.
+type Recovery struct {
+	Handler http.Handler
+	Log     logging.Logger
+	// RequestIdHeader is the request ID header. If empty,
+	// DefaultRequestIdHeader is used.
+	RequestIdHeader string
+	// ErrorHandler writes the error response. If nil, responds
+	// 500 Internal Server Error using the request ErrorRenderer.
+	ErrorHandler func(w http.ResponseWriter, r *http.Request, err interface{})
+}
+
+func NewRecovery(handler http.Handler, log logging.Logger) *Recovery {
+	return &Recovery{Handler: handler, Log: log}
+}
+
+func (rc *Recovery) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	wtd := ResponseWriterOf(w)
+	defer func() {
+		err := recover()
+		if err == nil {
+			return
+		}
+		if err == http.ErrAbortHandler {
+			panic(err)
+		}
+
+		header := rc.RequestIdHeader
+		if header == "" {
+			header = DefaultRequestIdHeader
+		}
+		id := r.Header.Get(header)
+		if id == "" {
+			id = newRequestId()
+			if !wtd.WroteHeader() {
+				wtd.Header().Set(header, id)
+			}
+		}
+
+		rc.Log.Errorf("panic serving %s %s [request id %s, prefix %s]: %v\n%s", r.Method, r.URL.Path, id, PrefixR(r), err, debug.Stack())
+
+		if wtd.WroteHeader() {
+			// the response is incomplete, closes the connection
+			panic(http.ErrAbortHandler)
+		}
+		if rc.ErrorHandler != nil {
+			rc.ErrorHandler(wtd, r, err)
+		} else {
+			RenderError(wtd, r, &HttpError{Status: http.StatusInternalServerError, Err: fmt.Errorf("panic: %v", err)})
+		}
+	}()
+	rc.Handler.ServeHTTP(wtd, r)
+}
+
+// ErrorPageHandler returns the Recovery.ErrorHandler that responds
+// 500 Internal Server Error with the HTML page.
+func ErrorPageHandler(page []byte) func(w http.ResponseWriter, r *http.Request, err interface{}) {
+	return func(w http.ResponseWriter, r *http.Request, err interface{}) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write(page)
+	}
+}
+
+func newRequestId() string {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return fmt.Sprint(err)
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// recoveryHandler returns the Recovery of handler using cfg.
+func (s *Server) recoveryHandler(cfg RecoveryConfig, handler http.Handler) http.Handler {
+	rc := &Recovery{Handler: handler, Log: s.log, RequestIdHeader: cfg.RequestIdHeader}
+	if cfg.ErrorPage != "" {
+		if page, err := ioutil.ReadFile(cfg.ErrorPage); err != nil {
+			s.log.Errorf("load recovery error page failed: %v", err)
+		} else {
+			rc.ErrorHandler = ErrorPageHandler(page)
+		}
+	}
+	return rc
+}
@@ -0,0 +1,83 @@
+package httpu
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRecoveryForwardsFlusherAndHijacker(t *testing.T) {
+	events := make(chan string, 2)
+	rc := NewRecovery(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/flush":
+			f, ok := w.(http.Flusher)
+			if !ok {
+				t.Errorf("%T is not a http.Flusher", w)
+				return
+			}
+			io.WriteString(w, "data: 1\n\n")
+			f.Flush()
+			events <- "flushed"
+			<-r.Context().Done()
+		case "/hijack":
+			h, ok := w.(http.Hijacker)
+			if !ok {
+				t.Errorf("%T is not a http.Hijacker", w)
+				return
+			}
+			c, brw, err := h.Hijack()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer c.Close()
+			brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: test\r\nConnection: Upgrade\r\n\r\n")
+			brw.Flush()
+			// the panic after hijack must not write the error response
+			panic("after hijack")
+		}
+	}), log)
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL + "/flush")
+	if err != nil {
+		t.Fatal(err)
+	}
+	line, err := bufio.NewReader(res.Body).ReadString('\n')
+	res.Body.Close()
+	if err != nil || line != "data: 1\n" {
+		t.Fatalf("read flushed data = %q, %v", line, err)
+	}
+	if e := <-events; e != "flushed" {
+		t.Fatal(e)
+	}
+
+	req, _ := http.NewRequest("GET", srv.URL+"/hijack", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "test")
+	if res, err = http.DefaultClient.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status = %d", res.StatusCode)
+	}
+}
+
+func TestRecoveryPanic(t *testing.T) {
+	rc := NewRecovery(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	}), log)
+	w := httptest.NewRecorder()
+	rc.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("code = %d", w.Code)
+	}
+	if w.Header().Get(DefaultRequestIdHeader) == "" {
+		t.Error("missing request id header")
+	}
+}
@@ -5,12 +5,11 @@ import (
 	"fmt"
 	"net"
 	"net/http"
-	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	post_limit "github.com/moisespsena-go/http-post-limit"
 	"github.com/moisespsena-go/task"
 
 	"github.com/go-errors/errors"
@@ -24,6 +23,8 @@ var (
 	pkg                 = path_helpers.GetCalledDir()
 	log                 = defaultlogger.GetOrCreateLogger(pkg)
 	ErrNoListenersFound = errors.New("No listeners found")
+	ErrListenerNotFound = errors.New("Listener not found")
+	ErrListenerExists   = errors.New("Listener already exists")
 )
 
 type ContextKey int
@@ -49,6 +50,10 @@ type Server struct {
 	Handler                    http.Handler
 	handler                    http.Handler
 	listeners                  Listeners
+	listenersMu                sync.RWMutex
+	closed                     bool
+	started                    Listeners
+	chain                      atomic.Value
 	log                        logging.Logger
 	listenerCallbacks          []func(lis *Listener)
 	preSetup, postSetup        []func(s *Server) error
@@ -56,6 +61,14 @@ type Server struct {
 	postShutdownMu, shutdownMu sync.Mutex
 	tasks                      task.Slice
 	stoper                     task.Stoper
+	state                      *task.State
+	prefork                    *preforkMaster
+	inherited                  map[Addr]net.Listener
+	errorLog                   *errorLogger
+	errorLogHooks              []func(e *ErrorLogEntry)
+	errorRenderers             ErrorRenderers
+	cacheStorage               CacheStorage
+	cacheStorageCfg            *CacheConfig
 }
 
 func NewServer(cfg *Config, handler http.Handler) *Server {
@@ -104,54 +117,151 @@ func (s *Server) OnListener(f ...func(lis *Listener)) {
 	s.listenerCallbacks = append(s.listenerCallbacks, f...)
 }
 
+// SetErrorRenderer sets the renderer of error responses of request paths with
+// prefix, like "/api/". The empty or "/" prefix sets the default renderer.
+// It must be called before Setup.
+func (s *Server) SetErrorRenderer(prefix string, renderer ErrorRenderer) {
+	s.errorRenderers.Set(prefix, renderer)
+}
+
+// OnErrorLog adds the hooks called with every http.Server error log message of
+// listeners, like handler panics, protocol errors and TLS handshake failures,
+// before the rate limit. Use it to forward the errors to an error tracker.
+func (s *Server) OnErrorLog(f ...func(e *ErrorLogEntry)) {
+	s.errorLogHooks = append(s.errorLogHooks, f...)
+}
+
+// SetCacheStorage sets the response cache storage, used instead of the
+// Config.Cache one. It must be called before Setup.
+func (s *Server) SetCacheStorage(storage CacheStorage) {
+	s.cacheStorage = storage
+	s.cacheStorageCfg = nil
+}
+
 func (s *Server) SetLog(log logging.Logger) {
 	s.log = log
 }
 
 func (s *Server) Listeners() []*Listener {
-	return s.listeners
+	s.listenersMu.RLock()
+	defer s.listenersMu.RUnlock()
+	return append([]*Listener{}, s.listeners...)
+}
+
+// Listener returns the listener bound to addr or nil if not found.
+func (s *Server) Listener(addr Addr) *Listener {
+	s.listenersMu.RLock()
+	defer s.listenersMu.RUnlock()
+	for _, l := range s.listeners {
+		if l.Config.Addr == addr {
+			return l
+		}
+	}
+	return nil
 }
 
 func (s *Server) Prepare() (err error) {
-	if s.Config.Prefix != "" && !strings.HasSuffix(s.Config.Prefix, "/") {
-		s.Config.Prefix += "/"
+	prepareConfig(s.Config)
+	if s.handler == nil {
+		s.handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			s.chain.Load().(http.Handler).ServeHTTP(w, r)
+		})
 	}
-	if !s.Config.DisableStripRequestPrefix && s.Config.RequestPrefixHeader == "" {
-		s.Config.RequestPrefixHeader = DefaultUriPrefixHeader
+	s.chain.Store(s.buildHandler(s.Config))
+	if s.errorLog == nil {
+		s.errorLog = &errorLogger{s: s}
 	}
+	s.errorLog.setConfig(s.Config.ErrorLog)
+	return
+}
 
-	if !s.Config.DisableStripRequestPrefix || s.Config.Prefix != "" {
-		s.handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+func prepareConfig(cfg *Config) {
+	if cfg.Prefix != "" && !strings.HasSuffix(cfg.Prefix, "/") {
+		cfg.Prefix += "/"
+	}
+	if !cfg.DisableStripRequestPrefix && cfg.RequestPrefixHeader == "" {
+		cfg.RequestPrefixHeader = DefaultUriPrefixHeader
+	}
+}
+
+// buildHandler creates the handlers chain using the global options of cfg.
+func (s *Server) buildHandler(cfg *Config) (handler http.Handler) {
+	handler = s.Handler
+	if !cfg.NotFoundDisabled {
+		handler = FallbackHandlers{handler, http.HandlerFunc(NotFound)}
+	}
+	if cfg.Cache.Enabled {
+		// the storage created by config is recreated if its options change,
+		// the one set by SetCacheStorage is kept
+		if storageCfg := cfg.Cache.storageConfig(); s.cacheStorage == nil ||
+			s.cacheStorageCfg != nil && *s.cacheStorageCfg != storageCfg {
+			var err error
+			if s.cacheStorage, err = cfg.Cache.CreateStorage(); err != nil {
+				s.log.Errorf("create cache storage failed, using memory: %v", err)
+				s.cacheStorage = NewMemoryCacheStorage(cfg.Cache.MaxSize)
+			}
+			s.cacheStorageCfg = &storageCfg
+		}
+		handler = NewCacheHandler(handler, s.cacheStorage, &cfg.Cache)
+	}
+	if cfg.Recovery.Enabled {
+		handler = s.recoveryHandler(cfg.Recovery, handler)
+	}
+	if cfg.Compress.Enabled {
+		compress := cfg.Compress
+		handler = NewCompressHandler(handler, &compress)
+	}
+	// the limits are matched against the paths without the server prefix,
+	// like the PrefixHandlers
+	handler = NewBodyLimitHandler(handler, BodyLimitConfig{
+		MaxSize:   cfg.MaxPostSize,
+		Unlimited: cfg.UnlimitedPostSize,
+	}, cfg.BodyLimits...)
+	if !cfg.DisableStripRequestPrefix || cfg.Prefix != "" {
+		next := handler
+		handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			var prefix = "/"
-			if !s.Config.DisableStripRequestPrefix {
-				if pfx := r.Header.Get(s.Config.RequestPrefixHeader); pfx != "" {
+			if !cfg.DisableStripRequestPrefix {
+				if pfx := r.Header.Get(cfg.RequestPrefixHeader); pfx != "" {
 					prefix += pfx[1:]
 				}
 			}
 
-			if s.Config.Prefix != "" {
-				prefix += s.Config.Prefix[1:]
+			if cfg.Prefix != "" {
+				prefix += cfg.Prefix[1:]
 			}
 
-			StripPrefix(w, r, s.Handler, prefix, !s.Config.DisableSlashPermanentRedirect)
+			StripPrefix(w, r, next, prefix, !cfg.DisableSlashPermanentRedirect)
 		})
 	}
-	if !s.Config.UnlimitedPostSize {
-		s.handler = post_limit.New(s.Handler, &post_limit.Opts{
-			MaxPostSize: s.Config.MaxPostSize,
+	if len(s.errorRenderers) > 0 {
+		next := handler
+		handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if renderer := s.errorRenderers.Get(r.URL.Path); renderer != nil {
+				r = SetErrorRendererR(r, renderer)
+			}
+			next.ServeHTTP(w, r)
 		})
 	}
-	if !s.Config.NotFoundDisabled {
-		s.Handler = FallbackHandlers{s.Handler, http.NotFoundHandler()}
-	}
 	return
 }
 
 func (s *Server) Setup() (err error) {
+	if err = s.Config.Validate(); err != nil {
+		return
+	}
 	if err = s.Prepare(); err != nil {
 		return
 	}
 
+	if s.Config.Prefork.Enabled() && PreforkWorkerID() == 0 {
+		// the master only binds the listeners, the workers serves the requests
+		if s.prefork == nil {
+			err = s.setupPreforkMaster()
+		}
+		return
+	}
+
 	for _, ps := range s.preSetup {
 		if err = ps(s); err != nil {
 			return fmt.Errorf("server pre_setup failed: %v", err.Error())
@@ -182,12 +292,19 @@ func (s *Server) Run() (err error) {
 
 func (s *Server) Start(done func()) (stop task.Stoper, err error) {
 	s.PostShutdown(done)
+	if s.Config.Prefork.Enabled() && PreforkWorkerID() > 0 {
+		s.startPreforkWorker()
+	}
+	s.listenersMu.Lock()
+	s.closed = false
+	s.listenersMu.Unlock()
 	if s.stoper, err = task.Start(func(state *task.State) {
 		s.callPostShutdown()
 	}, s.tasks...); err != nil || s.stoper == nil {
 		s.callPostShutdown()
 		return
 	}
+	s.state, _ = s.stoper.(*task.State)
 	return task.NewStoper(func() {
 		s.Close()
 	}, s.stoper.IsRunning), nil
@@ -210,105 +327,356 @@ func (s *Server) InitListeners() (err error) {
 		}
 	}()
 
+	if s.Config.Prefork.Enabled() && PreforkWorkerID() > 0 && s.inherited == nil {
+		if s.inherited, err = inheritedListeners(s.Config.Listeners); err != nil {
+			return
+		}
+	}
+
+	for i, cfg := range s.Config.Listeners {
+		var lis *Listener
+		if lis, err = s.createListener(cfg); err != nil {
+			return
+		}
+		listeners[i] = lis
+		tasks[i] = lis
+	}
+	s.listenersMu.Lock()
+	s.listeners = listeners
+	s.listenersMu.Unlock()
+	s.tasks = append(s.tasks, tasks...)
+	return
+}
+
+func (s *Server) createListener(cfg ListenerConfig) (lis *Listener, err error) {
 	log := s.log
+	kl := NewKeepAliveListener(nil)
+	if cfg.KeepAliveInterval != nil {
+		var dur time.Duration
+		dur, err = cfg.KeepAliveInterval.Get()
+		if err != nil {
+			err = fmt.Errorf("get KeepAliveInterval failed: %v", err)
+			return
+		}
+		if dur != 0 {
+			kl.KeepAliveInterval = dur
+		}
+	}
+	if cfg.KeepAliveIdleInterval != nil {
+		var dur time.Duration
+		dur, err = cfg.KeepAliveIdleInterval.Get()
+		if err != nil {
+			err = fmt.Errorf("get KeepAliveIdleInterval failed: %v", err)
+			return
+		}
+		if dur != 0 {
+			kl.KeepAliveIdleInterval = dur
+		}
+	}
+	if cfg.KeepAliveCount != 0 {
+		kl.KeepAliveCount = cfg.KeepAliveCount
+	}
+	kl.Socket = &cfg.Socket
+	if cfg.Tls != nil && !cfg.Tls.Valid() {
+		return nil, errors.Errorf("tls config for %q: bad cert_file and key_file value", cfg.Addr)
+	}
+
+	var srv *http.Server
+	if srv, err = cfg.CreateServer(); err != nil {
+		return
+	}
+	if s.handler == nil {
+		srv.Handler = s.Handler
+	} else {
+		srv.Handler = s.handler
+	}
+
+	var l net.Listener
+	if l = s.inherited[cfg.Addr]; l != nil {
+		delete(s.inherited, cfg.Addr)
+		log.Infof("prefork worker %d: listening on %s", PreforkWorkerID(), l.Addr().String())
+	} else if l, err = cfg.CreateListener(); err != nil {
+		return
+	} else {
+		log.Infof("listening on %s", l.Addr().String())
+	}
+
+	kl.Listener = l
+	l = kl
+
+	lis = &Listener{
+		Server:   srv,
+		Listener: l,
+		Config:   cfg,
+		Log:      logging.WithPrefix(log, "{"+string(cfg.Addr)+"}", ":"),
+	}
+	kl.Log = lis.Log
+	if cfg.Tls != nil {
+		tlsCfg := *cfg.Tls
+		lis.Tls = &tlsCfg
+	}
+	lis.errorLog = s.errorLog
+	srv.ErrorLog = newServerErrorLog(lis)
+	for _, cb := range s.listenerCallbacks {
+		cb(lis)
+	}
+	return
+}
+
+// AddListener creates a new listener from cfg and appends it to the server
+// listeners and config. If the server is running, the listener is started
+// immediately, otherwise it starts with the server. After Shutdown, it fails
+// with http.ErrServerClosed.
+func (s *Server) AddListener(cfg ListenerConfig) (lis *Listener, err error) {
+	s.listenersMu.Lock()
+	defer s.listenersMu.Unlock()
+	if s.prefork != nil {
+		return nil, ErrPreforkMaster
+	}
+	if lis, err = s.addListener(cfg); err != nil {
+		return
+	}
+	s.Config.Listeners = append(s.Config.Listeners, cfg)
+	return
+}
+
+// addListener creates and starts a new listener. The caller must hold the
+// listenersMu lock.
+func (s *Server) addListener(cfg ListenerConfig) (lis *Listener, err error) {
+	if s.closed {
+		return nil, http.ErrServerClosed
+	}
+	for _, l := range s.listeners {
+		if l.Config.Addr == cfg.Addr {
+			return nil, errors.WrapPrefix(ErrListenerExists, string(cfg.Addr), 0)
+		}
+	}
+
+	if lis, err = s.createListener(cfg); err != nil {
+		return
+	}
+
+	if s.state != nil {
+		// the tasks state is not safe for concurrent use, so the listener is
+		// started by itself and stopped by Shutdown
+		if err = lis.Setup(); err == nil {
+			_, err = lis.Start(func() {})
+		}
+		if err != nil {
+			lis.Close()
+			return nil, fmt.Errorf("start listener %q failed: %v", cfg.Addr, err)
+		}
+		s.started = append(s.started, lis)
+	} else {
+		s.tasks = append(s.tasks, lis)
+	}
+
+	s.listeners = append(s.listeners, lis)
+	return
+}
+
+// RemoveListener gracefully shutdowns the listener bound to addr and removes
+// it from the server listeners and config. If ctx is done before all
+// connections are finished, the remaining connections are closed.
+func (s *Server) RemoveListener(addr Addr, ctx context.Context) (err error) {
+	s.listenersMu.Lock()
+	lis := s.detachListener(addr)
+	if lis == nil {
+		s.listenersMu.Unlock()
+		return errors.WrapPrefix(ErrListenerNotFound, string(addr), 0)
+	}
 	for i, cfg := range s.Config.Listeners {
-		addr := cfg.Addr
-		var kl *KeepAliveListener
-		if addr.IsUnix() {
-			if _, err2 := os.Stat(addr.UnixPath()); err2 == nil {
-				pth := addr.UnixPath()
-				log.Info("Removing", pth)
-				if err = os.Remove(pth); err != nil {
-					return
-				}
-			}
-		} else {
-			kl = NewKeepAliveListener(nil)
-			if cfg.KeepAliveInterval != nil {
-				var dur time.Duration
-				dur, err = cfg.KeepAliveInterval.Get()
-				if err != nil {
-					err = fmt.Errorf("get KeepAliveInterval failed: %v", err)
-					return
-				}
-				if dur != 0 {
-					kl.KeepAliveInterval = dur
+		if cfg.Addr == addr {
+			s.Config.Listeners = append(s.Config.Listeners[:i:i], s.Config.Listeners[i+1:]...)
+			break
+		}
+	}
+	s.listenersMu.Unlock()
+	return stopListener(lis, ctx)
+}
+
+// detachListener removes the listener bound to addr from the server listeners
+// and tasks. The caller must hold the listenersMu lock.
+func (s *Server) detachListener(addr Addr) (lis *Listener) {
+	for i, l := range s.listeners {
+		if l.Config.Addr == addr {
+			lis = l
+			s.listeners = append(s.listeners[:i:i], s.listeners[i+1:]...)
+			break
+		}
+	}
+	if lis == nil {
+		return
+	}
+	for i, t := range s.tasks {
+		if t == lis {
+			s.tasks = append(s.tasks[:i:i], s.tasks[i+1:]...)
+			break
+		}
+	}
+	for i, l := range s.started {
+		if l == lis {
+			s.started = append(s.started[:i:i], s.started[i+1:]...)
+			break
+		}
+	}
+	return
+}
+
+func stopListener(lis *Listener, ctx context.Context) error {
+	if lis.gen != nil {
+		lis.gen.Stop()
+	}
+	if lis.IsRunning() {
+		return lis.ShutdownLog(ctx)
+	}
+	return lis.Close()
+}
+
+// ApplyConfig validates cfg and applies it to the server without restart.
+// The global options, except prefork, the listeners timeouts and TLS files and the added or
+// removed listeners are applied live, the other changes are reported in the
+// returned diff and requires a server restart. If cfg is invalid or any live
+// change fails, the running config is kept untouched. The ctx is used to drain
+// the removed listeners.
+func (s *Server) ApplyConfig(ctx context.Context, cfg *Config) (diff ConfigDiff, err error) {
+	cfg = cfg.Clone()
+	prepareConfig(cfg)
+	if err = cfg.Validate(); err != nil {
+		return
+	}
+
+	s.listenersMu.Lock()
+	defer func() {
+		if err != nil {
+			s.listenersMu.Unlock()
+		}
+	}()
+
+	if s.prefork != nil {
+		return nil, ErrPreforkMaster
+	}
+
+	old := s.Config
+	if diff = DiffConfig(old, cfg); len(diff) == 0 {
+		s.listenersMu.Unlock()
+		return
+	}
+
+	var (
+		oldByAddr = make(map[Addr]ListenerConfig, len(old.Listeners))
+		newByAddr = make(map[Addr]bool, len(cfg.Listeners))
+		certs     = map[Addr]*certificateLoader{}
+		added     []*Listener
+		removed   []*Listener
+		running   = cfg.Clone()
+	)
+
+	running.Prefork = old.Prefork
+
+	for _, l := range old.Listeners {
+		oldByAddr[l.Addr] = l
+	}
+
+	for i, l := range cfg.Listeners {
+		newByAddr[l.Addr] = true
+		if o, ok := oldByAddr[l.Addr]; ok {
+			// keeps the running values of options that requires restart
+			merged := o
+			merged.Timeouts = l.Timeouts
+			if o.Tls != nil && l.Tls != nil {
+				tlsCfg := *o.Tls
+				tlsCfg.CertFile, tlsCfg.KeyFile = l.Tls.CertFile, l.Tls.KeyFile
+				merged.Tls = &tlsCfg
+				if tlsCfg.CertFile != o.Tls.CertFile || tlsCfg.KeyFile != o.Tls.KeyFile {
+					loader := &certificateLoader{certFile: tlsCfg.CertFile, keyFile: tlsCfg.KeyFile}
+					if err = loader.load(); err != nil {
+						return nil, fmt.Errorf("listener %q: %v", l.Addr, err)
+					}
+					certs[l.Addr] = loader
 				}
 			}
-			if cfg.KeepAliveIdleInterval != nil {
-				var dur time.Duration
-				dur, err = cfg.KeepAliveIdleInterval.Get()
-				if err != nil {
-					err = fmt.Errorf("get KeepAliveIdleInterval failed: %v", err)
-					return
-				}
-				if dur != 0 {
-					kl.KeepAliveIdleInterval = dur
+			running.Listeners[i] = merged
+		}
+	}
+
+	for _, l := range cfg.Listeners {
+		if _, ok := oldByAddr[l.Addr]; !ok {
+			var lis *Listener
+			if lis, err = s.addListener(l); err != nil {
+				for _, lis := range added {
+					s.detachListener(lis.Config.Addr)
+					stopListener(lis, ctx)
 				}
+				return nil, err
 			}
-			if cfg.KeepAliveCount != 0 {
-				kl.KeepAliveCount = cfg.KeepAliveCount
-			}
+			added = append(added, lis)
 		}
-		var l net.Listener
-		if l, err = addr.CreateListener(); err != nil {
-			return
-		} else {
-			log.Infof("listening on %s", l.Addr().String())
+	}
 
-			if !addr.IsUnix() {
-				kl.Listener = l
-				l = kl
-			}
+	s.chain.Store(s.buildHandler(running))
+	if s.errorLog != nil {
+		s.errorLog.setConfig(running.ErrorLog)
+	}
 
-			var srv *http.Server
-			if srv, err = cfg.CreateServer(); err != nil {
-				return
-			}
-			if s.handler == nil {
-				srv.Handler = s.Handler
-			} else {
-				srv.Handler = s.handler
-			}
-			lis := &Listener{
-				Server:   srv,
-				Listener: l,
-				Log:      logging.WithPrefix(log, "{"+string(cfg.Addr)+"}", ":"),
-			}
-			if cfg.Tls != nil {
-				if !cfg.Tls.Valid() {
-					return errors.Errorf("tls config for %q: bad cert_file and key_file value", cfg.Addr)
-				}
-				lis.Tls = &TlsConfig{cfg.Tls.Generate, cfg.Tls.CertFile, cfg.Tls.KeyFile, cfg.Tls.NPNDisabled}
-			}
-			for _, cb := range s.listenerCallbacks {
-				cb(lis)
+	for _, lis := range s.listeners {
+		if _, ok := newByAddr[lis.Config.Addr]; !ok {
+			removed = append(removed, lis)
+			continue
+		}
+		for _, l := range running.Listeners {
+			if l.Addr == lis.Config.Addr {
+				lis.SetTimeouts(l.Timeouts)
+				break
 			}
-			listeners[i] = lis
-			tasks[i] = lis
+		}
+		if loader := certs[lis.Config.Addr]; loader != nil {
+			lis.setCertificateLoader(loader)
+		}
+	}
+
+	for _, lis := range removed {
+		s.detachListener(lis.Config.Addr)
+	}
+
+	s.Config = running
+	s.listenersMu.Unlock()
+
+	for _, lis := range removed {
+		if err := stopListener(lis, ctx); err != nil && err != context.DeadlineExceeded {
+			s.log.Errorf("remove listener %q failed: %v", lis.Config.Addr, err)
 		}
 	}
-	s.listeners = listeners
-	s.tasks = append(s.tasks, tasks...)
 	return
 }
 
 func (s *Server) Shutdown(ctx context.Context) (err error) {
 	s.shutdownMu.Lock()
 	defer s.shutdownMu.Unlock()
+	s.listenersMu.Lock()
+	s.closed = true
+	started := s.started
+	s.started = nil
+	s.listenersMu.Unlock()
 	if s.stoper != nil {
+		for _, l := range started {
+			stopListener(l, ctx)
+		}
 		s.stoper.Stop()
 		return
 	}
 
-	for _, l := range s.listeners[1:] {
-		if l.running {
-			go l.ShutdownLog(ctx)
+	listeners := s.Listeners()
+	if len(listeners) > 0 {
+		for _, l := range listeners[1:] {
+			if l.running {
+				go l.ShutdownLog(ctx)
+			}
 		}
-	}
 
-	if s.listeners[0].running {
-		err = s.listeners[0].ShutdownLog(ctx)
+		if listeners[0].running {
+			err = listeners[0].ShutdownLog(ctx)
+		}
 	}
 	s.callPostShutdown()
 	return
@@ -323,6 +691,8 @@ func (s *Server) callPostShutdown() {
 	s.postShutdown = nil
 	s.tasks = nil
 	s.stoper = nil
+	s.state = nil
+	s.prefork = nil
 }
 
 func (s *Server) Close() error {
@@ -0,0 +1,145 @@
+package httpu
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-errors/errors"
+)
+
+// startTestServer sets up and starts the server of cfg.
+func startTestServer(t *testing.T, cfg *Config, handler http.Handler) *Server {
+	t.Helper()
+	s := NewServer(cfg, handler)
+	if err := s.Setup(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Start(func() {}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// unixGet requests "/" on the unix socket of addr.
+func unixGet(addr Addr) (body string, err error) {
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", addr.UnixPath())
+		},
+		DisableKeepAlives: true,
+	}}
+	res, err := client.Get("http://unix/")
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+	b, err := io.ReadAll(res.Body)
+	return string(b), err
+}
+
+func TestServerAddRemoveListener(t *testing.T) {
+	dir := t.TempDir()
+	first, second := Addr("unix:"+filepath.Join(dir, "a.sock")), Addr("unix:"+filepath.Join(dir, "b.sock"))
+	started, release := make(chan struct{}), make(chan struct{})
+	s := startTestServer(t, &Config{Listeners: []ListenerConfig{{Addr: first}}}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("wait") != "" {
+			close(started)
+			<-release
+		}
+		io.WriteString(w, "ok")
+	}))
+
+	if _, err := s.AddListener(ListenerConfig{Addr: first}); !errors.Is(err, ErrListenerExists) {
+		t.Errorf("add existing: %v", err)
+	}
+	if _, err := s.AddListener(ListenerConfig{Addr: second}); err != nil {
+		t.Fatal(err)
+	}
+	if body, err := unixGet(second); err != nil || body != "ok" {
+		t.Fatalf("GET added listener: %q, %v", body, err)
+	}
+	if len(s.Config.Listeners) != 2 || s.Listener(second) == nil {
+		t.Fatalf("listeners = %v", s.Config.Listeners)
+	}
+
+	// the in flight request is finished before the listener is removed
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", second.UnixPath())
+		},
+	}}
+	type result struct {
+		code int
+		err  error
+	}
+	inFlight := make(chan result, 1)
+	go func() {
+		res, err := client.Get("http://unix/?wait=1")
+		if err != nil {
+			inFlight <- result{err: err}
+			return
+		}
+		res.Body.Close()
+		inFlight <- result{code: res.StatusCode}
+	}()
+	<-started
+	removed := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		removed <- s.RemoveListener(second, ctx)
+	}()
+	select {
+	case err := <-removed:
+		t.Fatalf("removed before the in flight request finished: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	if res := <-inFlight; res.err != nil || res.code != http.StatusOK {
+		t.Fatalf("in flight request: %+v", res)
+	}
+	if err := <-removed; err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := unixGet(second); err == nil {
+		t.Error("GET removed listener succeeded")
+	}
+	if body, err := unixGet(first); err != nil || body != "ok" {
+		t.Errorf("GET kept listener: %q, %v", body, err)
+	}
+	if len(s.Config.Listeners) != 1 || s.Listener(second) != nil {
+		t.Errorf("listeners = %v", s.Config.Listeners)
+	}
+	if err := s.RemoveListener(second, context.Background()); !errors.Is(err, ErrListenerNotFound) {
+		t.Errorf("remove not found: %v", err)
+	}
+}
+
+func TestServerAddListenerAfterClose(t *testing.T) {
+	dir := t.TempDir()
+	s := startTestServer(t, &Config{Listeners: []ListenerConfig{{Addr: Addr("unix:" + filepath.Join(dir, "a.sock"))}}}, http.NotFoundHandler())
+	added := Addr("unix:" + filepath.Join(dir, "b.sock"))
+	if _, err := s.AddListener(ListenerConfig{Addr: added}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := unixGet(added); err == nil {
+		t.Error("GET listener added before close succeeded after close")
+	}
+	addr := Addr("unix:" + filepath.Join(dir, "c.sock"))
+	if _, err := s.AddListener(ListenerConfig{Addr: addr}); !errors.Is(err, http.ErrServerClosed) {
+		t.Errorf("add after close: %v", err)
+	}
+	if _, err := unixGet(addr); err == nil {
+		t.Error("GET listener added after close succeeded")
+	}
+}
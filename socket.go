@@ -0,0 +1,59 @@
+package httpu
+
+import (
+	"net"
+	"time"
+)
+
+// SocketConfig specifies the low-level socket options. Except NoDelay, they
+// are supported on Linux only.
+type SocketConfig struct {
+	// ReusePort sets SO_REUSEPORT, allowing many processes to bind the same
+	// address.
+	ReusePort bool `mapstructure:"reuse_port" yaml:"reuse_port"`
+	// Backlog is the maximum length of pending connections queue. If zero,
+	// the system default is used.
+	Backlog int `mapstructure:"backlog" yaml:"backlog"`
+	// FastOpen is the TCP_FASTOPEN queue length. If zero, it is disabled.
+	FastOpen int `mapstructure:"fast_open" yaml:"fast_open"`
+	// DeferAccept sets TCP_DEFER_ACCEPT: the connection is accepted only
+	// when data arrives or after this timeout.
+	DeferAccept time.Duration `mapstructure:"defer_accept" yaml:"defer_accept"`
+	// V6Only sets IPV6_V6ONLY of IPv6 listeners.
+	V6Only *bool `mapstructure:"v6_only" yaml:"v6_only"`
+	// SendBuffer is the SO_SNDBUF size, inherited by accepted connections.
+	SendBuffer int `mapstructure:"send_buffer" yaml:"send_buffer"`
+	// ReceiveBuffer is the SO_RCVBUF size, inherited by accepted connections.
+	ReceiveBuffer int `mapstructure:"receive_buffer" yaml:"receive_buffer"`
+	// NoDelay sets TCP_NODELAY of accepted connections. If nil, the Go
+	// default (enabled) is used.
+	NoDelay *bool `mapstructure:"no_delay" yaml:"no_delay"`
+	// UserTimeout sets TCP_USER_TIMEOUT of accepted connections: the max
+	// time transmitted data may remain unacknowledged before the connection
+	// is closed.
+	UserTimeout time.Duration `mapstructure:"user_timeout" yaml:"user_timeout"`
+}
+
+// listenConfig returns the net.ListenConfig that applies the options to the
+// created sockets.
+func (cfg *SocketConfig) listenConfig() *net.ListenConfig {
+	// the keep alive is set by KeepAliveListener
+	return &net.ListenConfig{Control: cfg.control, KeepAlive: -1}
+}
+
+// setConnOptions sets the connection options of accepted conn.
+func (cfg *SocketConfig) setConnOptions(conn net.Conn) (err error) {
+	c, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	if cfg.NoDelay != nil {
+		if err = c.SetNoDelay(*cfg.NoDelay); err != nil {
+			return
+		}
+	}
+	if cfg.UserTimeout != 0 {
+		err = setUserTimeout(c, cfg.UserTimeout)
+	}
+	return
+}
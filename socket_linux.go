@@ -0,0 +1,87 @@
+package httpu
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func (cfg *SocketConfig) control(network, address string, c syscall.RawConn) (err error) {
+	type option struct {
+		level, opt, value int
+		name              string
+	}
+	var options []option
+	if cfg.SendBuffer > 0 {
+		options = append(options, option{unix.SOL_SOCKET, unix.SO_SNDBUF, cfg.SendBuffer, "SO_SNDBUF"})
+	}
+	if cfg.ReceiveBuffer > 0 {
+		options = append(options, option{unix.SOL_SOCKET, unix.SO_RCVBUF, cfg.ReceiveBuffer, "SO_RCVBUF"})
+	}
+	if network == "tcp" || network == "tcp4" || network == "tcp6" {
+		if cfg.ReusePort {
+			options = append(options, option{unix.SOL_SOCKET, unix.SO_REUSEPORT, 1, "SO_REUSEPORT"})
+		}
+		if cfg.FastOpen > 0 {
+			options = append(options, option{unix.IPPROTO_TCP, unix.TCP_FASTOPEN, cfg.FastOpen, "TCP_FASTOPEN"})
+		}
+		if cfg.DeferAccept > 0 {
+			options = append(options, option{unix.IPPROTO_TCP, unix.TCP_DEFER_ACCEPT, int(cfg.DeferAccept / time.Second), "TCP_DEFER_ACCEPT"})
+		}
+		if cfg.V6Only != nil && network == "tcp6" {
+			var v int
+			if *cfg.V6Only {
+				v = 1
+			}
+			options = append(options, option{unix.IPPROTO_IPV6, unix.IPV6_V6ONLY, v, "IPV6_V6ONLY"})
+		}
+	}
+	if len(options) == 0 {
+		return
+	}
+	if ctrlErr := c.Control(func(fd uintptr) {
+		for _, o := range options {
+			if err = unix.SetsockoptInt(int(fd), o.level, o.opt, o.value); err != nil {
+				err = fmt.Errorf("set %s of %s failed: %v", o.name, address, err)
+				return
+			}
+		}
+	}); ctrlErr != nil {
+		return ctrlErr
+	}
+	return
+}
+
+// setBacklog updates the pending connections queue length of listening socket.
+func setBacklog(l net.Listener, backlog int) (err error) {
+	sc, ok := l.(syscall.Conn)
+	if !ok {
+		return fmt.Errorf("bad listener type: %T", l)
+	}
+	var rc syscall.RawConn
+	if rc, err = sc.SyscallConn(); err != nil {
+		return
+	}
+	if ctrlErr := rc.Control(func(fd uintptr) {
+		err = unix.Listen(int(fd), backlog)
+	}); ctrlErr != nil {
+		return ctrlErr
+	}
+	return
+}
+
+func setUserTimeout(c *net.TCPConn, timeout time.Duration) (err error) {
+	var rc syscall.RawConn
+	if rc, err = c.SyscallConn(); err != nil {
+		return
+	}
+	if ctrlErr := rc.Control(func(fd uintptr) {
+		err = unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_USER_TIMEOUT, int(timeout/time.Millisecond))
+	}); ctrlErr != nil {
+		return ctrlErr
+	}
+	return
+}
@@ -0,0 +1,29 @@
+//go:build !linux
+// +build !linux
+
+package httpu
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"time"
+)
+
+var errSocketOptionNotSupported = errors.New("socket option not supported on this platform")
+
+func (cfg *SocketConfig) control(network, address string, c syscall.RawConn) (err error) {
+	if cfg.ReusePort || cfg.FastOpen > 0 || cfg.DeferAccept > 0 || cfg.V6Only != nil ||
+		cfg.SendBuffer > 0 || cfg.ReceiveBuffer > 0 {
+		return errSocketOptionNotSupported
+	}
+	return
+}
+
+func setBacklog(l net.Listener, backlog int) error {
+	return errSocketOptionNotSupported
+}
+
+func setUserTimeout(c *net.TCPConn, timeout time.Duration) error {
+	return errSocketOptionNotSupported
+}
@@ -0,0 +1,254 @@
+package httpu
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// tlsCertCheckInterval is how often the TLS handshakes check the certificate
+// file for changes.
+const tlsCertCheckInterval = 10 * time.Second
+
+// certificateLoader loads the TLS certificate pair from files and reloads it
+// when the certificate file changes, like renewals from tlsgen. The file is
+// checked by the handshakes at most once per interval.
+type certificateLoader struct {
+	certFile, keyFile string
+	// interval is how often the file is checked. If zero,
+	// tlsCertCheckInterval is used.
+	interval time.Duration
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	modTime  time.Time
+	// checked is the unix nano time of the last file check
+	checked atomic.Int64
+}
+
+func (c *certificateLoader) load() (err error) {
+	var info os.FileInfo
+	if info, err = os.Stat(c.certFile); err != nil {
+		return
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cert = &cert
+	c.modTime = info.ModTime()
+	c.checked.Store(time.Now().UnixNano())
+	return
+}
+
+// checkDue reports if the file must be checked at now, once per interval
+// between the concurrent handshakes.
+func (c *certificateLoader) checkDue(now time.Time) bool {
+	interval := c.interval
+	if interval == 0 {
+		interval = tlsCertCheckInterval
+	}
+	last := c.checked.Load()
+	return now.UnixNano()-last >= int64(interval) && c.checked.CompareAndSwap(last, now.UnixNano())
+}
+
+func (c *certificateLoader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	cert, modTime := c.cert, c.modTime
+	c.mu.RUnlock()
+
+	if cert != nil && !c.checkDue(time.Now()) {
+		return cert, nil
+	}
+	if info, err := os.Stat(c.certFile); err == nil && (cert == nil || !info.ModTime().Equal(modTime)) {
+		if err = c.load(); err != nil {
+			if cert == nil {
+				return nil, err
+			}
+			// keeps the current certificate while the new pair is incomplete
+			return cert, nil
+		}
+		c.mu.RLock()
+		cert = c.cert
+		c.mu.RUnlock()
+	}
+	return cert, nil
+}
+
+// DefaultTlsHandshakeTimeout is the TLS handshake timeout used if
+// TlsConfig.HandshakeTimeout is zero.
+var DefaultTlsHandshakeTimeout = 10 * time.Second
+
+// DefaultTlsMaxHandshakes is the max number of concurrent TLS handshakes used
+// if TlsConfig.MaxHandshakes is zero.
+var DefaultTlsMaxHandshakes = 1024
+
+// TlsHandshakeFailure is the reason of a failed TLS handshake.
+type TlsHandshakeFailure string
+
+const (
+	// TlsHandshakeFailed is a generic handshake failure.
+	TlsHandshakeFailed TlsHandshakeFailure = "handshake_failure"
+	// TlsHandshakeUnknownCA is the client rejecting the server certificate, or
+	// the server rejecting the client certificate.
+	TlsHandshakeUnknownCA TlsHandshakeFailure = "unknown_ca"
+	// TlsHandshakeProtocolMismatch is the client and server without a common
+	// TLS version, cipher suite or application protocol.
+	TlsHandshakeProtocolMismatch TlsHandshakeFailure = "protocol_mismatch"
+	// TlsHandshakeTimedOut is the handshake not finished before the
+	// TlsConfig.HandshakeTimeout.
+	TlsHandshakeTimedOut TlsHandshakeFailure = "timeout"
+	// TlsHandshakeNotTls is the client sending non TLS data, like plain HTTP.
+	TlsHandshakeNotTls TlsHandshakeFailure = "not_tls"
+	// TlsHandshakeClientClosed is the client closing the connection during
+	// the handshake.
+	TlsHandshakeClientClosed TlsHandshakeFailure = "client_closed"
+)
+
+// tlsHandshakeFailures are the error messages of failure reasons.
+var tlsHandshakeFailures = []struct {
+	reason TlsHandshakeFailure
+	msgs   []string
+}{
+	{TlsHandshakeNotTls, []string{"does not look like a TLS handshake", "oversized record", "unsupported SSLv2"}},
+	{TlsHandshakeTimedOut, []string{"i/o timeout", "deadline exceeded"}},
+	{TlsHandshakeUnknownCA, []string{"unknown certificate authority", "certificate signed by unknown authority",
+		"bad certificate", "unknown certificate", "certificate required", "unsupported certificate", "certificate expired"}},
+	{TlsHandshakeProtocolMismatch, []string{"protocol version", "unsupported versions", "no cipher suite",
+		"no application protocol", "no supported versions", "unsupported elliptic curves"}},
+	{TlsHandshakeClientClosed, []string{"EOF", "connection reset", "broken pipe"}},
+}
+
+// ClassifyTlsHandshakeError returns the failure reason of the handshake error
+// or error message.
+func ClassifyTlsHandshakeError(msg string) TlsHandshakeFailure {
+	for _, f := range tlsHandshakeFailures {
+		for _, m := range f.msgs {
+			if strings.Contains(msg, m) {
+				return f.reason
+			}
+		}
+	}
+	return TlsHandshakeFailed
+}
+
+// tlsListener accepts the connections of the Listener and runs the TLS
+// handshakes concurrently, with timeout, before returning them to the
+// http.Server.
+type tlsListener struct {
+	net.Listener
+	l         *Listener
+	config    *tls.Config
+	timeout   time.Duration
+	conns     chan net.Conn
+	errs      chan error
+	slots     chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newTlsListener(l *Listener, config *tls.Config, timeout time.Duration, maxHandshakes int) *tlsListener {
+	if timeout == 0 {
+		timeout = DefaultTlsHandshakeTimeout
+	}
+	if maxHandshakes <= 0 {
+		maxHandshakes = DefaultTlsMaxHandshakes
+	}
+	tl := &tlsListener{
+		Listener: l,
+		l:        l,
+		config:   config,
+		timeout:  timeout,
+		conns:    make(chan net.Conn),
+		errs:     make(chan error),
+		slots:    make(chan struct{}, maxHandshakes),
+		done:     make(chan struct{}),
+	}
+	go tl.accept()
+	return tl
+}
+
+func (tl *tlsListener) accept() {
+	for {
+		// waits for a free handshake slot before accepting the next
+		// connection, so slow handshakes don't pile up without bound
+		select {
+		case tl.slots <- struct{}{}:
+		case <-tl.done:
+			return
+		}
+		con, err := tl.Listener.Accept()
+		if err != nil {
+			<-tl.slots
+			select {
+			case tl.errs <- err:
+			case <-tl.done:
+				return
+			}
+			// the http.Server retries the temporary errors, like EMFILE, and
+			// returns on the other ones closing this listener
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		go tl.handshake(con)
+	}
+}
+
+func (tl *tlsListener) handshake(con net.Conn) {
+	defer func() { <-tl.slots }()
+	tc := tls.Server(con, tl.config)
+	ctx, cancel := context.WithTimeout(context.Background(), tl.timeout)
+	err := tc.HandshakeContext(ctx)
+	cancel()
+	if err != nil {
+		var re tls.RecordHeaderError
+		if errors.As(err, &re) && re.Conn != nil && recordHeaderLooksLikeHTTP(re.RecordHeader) {
+			io.WriteString(re.Conn, "HTTP/1.0 400 Bad Request\r\n\r\nClient sent an HTTP request to an HTTPS server.\n")
+		}
+		tc.Close()
+		tl.l.tlsHandshakeFailed(con.RemoteAddr().String(), err.Error())
+		return
+	}
+	select {
+	case tl.conns <- tc:
+	case <-tl.done:
+		tc.Close()
+	}
+}
+
+func (tl *tlsListener) Accept() (net.Conn, error) {
+	select {
+	case con := <-tl.conns:
+		return con, nil
+	case err := <-tl.errs:
+		return nil, err
+	case <-tl.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (tl *tlsListener) Close() (err error) {
+	tl.closeOnce.Do(func() {
+		close(tl.done)
+		err = tl.Listener.Close()
+	})
+	return
+}
+
+func recordHeaderLooksLikeHTTP(hdr [5]byte) bool {
+	switch string(hdr[:]) {
+	case "GET /", "HEAD ", "POST ", "PUT /", "OPTIO":
+		return true
+	}
+	return false
+}
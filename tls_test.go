@@ -0,0 +1,86 @@
+package httpu
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self signed certificate pair of 127.0.0.1 to dir.
+func writeTestCert(t *testing.T, dir string) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestCertificateLoaderCheckInterval(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCert(t, dir)
+	c := &certificateLoader{certFile: certFile, keyFile: keyFile, interval: time.Hour}
+	if err := c.load(); err != nil {
+		t.Fatal(err)
+	}
+	first, err := c.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeTestCert(t, dir)
+	mtime := time.Now().Add(time.Minute)
+	if err = os.Chtimes(certFile, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	if cert, _ := c.GetCertificate(nil); cert != first {
+		t.Fatal("the certificate file was checked before the interval")
+	}
+
+	// the interval elapsed
+	c.checked.Store(time.Now().Add(-time.Hour).UnixNano())
+	cert, err := c.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(cert.Certificate[0], first.Certificate[0]) {
+		t.Fatal("the changed certificate was not reloaded")
+	}
+	if again, _ := c.GetCertificate(nil); again != cert {
+		t.Error("the unchanged certificate was reloaded")
+	}
+}
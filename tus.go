@@ -0,0 +1,477 @@
+package httpu
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"hash"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	post_limit "github.com/moisespsena-go/http-post-limit"
+)
+
+const (
+	// TusVersion is the supported tus protocol version.
+	TusVersion = "1.0.0"
+	// TusExtensions are the supported tus protocol extensions.
+	TusExtensions = "creation,creation-with-upload,creation-defer-length,checksum,expiration,termination"
+	// StatusChecksumMismatch is the tus status of chunks not matching the
+	// Upload-Checksum header.
+	StatusChecksumMismatch = 460
+)
+
+// TusChecksumAlgorithms are the hashes of the Upload-Checksum header by
+// algorithm name.
+var TusChecksumAlgorithms = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// TusHandler is a tus 1.0 resumable upload handler, with the creation,
+// creation-with-upload, creation-defer-length, checksum, expiration and
+// termination extensions. It serves the uploads creation on "/" and the
+// uploads on "/<id>", so it is mounted on a prefix:
+//
+//	handlers.With("/uploads/", httpu.NewTusHandler(storage))
+//
+// The PATCH requests bodies, the upload chunks, are limited by MaxChunkSize
+// or else by the server post size, so the clients split the bigger uploads
+// in chunks.
+type TusHandler struct {
+	Storage TusStorage
+	// MaxSize is the max upload length. If zero, it is unlimited.
+	MaxSize int64
+	// MaxChunkSize is the max request body length, capped by the server max
+	// post size, if limited. If zero, the server max post size is used.
+	MaxChunkSize int64
+	// Expiration is the duration the incomplete uploads expire after the
+	// last chunk. If zero, they do not expire.
+	Expiration time.Duration
+	// OnComplete is called once, by the request completing the upload, after
+	// its last chunk was stored. Its error is rendered as the PATCH or POST
+	// response.
+	OnComplete func(r *http.Request, upload *TusUpload) error
+
+	locks sync.Map
+}
+
+// NewTusHandler creates the TusHandler of storage.
+func NewTusHandler(storage TusStorage) *TusHandler {
+	return &TusHandler{Storage: storage}
+}
+
+func (h *TusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	header := w.Header()
+	header.Set("Tus-Resumable", TusVersion)
+	method := r.Method
+	if override := r.Header.Get("X-HTTP-Method-Override"); override != "" && method == http.MethodPost {
+		method = strings.ToUpper(override)
+	}
+	if method == http.MethodOptions {
+		h.serveOptions(w)
+		return
+	}
+	if r.Header.Get("Tus-Resumable") != TusVersion {
+		header.Set("Tus-Version", TusVersion)
+		RenderError(w, r, NewHttpError(http.StatusPreconditionFailed, "unsupported tus version"))
+		return
+	}
+
+	id := strings.Trim(r.URL.Path, "/")
+	if id == "" {
+		if method != http.MethodPost {
+			header.Set("Allow", "OPTIONS, POST")
+			RenderError(w, r, NewHttpError(http.StatusMethodNotAllowed, ""))
+			return
+		}
+		h.create(w, r)
+		return
+	}
+	if strings.Contains(id, "/") {
+		NotFound(w, r)
+		return
+	}
+
+	switch method {
+	case http.MethodHead:
+		h.head(w, r, id)
+	case http.MethodPatch:
+		h.patch(w, r, id)
+	case http.MethodDelete:
+		h.terminate(w, r, id)
+	default:
+		header.Set("Allow", "OPTIONS, HEAD, PATCH, DELETE")
+		RenderError(w, r, NewHttpError(http.StatusMethodNotAllowed, ""))
+	}
+}
+
+func (h *TusHandler) serveOptions(w http.ResponseWriter) {
+	header := w.Header()
+	header.Set("Tus-Version", TusVersion)
+	header.Set("Tus-Extension", TusExtensions)
+	if h.MaxSize > 0 {
+		header.Set("Tus-Max-Size", strconv.FormatInt(h.MaxSize, 10))
+	}
+	algorithms := make([]string, 0, len(TusChecksumAlgorithms))
+	for name := range TusChecksumAlgorithms {
+		algorithms = append(algorithms, name)
+	}
+	sort.Strings(algorithms)
+	header.Set("Tus-Checksum-Algorithm", strings.Join(algorithms, ","))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *TusHandler) create(w http.ResponseWriter, r *http.Request) {
+	upload := &TusUpload{Size: -1, CreatedAt: time.Now()}
+	if v := r.Header.Get("Upload-Length"); v != "" {
+		size, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || size < 0 {
+			RenderError(w, r, NewHttpError(http.StatusBadRequest, "invalid Upload-Length header"))
+			return
+		}
+		upload.Size = size
+	} else if r.Header.Get("Upload-Defer-Length") != "1" {
+		RenderError(w, r, NewHttpError(http.StatusBadRequest, "missing Upload-Length or Upload-Defer-Length header"))
+		return
+	}
+	if h.MaxSize > 0 && upload.Size > h.MaxSize {
+		RenderError(w, r, NewHttpError(http.StatusRequestEntityTooLarge, "max upload size of "+strconv.FormatInt(h.MaxSize, 10)+" bytes exceeded"))
+		return
+	}
+	var err error
+	if upload.Metadata, err = parseTusMetadata(r.Header.Get("Upload-Metadata")); err != nil {
+		RenderError(w, r, NewHttpError(http.StatusBadRequest, err.Error()))
+		return
+	}
+	if h.Expiration > 0 {
+		upload.ExpiresAt = upload.CreatedAt.Add(h.Expiration)
+	}
+	if err = h.Storage.Create(upload); err != nil {
+		RenderError(w, r, err)
+		return
+	}
+	w.Header().Set("Location", PrefixR(r)+upload.ID)
+
+	if r.Header.Get("Content-Type") == "application/offset+octet-stream" {
+		if !h.lock(upload.ID) {
+			RenderError(w, r, NewHttpError(http.StatusLocked, "upload in progress"))
+			return
+		}
+		defer h.unlock(upload.ID)
+		if !h.writeChunk(w, r, upload) {
+			return
+		}
+	}
+	if upload.Complete() && !h.complete(w, r, upload) {
+		return
+	}
+	h.setUploadHeaders(w, upload)
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (h *TusHandler) head(w http.ResponseWriter, r *http.Request, id string) {
+	upload, ok := h.get(w, r, id)
+	if !ok {
+		return
+	}
+	header := w.Header()
+	header.Set("Cache-Control", "no-store")
+	if upload.SizeDeferred() {
+		header.Set("Upload-Defer-Length", "1")
+	} else {
+		header.Set("Upload-Length", strconv.FormatInt(upload.Size, 10))
+	}
+	if len(upload.Metadata) > 0 {
+		header.Set("Upload-Metadata", formatTusMetadata(upload.Metadata))
+	}
+	h.setUploadHeaders(w, upload)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *TusHandler) patch(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		RenderError(w, r, NewHttpError(http.StatusUnsupportedMediaType, "the content type must be application/offset+octet-stream"))
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		RenderError(w, r, NewHttpError(http.StatusBadRequest, "invalid Upload-Offset header"))
+		return
+	}
+	if !h.lock(id) {
+		RenderError(w, r, NewHttpError(http.StatusLocked, "upload in progress"))
+		return
+	}
+	defer h.unlock(id)
+
+	upload, ok := h.get(w, r, id)
+	if !ok {
+		return
+	}
+	if offset != upload.Offset {
+		RenderError(w, r, NewHttpError(http.StatusConflict, "Upload-Offset does not match the upload offset "+strconv.FormatInt(upload.Offset, 10)))
+		return
+	}
+	// the retries of the completed uploads are not completed again
+	wasComplete := upload.Complete()
+	if v := r.Header.Get("Upload-Length"); v != "" && upload.SizeDeferred() {
+		size, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || size < upload.Offset {
+			RenderError(w, r, NewHttpError(http.StatusBadRequest, "invalid Upload-Length header"))
+			return
+		}
+		if h.MaxSize > 0 && size > h.MaxSize {
+			RenderError(w, r, NewHttpError(http.StatusRequestEntityTooLarge, "max upload size of "+strconv.FormatInt(h.MaxSize, 10)+" bytes exceeded"))
+			return
+		}
+		upload.Size = size
+		if err = h.Storage.Update(upload); err != nil {
+			RenderError(w, r, err)
+			return
+		}
+	}
+	if !h.writeChunk(w, r, upload) {
+		return
+	}
+	if !wasComplete && upload.Complete() && !h.complete(w, r, upload) {
+		return
+	}
+	h.setUploadHeaders(w, upload)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *TusHandler) terminate(w http.ResponseWriter, r *http.Request, id string) {
+	if !h.lock(id) {
+		RenderError(w, r, NewHttpError(http.StatusLocked, "upload in progress"))
+		return
+	}
+	defer h.unlock(id)
+	if err := h.Storage.Terminate(id); err != nil {
+		h.renderStorageError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// get returns the upload of id or renders the not found or expiration
+// errors.
+func (h *TusHandler) get(w http.ResponseWriter, r *http.Request, id string) (upload *TusUpload, ok bool) {
+	upload, err := h.Storage.Get(id)
+	if err != nil {
+		h.renderStorageError(w, r, err)
+		return
+	}
+	if upload.Expired(time.Now()) {
+		if err = h.Storage.Terminate(id); err != nil && !errors.Is(err, ErrTusUploadNotFound) {
+			log.Errorf("tus: terminate expired upload %q failed: %v", id, err)
+		}
+		RenderError(w, r, NewHttpError(http.StatusGone, "upload expired"))
+		return
+	}
+	return upload, true
+}
+
+func (h *TusHandler) renderStorageError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, ErrTusUploadNotFound) {
+		NotFound(w, r)
+		return
+	}
+	RenderError(w, r, err)
+}
+
+// maxChunkSize returns the max request body length or -1 if unlimited. The
+// MaxChunkSize is capped by the request post size, if limited, so the bigger
+// chunks are rejected before the copy.
+func (h *TusHandler) maxChunkSize(r *http.Request) int64 {
+	max := h.MaxChunkSize
+	if r.Context().Value(post_limit.PostSizeKey) != nil {
+		if postSize := post_limit.MaxPostSizeOf(r); max <= 0 || postSize < max {
+			max = postSize
+		}
+	}
+	if max <= 0 {
+		return -1
+	}
+	return max
+}
+
+// writeChunk stores the request body into upload, reporting if succeeded,
+// otherwise the error was rendered.
+func (h *TusHandler) writeChunk(w http.ResponseWriter, r *http.Request, upload *TusUpload) bool {
+	maxChunk := h.maxChunkSize(r)
+	if maxChunk >= 0 && r.ContentLength > maxChunk {
+		RenderError(w, r, NewHttpError(http.StatusRequestEntityTooLarge, "max chunk size of "+strconv.FormatInt(maxChunk, 10)+" bytes exceeded"))
+		return false
+	}
+	if !upload.SizeDeferred() && r.ContentLength > upload.Size-upload.Offset {
+		RenderError(w, r, NewHttpError(http.StatusRequestEntityTooLarge, "the chunk exceeds the upload length"))
+		return false
+	}
+
+	var body io.Reader = r.Body
+	if maxChunk >= 0 {
+		body = http.MaxBytesReader(w, r.Body, maxChunk)
+	}
+	remaining := int64(-1)
+	if !upload.SizeDeferred() {
+		remaining = upload.Size - upload.Offset
+	} else if h.MaxSize > 0 {
+		remaining = h.MaxSize - upload.Offset
+	}
+	if remaining >= 0 {
+		body = &tusLimitReader{r: body, n: remaining}
+	}
+	if v := r.Header.Get("Upload-Checksum"); v != "" {
+		name, sum, _ := strings.Cut(v, " ")
+		newHash := TusChecksumAlgorithms[name]
+		if newHash == nil {
+			RenderError(w, r, NewHttpError(http.StatusBadRequest, "unsupported checksum algorithm "+strconv.Quote(name)))
+			return false
+		}
+		expected, err := base64.StdEncoding.DecodeString(sum)
+		if err != nil {
+			RenderError(w, r, NewHttpError(http.StatusBadRequest, "invalid Upload-Checksum header"))
+			return false
+		}
+		body = &tusChecksumReader{r: body, hash: newHash(), sum: expected}
+	}
+
+	n, err := h.Storage.WriteChunk(upload.ID, upload.Offset, body)
+	upload.Offset += n
+	if err == nil && h.Expiration > 0 && !upload.Complete() {
+		upload.ExpiresAt = time.Now().Add(h.Expiration)
+		err = h.Storage.Update(upload)
+	}
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		switch {
+		case errors.Is(err, ErrTusChecksumMismatch):
+			RenderError(w, r, &HttpError{Status: StatusChecksumMismatch, Title: "Checksum Mismatch", Detail: err.Error()})
+		case errors.As(err, &maxBytesErr):
+			RenderError(w, r, NewHttpError(http.StatusRequestEntityTooLarge, "max chunk size of "+strconv.FormatInt(maxChunk, 10)+" bytes exceeded"))
+		case errors.Is(err, errTusUploadExceeded):
+			RenderError(w, r, NewHttpError(http.StatusRequestEntityTooLarge, err.Error()))
+		default:
+			h.renderStorageError(w, r, err)
+		}
+		return false
+	}
+	return true
+}
+
+// complete calls OnComplete, reporting if succeeded, otherwise the error was
+// rendered.
+func (h *TusHandler) complete(w http.ResponseWriter, r *http.Request, upload *TusUpload) bool {
+	if h.OnComplete == nil {
+		return true
+	}
+	if err := h.OnComplete(r, upload); err != nil {
+		RenderError(w, r, err)
+		return false
+	}
+	return true
+}
+
+func (h *TusHandler) setUploadHeaders(w http.ResponseWriter, upload *TusUpload) {
+	header := w.Header()
+	header.Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	if !upload.ExpiresAt.IsZero() && !upload.Complete() {
+		header.Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	}
+}
+
+// lock locks the upload of id, reporting false if already locked by other
+// request.
+func (h *TusHandler) lock(id string) bool {
+	_, loaded := h.locks.LoadOrStore(id, true)
+	return !loaded
+}
+
+func (h *TusHandler) unlock(id string) {
+	h.locks.Delete(id)
+}
+
+// parseTusMetadata parses the Upload-Metadata header, the comma separated
+// "key base64value" pairs.
+func parseTusMetadata(value string) (metadata map[string]string, err error) {
+	for _, pair := range strings.Split(value, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		key, encoded, _ := strings.Cut(pair, " ")
+		var v []byte
+		if v, err = base64.StdEncoding.DecodeString(encoded); err != nil || key == "" {
+			return nil, errors.New("invalid Upload-Metadata header")
+		}
+		if metadata == nil {
+			metadata = map[string]string{}
+		}
+		metadata[key] = string(v)
+	}
+	return
+}
+
+func formatTusMetadata(metadata map[string]string) string {
+	pairs := make([]string, 0, len(metadata))
+	for key, v := range metadata {
+		if v == "" {
+			pairs = append(pairs, key)
+		} else {
+			pairs = append(pairs, key+" "+base64.StdEncoding.EncodeToString([]byte(v)))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+var errTusUploadExceeded = errors.New("the chunk exceeds the upload length")
+
+// tusLimitReader reads up to n bytes, failing if r has more.
+type tusLimitReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *tusLimitReader) Read(p []byte) (n int, err error) {
+	if l.n <= 0 {
+		var b [1]byte
+		if n, err = l.r.Read(b[:]); n > 0 {
+			return 0, errTusUploadExceeded
+		}
+		return 0, err
+	}
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	n, err = l.r.Read(p)
+	l.n -= int64(n)
+	return
+}
+
+// tusChecksumReader fails with ErrTusChecksumMismatch at EOF if the read data
+// does not match sum.
+type tusChecksumReader struct {
+	r    io.Reader
+	hash hash.Hash
+	sum  []byte
+}
+
+func (c *tusChecksumReader) Read(p []byte) (n int, err error) {
+	n, err = c.r.Read(p)
+	c.hash.Write(p[:n])
+	if err == io.EOF && string(c.hash.Sum(nil)) != string(c.sum) {
+		err = ErrTusChecksumMismatch
+	}
+	return
+}
@@ -0,0 +1,256 @@
+package httpu
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrTusUploadNotFound is returned by TusStorage if the upload does not
+	// exist.
+	ErrTusUploadNotFound = errors.New("upload not found")
+	// ErrTusChecksumMismatch is returned by the chunk reader if the chunk does
+	// not match the Upload-Checksum header. The TusStorage must discard the
+	// chunk.
+	ErrTusChecksumMismatch = errors.New("checksum mismatch")
+)
+
+// TusUpload is a resumable upload.
+type TusUpload struct {
+	ID string `json:"id"`
+	// Size is the upload length, or -1 if deferred.
+	Size int64 `json:"size"`
+	// Offset is the number of received bytes.
+	Offset   int64             `json:"-"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// CreatedAt is the creation time.
+	CreatedAt time.Time `json:"created_at"`
+	// ExpiresAt is the time the incomplete upload expires. If zero, it does
+	// not expire.
+	ExpiresAt time.Time `json:"expires_at,omitempty"`
+}
+
+// SizeDeferred reports if the upload length is not known yet.
+func (u *TusUpload) SizeDeferred() bool {
+	return u.Size < 0
+}
+
+// Complete reports if all bytes were received.
+func (u *TusUpload) Complete() bool {
+	return u.Size >= 0 && u.Offset == u.Size
+}
+
+// Expired reports if the incomplete upload expired at now.
+func (u *TusUpload) Expired(now time.Time) bool {
+	return !u.ExpiresAt.IsZero() && !u.Complete() && now.After(u.ExpiresAt)
+}
+
+// TusStorage stores the TusHandler uploads.
+type TusStorage interface {
+	// Create stores the new upload, setting its ID.
+	Create(upload *TusUpload) error
+	// Get returns the upload of id or ErrTusUploadNotFound.
+	Get(id string) (*TusUpload, error)
+	// Update stores the upload size and expiration changes.
+	Update(upload *TusUpload) error
+	// WriteChunk appends the data of r to the upload at offset, returning the
+	// number of stored bytes. If r fails, the bytes read before are kept,
+	// so the client resumes from them, except on ErrTusChecksumMismatch.
+	WriteChunk(id string, offset int64, r io.Reader) (n int64, err error)
+	// Terminate removes the upload and its data.
+	Terminate(id string) error
+}
+
+// DiskTusStorage is a TusStorage of files in Dir: the upload data in <id>
+// and its info in <id>.info.
+type DiskTusStorage struct {
+	Dir string
+}
+
+// NewDiskTusStorage creates the DiskTusStorage of dir, creating it if does
+// not exist.
+func NewDiskTusStorage(dir string) (s *DiskTusStorage, err error) {
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return
+	}
+	return &DiskTusStorage{Dir: dir}, nil
+}
+
+// validTusID reports if id is a hex upload id, so it is safe as file name.
+func validTusID(id string) bool {
+	if id == "" {
+		return false
+	}
+	for _, c := range id {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// Path returns the data file path of upload id.
+func (s *DiskTusStorage) Path(id string) string {
+	return filepath.Join(s.Dir, id)
+}
+
+// Open opens the data file of upload id for reading.
+func (s *DiskTusStorage) Open(id string) (*os.File, error) {
+	if !validTusID(id) {
+		return nil, ErrTusUploadNotFound
+	}
+	f, err := os.Open(s.Path(id))
+	if errors.Is(err, fs.ErrNotExist) {
+		err = ErrTusUploadNotFound
+	}
+	return f, err
+}
+
+func (s *DiskTusStorage) Create(upload *TusUpload) (err error) {
+	id := make([]byte, 16)
+	if _, err = rand.Read(id); err != nil {
+		return
+	}
+	upload.ID = hex.EncodeToString(id)
+	var f *os.File
+	if f, err = os.OpenFile(s.Path(upload.ID), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600); err != nil {
+		return
+	}
+	f.Close()
+	if err = s.Update(upload); err != nil {
+		os.Remove(s.Path(upload.ID))
+	}
+	return
+}
+
+func (s *DiskTusStorage) Get(id string) (upload *TusUpload, err error) {
+	if !validTusID(id) {
+		return nil, ErrTusUploadNotFound
+	}
+	data, err := os.ReadFile(s.Path(id) + ".info")
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			err = ErrTusUploadNotFound
+		}
+		return
+	}
+	upload = &TusUpload{}
+	if err = json.Unmarshal(data, upload); err != nil {
+		return nil, err
+	}
+	// the data file size is the offset, so the interrupted writes are kept
+	var info fs.FileInfo
+	if info, err = os.Stat(s.Path(id)); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			err = ErrTusUploadNotFound
+		}
+		return nil, err
+	}
+	upload.Offset = info.Size()
+	return
+}
+
+func (s *DiskTusStorage) Update(upload *TusUpload) (err error) {
+	data, err := json.Marshal(upload)
+	if err != nil {
+		return
+	}
+	f, err := os.CreateTemp(s.Dir, ".tmp-*")
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(f.Name())
+		}
+	}()
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		return
+	}
+	if err = f.Close(); err != nil {
+		return
+	}
+	return os.Rename(f.Name(), s.Path(upload.ID)+".info")
+}
+
+func (s *DiskTusStorage) WriteChunk(id string, offset int64, r io.Reader) (n int64, err error) {
+	if !validTusID(id) {
+		return 0, ErrTusUploadNotFound
+	}
+	f, err := os.OpenFile(s.Path(id), os.O_WRONLY, 0)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			err = ErrTusUploadNotFound
+		}
+		return
+	}
+	defer func() {
+		if errors.Is(err, ErrTusChecksumMismatch) {
+			f.Truncate(offset)
+			n = 0
+		}
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}()
+	if _, err = f.Seek(offset, io.SeekStart); err != nil {
+		return
+	}
+	return io.Copy(f, r)
+}
+
+func (s *DiskTusStorage) Terminate(id string) (err error) {
+	if !validTusID(id) {
+		return ErrTusUploadNotFound
+	}
+	if err = os.Remove(s.Path(id) + ".info"); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			err = ErrTusUploadNotFound
+		}
+		return
+	}
+	if err = os.Remove(s.Path(id)); errors.Is(err, fs.ErrNotExist) {
+		err = nil
+	}
+	return
+}
+
+// RemoveExpired terminates the uploads expired at now, returning the number
+// of removed uploads.
+func (s *DiskTusStorage) RemoveExpired(now time.Time) (n int, err error) {
+	entries, err := os.ReadDir(s.Dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".info")
+		if !ok || !validTusID(id) {
+			continue
+		}
+		var upload *TusUpload
+		if upload, err = s.Get(id); err != nil {
+			if errors.Is(err, ErrTusUploadNotFound) {
+				err = nil
+				continue
+			}
+			return
+		}
+		if upload.Expired(now) {
+			if err = s.Terminate(id); err != nil && !errors.Is(err, ErrTusUploadNotFound) {
+				return
+			}
+			err = nil
+			n++
+		}
+	}
+	return
+}
@@ -0,0 +1,179 @@
+package httpu
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	post_limit "github.com/moisespsena-go/http-post-limit"
+)
+
+func TestTusHandlerMaxChunkSize(t *testing.T) {
+	for _, tt := range []struct {
+		maxChunk, postSize, want int64
+	}{
+		{0, 0, -1},
+		{100, 0, 100},
+		{0, 50, 50},
+		{100, 50, 50},
+		{50, 100, 50},
+	} {
+		r := httptest.NewRequest("PATCH", "/", nil)
+		if tt.postSize > 0 {
+			r = r.WithContext(context.WithValue(r.Context(), post_limit.PostSizeKey, tt.postSize))
+		}
+		h := &TusHandler{MaxChunkSize: tt.maxChunk}
+		if got := h.maxChunkSize(r); got != tt.want {
+			t.Errorf("MaxChunkSize %d, post size %d: got %d, want %d", tt.maxChunk, tt.postSize, got, tt.want)
+		}
+	}
+}
+
+// tusTestServe serves the tus request of method and target with the body
+// and header pairs.
+func tusTestServe(h http.Handler, method, target, body string, header ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	r = SetPrefixR(r, "/")
+	r.Header.Set("Tus-Resumable", TusVersion)
+	if method == http.MethodPatch || body != "" {
+		r.Header.Set("Content-Type", "application/offset+octet-stream")
+	}
+	for i := 0; i < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func newTusTestHandler(t *testing.T) (h *TusHandler, completed *int) {
+	storage, err := NewDiskTusStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	completed = new(int)
+	h = NewTusHandler(storage)
+	h.OnComplete = func(r *http.Request, upload *TusUpload) error {
+		*completed++
+		return nil
+	}
+	return
+}
+
+func tusTestCreate(t *testing.T, h http.Handler, body string, header ...string) (location string) {
+	w := tusTestServe(h, "POST", "/", body, header...)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: code = %d: %s", w.Code, w.Body)
+	}
+	return w.Header().Get("Location")
+}
+
+func TestTusHandlerComplete(t *testing.T) {
+	h, completed := newTusTestHandler(t)
+	location := tusTestCreate(t, h, "", "Upload-Length", "10")
+	for _, tt := range []struct {
+		offset, body string
+		code         int
+		completed    int
+	}{
+		{"0", "01234", http.StatusNoContent, 0},
+		{"0", "01234", http.StatusConflict, 0},
+		{"5", "56789", http.StatusNoContent, 1},
+		// the client retry of the last chunk
+		{"10", "", http.StatusNoContent, 1},
+		{"10", "x", http.StatusRequestEntityTooLarge, 1},
+	} {
+		w := tusTestServe(h, "PATCH", location, tt.body, "Upload-Offset", tt.offset)
+		if w.Code != tt.code || *completed != tt.completed {
+			t.Errorf("PATCH %s %q: code = %d, completed = %d, want %d, %d", tt.offset, tt.body, w.Code, *completed, tt.code, tt.completed)
+		}
+	}
+
+	// creation-with-upload
+	tusTestCreate(t, h, "abc", "Upload-Length", "3")
+	if *completed != 2 {
+		t.Errorf("creation-with-upload: completed = %d", *completed)
+	}
+	tusTestCreate(t, h, "", "Upload-Length", "0")
+	if *completed != 3 {
+		t.Errorf("empty upload: completed = %d", *completed)
+	}
+}
+
+func TestTusHandlerChecksum(t *testing.T) {
+	h, _ := newTusTestHandler(t)
+	location := tusTestCreate(t, h, "", "Upload-Length", "5")
+	sum := sha1.Sum([]byte("hello"))
+	checksum := "sha1 " + base64.StdEncoding.EncodeToString(sum[:])
+
+	w := tusTestServe(h, "PATCH", location, "hellO", "Upload-Offset", "0", "Upload-Checksum", checksum)
+	if w.Code != StatusChecksumMismatch {
+		t.Fatalf("mismatch: code = %d", w.Code)
+	}
+	if w = tusTestServe(h, "HEAD", location, ""); w.Header().Get("Upload-Offset") != "0" {
+		t.Fatalf("the mismatched chunk was kept: offset = %s", w.Header().Get("Upload-Offset"))
+	}
+	if w = tusTestServe(h, "PATCH", location, "hello", "Upload-Offset", "0", "Upload-Checksum", "crc32 AAAA"); w.Code != http.StatusBadRequest {
+		t.Errorf("unsupported algorithm: code = %d", w.Code)
+	}
+	if w = tusTestServe(h, "PATCH", location, "hello", "Upload-Offset", "0", "Upload-Checksum", checksum); w.Code != http.StatusNoContent {
+		t.Errorf("match: code = %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestTusHandlerDeferredLength(t *testing.T) {
+	h, completed := newTusTestHandler(t)
+	h.MaxSize = 10
+	location := tusTestCreate(t, h, "", "Upload-Defer-Length", "1")
+
+	if w := tusTestServe(h, "PATCH", location, "abc", "Upload-Offset", "0"); w.Code != http.StatusNoContent {
+		t.Fatalf("PATCH: code = %d: %s", w.Code, w.Body)
+	}
+	w := tusTestServe(h, "HEAD", location, "")
+	if w.Header().Get("Upload-Defer-Length") != "1" || w.Header().Get("Upload-Offset") != "3" {
+		t.Fatalf("HEAD: header = %v", w.Header())
+	}
+	if w = tusTestServe(h, "PATCH", location, "", "Upload-Offset", "3", "Upload-Length", "11"); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("length over MaxSize: code = %d", w.Code)
+	}
+	if w = tusTestServe(h, "PATCH", location, "", "Upload-Offset", "3", "Upload-Length", "2"); w.Code != http.StatusBadRequest {
+		t.Errorf("length under offset: code = %d", w.Code)
+	}
+	// the length of the received bytes completes the upload without data
+	if w = tusTestServe(h, "PATCH", location, "", "Upload-Offset", "3", "Upload-Length", "3"); w.Code != http.StatusNoContent || *completed != 1 {
+		t.Fatalf("PATCH length: code = %d, completed = %d", w.Code, *completed)
+	}
+	if w = tusTestServe(h, "HEAD", location, ""); w.Header().Get("Upload-Length") != "3" {
+		t.Errorf("HEAD: header = %v", w.Header())
+	}
+}
+
+func TestTusHandlerExpiration(t *testing.T) {
+	h, _ := newTusTestHandler(t)
+	h.Expiration = time.Hour
+	w := tusTestServe(h, "POST", "/", "", "Upload-Length", "10")
+	if w.Code != http.StatusCreated || w.Header().Get("Upload-Expires") == "" {
+		t.Fatalf("create: code = %d, header = %v", w.Code, w.Header())
+	}
+	id := strings.TrimPrefix(w.Header().Get("Location"), "/")
+	upload, err := h.Storage.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upload.ExpiresAt = time.Now().Add(-time.Second)
+	if err = h.Storage.Update(upload); err != nil {
+		t.Fatal(err)
+	}
+	if w = tusTestServe(h, "PATCH", "/"+id, "abc", "Upload-Offset", "0"); w.Code != http.StatusGone {
+		t.Fatalf("PATCH expired: code = %d", w.Code)
+	}
+	if _, err = h.Storage.Get(id); !errors.Is(err, ErrTusUploadNotFound) {
+		t.Errorf("the expired upload was not terminated: %v", err)
+	}
+}
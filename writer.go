@@ -1,7 +1,9 @@
 package httpu
 
 import (
+	"bufio"
 	"io"
+	"net"
 	"net/http"
 
 	"github.com/pkg/errors"
@@ -69,6 +71,24 @@ func (this *responseWriter) Unwrap() http.ResponseWriter {
 	return this.ResponseWriter
 }
 
+// Flush sends the buffered data of proxied writer to the client, if it
+// supports flushing.
+func (this *responseWriter) Flush() {
+	if !this.wroteHeader {
+		this.WriteHeader(200)
+	}
+	http.NewResponseController(this.ResponseWriter).Flush()
+}
+
+// Hijack hijacks the connection of proxied writer. After hijacking, the
+// header is taken as sent.
+func (this *responseWriter) Hijack() (c net.Conn, rw *bufio.ReadWriter, err error) {
+	if c, rw, err = http.NewResponseController(this.ResponseWriter).Hijack(); err == nil {
+		this.wroteHeader = true
+	}
+	return
+}
+
 type teeResponseWriter struct {
 	http.ResponseWriter
 	tee []io.Writer